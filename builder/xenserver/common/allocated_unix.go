@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// allocatedSize is how much of the filesystem a possibly sparse file takes.
+func allocatedSize(info os.FileInfo) (int64, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no block count for %s", info.Name())
+	}
+	return int64(stat.Blocks) * 512, nil
+}
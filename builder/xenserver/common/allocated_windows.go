@@ -0,0 +1,11 @@
+package common
+
+import (
+	"os"
+)
+
+// allocatedSize is how much of the filesystem a possibly sparse file takes.
+// Windows doesn't report it through FileInfo, so it's taken to be all of it.
+func allocatedSize(info os.FileInfo) (int64, error) {
+	return info.Size(), nil
+}
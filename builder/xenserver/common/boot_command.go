@@ -0,0 +1,311 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ * Boot commands are typed a token at a time. A token is a character, a
+ * special key in angle brackets such as <enter> or <f10>, a special key with
+ * On or Off appended to hold it down or let it go, such as <leftCtrlOn>, or
+ * a wait: <wait> for a second, <wait5> for five seconds, or a duration such
+ * as <wait500ms> or <wait2m>. Names in angle brackets aren't case sensitive,
+ * and the whole name up to the closing bracket has to match, so <f1> is
+ * never taken for the start of <f10>. Anything in angle brackets that isn't
+ * one of these is typed as it is. Characters are typed with the keys, and
+ * Shift or AltGr, that boot_keyboard_layout has them on.
+ *
+ * Two tokens work with the screen rather than the keyboard: <screenshot>
+ * saves a picture of it, and <waitForScreenChange> waits for it to change
+ * and then stay the same for a moment, such as while an installer loads its
+ * next page. That waits for up to five minutes, or for a number of seconds
+ * or a duration given as with <wait>, such as <waitForScreenChange10m>.
+ */
+
+const KeyLeftShift uint = 0xFFE1
+
+const screenChangeTimeout = 5 * time.Minute
+
+// specialKeys maps the names of special keys, in lower case, to their X
+// keysyms. See https://github.com/qemu/qemu/blob/master/ui/vnc_keysym.h
+var specialKeys = map[string]uint32{
+	"bs":       0xFF08,
+	"del":      0xFFFF,
+	"enter":    0xFF0D,
+	"esc":      0xFF1B,
+	"return":   0xFF0D,
+	"tab":      0xFF09,
+	"up":       0xFF52,
+	"down":     0xFF54,
+	"left":     0xFF51,
+	"right":    0xFF53,
+	"spacebar": 0x0020,
+	"insert":   0xFF63,
+	"home":     0xFF50,
+	"end":      0xFF57,
+	"pageup":   0xFF55,
+	"pagedown": 0xFF56,
+
+	"f1":  0xFFBE,
+	"f2":  0xFFBF,
+	"f3":  0xFFC0,
+	"f4":  0xFFC1,
+	"f5":  0xFFC2,
+	"f6":  0xFFC3,
+	"f7":  0xFFC4,
+	"f8":  0xFFC5,
+	"f9":  0xFFC6,
+	"f10": 0xFFC7,
+	"f11": 0xFFC8,
+	"f12": 0xFFC9,
+
+	"leftshift":  0xFFE1,
+	"rightshift": 0xFFE2,
+	"leftctrl":   0xFFE3,
+	"rightctrl":  0xFFE4,
+	"leftalt":    0xFFE9,
+	"rightalt":   0xFFEA,
+	"leftsuper":  0xFFEB,
+	"rightsuper": 0xFFEC,
+	"capslock":   0xFFE5,
+	"numlock":    0xFF7F,
+
+	"kp0":        0xFFB0,
+	"kp1":        0xFFB1,
+	"kp2":        0xFFB2,
+	"kp3":        0xFFB3,
+	"kp4":        0xFFB4,
+	"kp5":        0xFFB5,
+	"kp6":        0xFFB6,
+	"kp7":        0xFFB7,
+	"kp8":        0xFFB8,
+	"kp9":        0xFFB9,
+	"kpenter":    0xFF8D,
+	"kpadd":      0xFFAB,
+	"kpsubtract": 0xFFAD,
+	"kpmultiply": 0xFFAA,
+	"kpdivide":   0xFFAF,
+	"kpdecimal":  0xFFAE,
+}
+
+// shiftKeys are the keysyms that count as shift being held.
+var shiftKeys = map[uint32]bool{0xFFE1: true, 0xFFE2: true}
+
+type bootCommandAction int
+
+const (
+	keyPress bootCommandAction = iota
+	keyDown
+	keyUp
+	keyWait
+	screenshot
+	waitForScreenChange
+)
+
+// bootCommandToken is one thing to do while typing a boot command. A
+// character is left for the keyboard layout to turn into a key.
+type bootCommandToken struct {
+	action bootCommandAction
+	keysym uint32
+	char   rune
+	wait   time.Duration
+	text   string
+}
+
+// parseBootCommand splits a boot command into tokens.
+func parseBootCommand(command string) []bootCommandToken {
+	var tokens []bootCommandToken
+	for len(command) > 0 {
+		if strings.HasPrefix(command, "<") {
+			if end := strings.Index(command, ">"); end > 0 {
+				if token, ok := parseSpecial(command[1:end]); ok {
+					token.text = command[:end+1]
+					tokens = append(tokens, token)
+					command = command[end+1:]
+					continue
+				}
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(command)
+		tokens = append(tokens, bootCommandToken{action: keyPress, char: r, text: command[:size]})
+		command = command[size:]
+	}
+	return tokens
+}
+
+// parseSpecial parses the name between angle brackets.
+func parseSpecial(name string) (bootCommandToken, bool) {
+	lower := strings.ToLower(name)
+	if keysym, ok := specialKeys[lower]; ok {
+		return bootCommandToken{action: keyPress, keysym: keysym}, true
+	}
+	if keysym, ok := specialKeys[strings.TrimSuffix(lower, "off")]; ok && strings.HasSuffix(lower, "off") {
+		return bootCommandToken{action: keyUp, keysym: keysym}, true
+	}
+	if keysym, ok := specialKeys[strings.TrimSuffix(lower, "on")]; ok && strings.HasSuffix(lower, "on") {
+		return bootCommandToken{action: keyDown, keysym: keysym}, true
+	}
+
+	if lower == "screenshot" {
+		return bootCommandToken{action: screenshot}, true
+	}
+	if strings.HasPrefix(lower, "waitforscreenchange") {
+		timeout, ok := screenChangeTimeout, true
+		if suffix := lower[len("waitforscreenchange"):]; suffix != "" {
+			timeout, ok = parseWait(suffix)
+		}
+		if ok {
+			return bootCommandToken{action: waitForScreenChange, wait: timeout}, true
+		}
+	}
+	if strings.HasPrefix(lower, "wait") {
+		if wait, ok := parseWait(lower[len("wait"):]); ok {
+			return bootCommandToken{action: keyWait, wait: wait}, true
+		}
+	}
+	return bootCommandToken{}, false
+}
+
+// parseWait parses what follows "wait": nothing for a second, a number of
+// seconds, or a duration.
+func parseWait(s string) (time.Duration, bool) {
+	if s == "" {
+		return time.Second, true
+	}
+	if seconds, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if wait, err := time.ParseDuration(s); err == nil && wait >= 0 {
+		return wait, true
+	}
+	return 0, false
+}
+
+// bootConsole is the VM's console as boot commands see it: they're typed
+// on its keyboard, and can save or watch its screen.
+type bootConsole interface {
+	KeyEvent(keysym uint32, down bool) error
+	Screenshot() error
+	WaitForScreenChange(timeout time.Duration) error
+}
+
+// bootCommandTyper types boot commands for a keyboard layout, pausing
+// keyInterval after each key and groupInterval after each command. wait
+// does the pausing, returning an error if the build is interrupted; it's
+// called after every key, even when there's no interval, so an interrupt
+// stops the typing straight away.
+type bootCommandTyper struct {
+	conn          bootConsole
+	layout        keyboardLayout
+	keyInterval   time.Duration
+	groupInterval time.Duration
+	wait          func(time.Duration) error
+	held          map[uint32]bool
+}
+
+func newBootCommandTyper(conn bootConsole, layout keyboardLayout, keyInterval, groupInterval time.Duration, wait func(time.Duration) error) *bootCommandTyper {
+	return &bootCommandTyper{
+		conn:          conn,
+		layout:        layout,
+		keyInterval:   keyInterval,
+		groupInterval: groupInterval,
+		wait:          wait,
+		held:          make(map[uint32]bool),
+	}
+}
+
+// Type types a boot command.
+func (self *bootCommandTyper) Type(command string) error {
+	for _, token := range parseBootCommand(command) {
+		if err := self.typeToken(token); err != nil {
+			return err
+		}
+	}
+	return self.wait(self.groupInterval)
+}
+
+func (self *bootCommandTyper) typeToken(token bootCommandToken) error {
+	switch token.action {
+	case keyWait:
+		log.Printf("Special code '%s' found, sleeping %s", token.text, token.wait)
+		return self.wait(token.wait)
+
+	case screenshot:
+		log.Printf("Special code '%s' found, saving a screenshot", token.text)
+		if err := self.conn.Screenshot(); err != nil {
+			return fmt.Errorf("Error saving screenshot: %s", err)
+		}
+		return nil
+
+	case waitForScreenChange:
+		log.Printf("Special code '%s' found, waiting up to %s for the screen to change", token.text, token.wait)
+		return self.conn.WaitForScreenChange(token.wait)
+
+	case keyDown, keyUp:
+		down := token.action == keyDown
+		log.Printf("Special code '%s' found, sending key %#x down %v", token.text, token.keysym, down)
+		if err := self.conn.KeyEvent(token.keysym, down); err != nil {
+			return fmt.Errorf("Error sending key: %s", err)
+		}
+		if down {
+			self.held[token.keysym] = true
+		} else {
+			delete(self.held, token.keysym)
+		}
+		return self.wait(self.keyInterval)
+	}
+
+	if token.char == 0 {
+		log.Printf("Special code '%s' found, sending key %#x", token.text, token.keysym)
+		return self.press(token.keysym, false, false)
+	}
+
+	key := self.layout.key(token.char)
+	log.Printf("Sending '%s', code %#x, shift %v, AltGr %v", token.text, key.keysym, key.shift, key.altGr)
+	if err := self.press(key.keysym, key.shift, key.altGr); err != nil {
+		return err
+	}
+	if key.dead {
+		// Finish the dead key, which then types the character itself
+		return self.press(' ', false, false)
+	}
+	return nil
+}
+
+// press presses and lets go of a key, along with shift or AltGr.
+func (self *bootCommandTyper) press(keysym uint32, shift, altGr bool) error {
+	keys := []uint32{keysym}
+	// Don't let go of a shift key that's being held down
+	if shift && !self.shiftHeld() {
+		keys = append([]uint32{uint32(KeyLeftShift)}, keys...)
+	}
+	if altGr && !self.held[keyAltGr] {
+		keys = append([]uint32{keyAltGr}, keys...)
+	}
+	for _, keysym := range keys {
+		if err := self.conn.KeyEvent(keysym, true); err != nil {
+			return fmt.Errorf("Error sending key: %s", err)
+		}
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := self.conn.KeyEvent(keys[i], false); err != nil {
+			return fmt.Errorf("Error sending key: %s", err)
+		}
+	}
+	return self.wait(self.keyInterval)
+}
+
+func (self *bootCommandTyper) shiftHeld() bool {
+	for keysym := range self.held {
+		if shiftKeys[keysym] {
+			return true
+		}
+	}
+	return false
+}
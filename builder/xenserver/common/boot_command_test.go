@@ -0,0 +1,226 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingConn records key events, screenshots and waits for the screen,
+// and the typer's waits other than the ones with nothing to wait for, as
+// they happen.
+type recordingConn struct {
+	events []string
+	fail   bool
+}
+
+func (c *recordingConn) KeyEvent(keysym uint32, down bool) error {
+	if c.fail {
+		return errors.New("connection closed")
+	}
+	direction := "up"
+	if down {
+		direction = "down"
+	}
+	c.events = append(c.events, fmt.Sprintf("%s %#x", direction, keysym))
+	return nil
+}
+
+func (c *recordingConn) Screenshot() error {
+	c.events = append(c.events, "screenshot")
+	return nil
+}
+
+func (c *recordingConn) WaitForScreenChange(timeout time.Duration) error {
+	c.events = append(c.events, fmt.Sprintf("wait for screen change %s", timeout))
+	return nil
+}
+
+func (c *recordingConn) wait(d time.Duration) error {
+	if d > 0 {
+		c.events = append(c.events, fmt.Sprintf("wait %s", d))
+	}
+	return nil
+}
+
+func testLayout(t *testing.T, name string) keyboardLayout {
+	layout, err := newKeyboardLayout(name)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return layout
+}
+
+func typeRecorded(t *testing.T, layout, command string) []string {
+	conn := new(recordingConn)
+	if err := newBootCommandTyper(conn, testLayout(t, layout), 0, 0, conn.wait).Type(command); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return conn.events
+}
+
+func TestBootCommandTyper(t *testing.T) {
+	cases := []struct {
+		command string
+		events  []string
+	}{
+		{"a", []string{"down 0x61", "up 0x61"}},
+		{"A!", []string{
+			"down 0xffe1", "down 0x61", "up 0x61", "up 0xffe1",
+			"down 0xffe1", "down 0x31", "up 0x31", "up 0xffe1",
+		}},
+
+		// The whole name has to match, so these are never confused
+		{"<f1><f10>", []string{"down 0xffbe", "up 0xffbe", "down 0xffc7", "up 0xffc7"}},
+		{"<F1>0", []string{"down 0xffbe", "up 0xffbe", "down 0x30", "up 0x30"}},
+		{"<enter><ENTER><Return>", []string{
+			"down 0xff0d", "up 0xff0d", "down 0xff0d", "up 0xff0d", "down 0xff0d", "up 0xff0d",
+		}},
+
+		// Modifiers and other special keys held down and let go
+		{"<leftCtrlOn>c<leftCtrlOff>", []string{"down 0xffe3", "down 0x63", "up 0x63", "up 0xffe3"}},
+		{"<leftAltOn><rightAltOn><del><rightAltOff><leftAltOff>", []string{
+			"down 0xffe9", "down 0xffea", "down 0xffff", "up 0xffff", "up 0xffea", "up 0xffe9",
+		}},
+		{"<enterOn><enterOff>", []string{"down 0xff0d", "up 0xff0d"}},
+
+		// A held shift isn't let go by a shifted character
+		{"<leftShiftOn>A<leftShiftOff>", []string{"down 0xffe1", "down 0x61", "up 0x61", "up 0xffe1"}},
+
+		// Keypad
+		{"<kp7><kpEnter><kpAdd>", []string{"down 0xffb7", "up 0xffb7", "down 0xff8d", "up 0xff8d", "down 0xffab", "up 0xffab"}},
+
+		// Waits
+		{"<wait><wait5><wait10>", []string{"wait 1s", "wait 5s", "wait 10s"}},
+		{"<wait2m><wait500ms><wait1m30s><WAIT3S>", []string{"wait 2m0s", "wait 500ms", "wait 1m30s", "wait 3s"}},
+
+		// The screen
+		{"<screenshot><waitForScreenChange><waitForScreenChange30><WAITFORSCREENCHANGE2m>", []string{
+			"screenshot", "wait for screen change 5m0s", "wait for screen change 30s", "wait for screen change 2m0s",
+		}},
+
+		// Anything else in angle brackets is typed as it is
+		{"<x>", []string{
+			"down 0xffe1", "down 0x2c", "up 0x2c", "up 0xffe1",
+			"down 0x78", "up 0x78",
+			"down 0xffe1", "down 0x2e", "up 0x2e", "up 0xffe1",
+		}},
+		{"<waitx", []string{
+			"down 0xffe1", "down 0x2c", "up 0x2c", "up 0xffe1",
+			"down 0x77", "up 0x77", "down 0x61", "up 0x61", "down 0x69", "up 0x69",
+			"down 0x74", "up 0x74", "down 0x78", "up 0x78",
+		}},
+		{"<<tab>", []string{"down 0xffe1", "down 0x2c", "up 0x2c", "up 0xffe1", "down 0xff09", "up 0xff09"}},
+	}
+
+	for _, c := range cases {
+		if events := typeRecorded(t, "us", c.command); !reflect.DeepEqual(events, c.events) {
+			t.Errorf("%q:\nexpected %v\n     got %v", c.command, c.events, events)
+		}
+	}
+}
+
+func TestBootCommandTyper_Layouts(t *testing.T) {
+	cases := []struct {
+		layout  string
+		command string
+		events  []string
+	}{
+		// Characters are typed from the keys in the same place on a US keyboard
+		{"de", "zy", []string{"down 0x79", "up 0x79", "down 0x7a", "up 0x7a"}},
+		{"fr", "aq", []string{"down 0x71", "up 0x71", "down 0x61", "up 0x61"}},
+		{"de", "\"", []string{"down 0xffe1", "down 0x32", "up 0x32", "up 0xffe1"}},
+		{"fr", "1", []string{"down 0xffe1", "down 0x31", "up 0x31", "up 0xffe1"}},
+		{"uk", "@", []string{"down 0xffe1", "down 0x27", "up 0x27", "up 0xffe1"}},
+
+		// AltGr is the right Alt key
+		{"de", "@", []string{"down 0xffea", "down 0x71", "up 0x71", "up 0xffea"}},
+		{"fr", "\\", []string{"down 0xffea", "down 0x38", "up 0x38", "up 0xffea"}},
+
+		// The key left of Z on ISO keyboards
+		{"de", "<|", []string{"down 0x3c", "up 0x3c", "down 0xffea", "down 0x3c", "up 0x3c", "up 0xffea"}},
+
+		// A dead key is finished with a space, unless the character's
+		// also on a live key
+		{"de", "^", []string{"down 0x60", "up 0x60", "down 0x20", "up 0x20"}},
+		{"fr", "^", []string{"down 0xffea", "down 0x39", "up 0x39", "up 0xffea"}},
+
+		// Characters the layout doesn't have are sent as they are
+		{"us", "é€", []string{"down 0xe9", "up 0xe9", "down 0x10020ac", "up 0x10020ac"}},
+	}
+
+	for _, c := range cases {
+		if events := typeRecorded(t, c.layout, c.command); !reflect.DeepEqual(events, c.events) {
+			t.Errorf("%s %q:\nexpected %v\n     got %v", c.layout, c.command, c.events, events)
+		}
+	}
+
+	if _, err := newKeyboardLayout("dvorak"); err == nil {
+		t.Fatal("an unknown layout should be an error")
+	}
+}
+
+// Every layout describes all the keys, and lets every printable ASCII
+// character be typed.
+func TestKeyboardLayouts(t *testing.T) {
+	for name := range layoutDescriptions {
+		layout := testLayout(t, name)
+		for r := rune(' '); r <= '~'; r++ {
+			if _, ok := layout[r]; !ok {
+				t.Errorf("%s can't type %q", name, r)
+			}
+		}
+	}
+}
+
+func TestBootCommandTyper_Intervals(t *testing.T) {
+	conn := new(recordingConn)
+	typer := newBootCommandTyper(conn, testLayout(t, "us"), 50*time.Millisecond, time.Second, conn.wait)
+	for _, command := range []string{"a<wait2>", "<enter>"} {
+		if err := typer.Type(command); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	expected := []string{
+		"down 0x61", "up 0x61", "wait 50ms", "wait 2s", "wait 1s",
+		"down 0xff0d", "up 0xff0d", "wait 50ms", "wait 1s",
+	}
+	if !reflect.DeepEqual(conn.events, expected) {
+		t.Fatalf("expected %v, got %v", expected, conn.events)
+	}
+}
+
+func TestBootCommandTyper_Errors(t *testing.T) {
+	conn := &recordingConn{fail: true}
+	if err := newBootCommandTyper(conn, testLayout(t, "us"), 0, 0, conn.wait).Type("a"); err == nil {
+		t.Fatal("a failed key event should be an error")
+	}
+
+	conn = new(recordingConn)
+	interrupted := func(time.Duration) error { return InterruptedError{} }
+	err := newBootCommandTyper(conn, testLayout(t, "us"), 0, 0, interrupted).Type("<wait>a")
+	if _, ok := err.(InterruptedError); !ok {
+		t.Fatalf("expected an interruption, got %v", err)
+	}
+	if len(conn.events) != 0 {
+		t.Fatalf("nothing should be typed after an interruption: %v", conn.events)
+	}
+
+	// An interrupt is noticed between keys, even with no key interval
+	conn = new(recordingConn)
+	interrupted = func(time.Duration) error {
+		if len(conn.events) > 0 {
+			return InterruptedError{}
+		}
+		return nil
+	}
+	err = newBootCommandTyper(conn, testLayout(t, "us"), 0, 0, interrupted).Type("abc")
+	if _, ok := err.(InterruptedError); !ok {
+		t.Fatalf("expected an interruption, got %v", err)
+	}
+	if expected := []string{"down 0x61", "up 0x61"}; !reflect.DeepEqual(conn.events, expected) {
+		t.Fatalf("typing should stop after the first key: %v", conn.events)
+	}
+}
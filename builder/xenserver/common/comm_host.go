@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/multistep"
+)
+
+/*
+ * Where the guest communicator, SSH or WinRM, is reached. By default it's
+ * through a port forwarded over the dom0 SSH tunnel, so the communicator
+ * connects to 127.0.0.1; with ssh_connect_mode "direct" it connects to the
+ * guest's own address and port.
+ */
+
+// CommHost returns the address the communicator connects to: the local end
+// of the port forward, or the guest itself in direct mode.
+func CommHost(state multistep.StateBag) (string, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	if config.SSHConnectMode == "direct" {
+		return InstanceSSHIP(state)
+	}
+	return "127.0.0.1", nil
+}
+
+// CommPort returns the local end of the port forward to the guest
+// communicator, whichever communicator type is in use, or the guest's own
+// port in direct mode.
+func CommPort(state multistep.StateBag) (int, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	if config.SSHConnectMode == "direct" {
+		port, err := InstanceCommPort(state)
+		return int(port), err
+	}
+
+	commLocalPort, ok := state.Get("local_comm_port").(uint)
+	if !ok {
+		return 0, fmt.Errorf("Communicator port forwarding hasn't been set up yet")
+	}
+	return int(commLocalPort), nil
+}
+
+// InstanceCommPort returns the port in the guest that the configured
+// communicator listens on, so it can be forwarded over the dom0 SSH tunnel.
+func InstanceCommPort(state multistep.StateBag) (uint, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	switch config.Comm.Type {
+	case "winrm":
+		return InstanceWinRMPort(state)
+	default:
+		return InstanceSSHPort(state)
+	}
+}
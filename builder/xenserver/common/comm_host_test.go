@@ -0,0 +1,78 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/helper/communicator"
+	"github.com/mitchellh/packer/packer"
+)
+
+func testCommState(mode, commType string) *multistep.BasicStateBag {
+	config := CommonConfig{}
+	config.SSHConnectMode = mode
+	config.Comm = communicator.Config{Type: commType, WinRMPort: 5986}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("commonconfig", config)
+	state.Put("instance_ssh_address", "10.0.0.5")
+	if mode == "tunnel" {
+		state.Put("local_comm_port", uint(2222))
+	}
+	state.Put("ui", &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	})
+	return state
+}
+
+func TestCommHostPort_Tunnel(t *testing.T) {
+	state := testCommState("tunnel", "ssh")
+
+	if host, err := CommHost(state); err != nil || host != "127.0.0.1" {
+		t.Fatalf("bad host: %s %v", host, err)
+	}
+	if port, err := CommPort(state); err != nil || port != 2222 {
+		t.Fatalf("bad port: %d %v", port, err)
+	}
+}
+
+func TestCommHostPort_Direct(t *testing.T) {
+	state := testCommState("direct", "ssh")
+
+	if host, err := CommHost(state); err != nil || host != "10.0.0.5" {
+		t.Fatalf("bad host: %s %v", host, err)
+	}
+	if port, err := CommPort(state); err != nil || port != 22 {
+		t.Fatalf("bad port: %d %v", port, err)
+	}
+
+	state = testCommState("direct", "winrm")
+	if port, err := CommPort(state); err != nil || port != 5986 {
+		t.Fatalf("bad WinRM port: %d %v", port, err)
+	}
+}
+
+func TestStepForwardPortOverSSH_Direct(t *testing.T) {
+	state := testCommState("direct", "ssh")
+
+	// No "host_ssh" in the state, so this would panic if it tried to forward
+	step := &StepForwardPortOverSSH{
+		RemotePort:       InstanceCommPort,
+		RemoteDest:       InstanceSSHIP,
+		HostPortMin:      14000,
+		HostPortMax:      15000,
+		ResultKey:        "local_comm_port",
+		SkipInDirectMode: true,
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+
+	if _, ok := state.GetOk("local_comm_port"); ok {
+		t.Fatal("expected no port forward in direct mode")
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/mitchellh/packer/common"
 	commonssh "github.com/mitchellh/packer/common/ssh"
 	"github.com/mitchellh/packer/template/interpolate"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type CommonConfig struct {
@@ -18,6 +17,21 @@ type CommonConfig struct {
 	Password string `mapstructure:"remote_password"`
 	HostIp   string `mapstructure:"remote_host"`
 
+	XAPIProtocol string `mapstructure:"xapi_protocol"`
+
+	RemoteCAFile             string `mapstructure:"remote_ca_file"`
+	RemoteTLSFingerprint     string `mapstructure:"remote_tls_fingerprint"`
+	RemoteInsecureSkipVerify bool   `mapstructure:"remote_insecure_skip_verify"`
+
+	RemoteSSHUsername           string `mapstructure:"remote_ssh_username"`
+	RemoteSSHPrivateKeyFile     string `mapstructure:"remote_ssh_private_key_file"`
+	RemoteSSHAgentAuth          bool   `mapstructure:"remote_ssh_agent_auth"`
+	RemoteSSHKnownHosts         string `mapstructure:"remote_ssh_known_hosts"`
+	RemoteSSHHostKeyFingerprint string `mapstructure:"remote_ssh_host_key_fingerprint"`
+
+	AffinityHost string `mapstructure:"affinity_host"`
+	Placement    string `mapstructure:"placement"`
+
 	VMName        string   `mapstructure:"vm_name"`
 	VMDescription string   `mapstructure:"vm_description"`
 	SrName        string   `mapstructure:"sr_name"`
@@ -27,12 +41,22 @@ type CommonConfig struct {
 	HostPortMin uint `mapstructure:"host_port_min"`
 	HostPortMax uint `mapstructure:"host_port_max"`
 
-	BootCommand     []string `mapstructure:"boot_command"`
-	ShutdownCommand string   `mapstructure:"shutdown_command"`
+	BootCommand        []string `mapstructure:"boot_command"`
+	BootKeyboardLayout string   `mapstructure:"boot_keyboard_layout"`
+	ShutdownCommand    string   `mapstructure:"shutdown_command"`
 
 	RawBootWait string `mapstructure:"boot_wait"`
 	BootWait    time.Duration
 
+	RawBootKeyInterval      string `mapstructure:"boot_key_interval"`
+	BootKeyInterval         time.Duration
+	RawBootKeyGroupInterval string `mapstructure:"boot_keygroup_interval"`
+	BootKeyGroupInterval    time.Duration
+
+	VNCRecord            bool   `mapstructure:"vnc_record"`
+	RawVNCRecordInterval string `mapstructure:"vnc_record_interval"`
+	VNCRecordInterval    time.Duration
+
 	ToolsIsoName string `mapstructure:"tools_iso_name"`
 
 	HTTPDir     string `mapstructure:"http_directory"`
@@ -50,10 +74,17 @@ type CommonConfig struct {
 	RawSSHWaitTimeout string `mapstructure:"ssh_wait_timeout"`
 	SSHWaitTimeout    time.Duration
 
+	RawUploadTimeout string `mapstructure:"upload_timeout"`
+	UploadTimeout    time.Duration
+
 	OutputDir string `mapstructure:"output_directory"`
 	Format    string `mapstructure:"format"`
+	VHDExport string `mapstructure:"vhd_export"`
 	KeepVM    string `mapstructure:"keep_vm"`
 	IPGetter  string `mapstructure:"ip_getter"`
+
+	ExportConcurrency uint   `mapstructure:"export_concurrency"`
+	ExportCompression string `mapstructure:"export_compression"`
 }
 
 func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig) []error {
@@ -74,6 +105,22 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		c.RawBootWait = "5s"
 	}
 
+	if c.RawBootKeyInterval == "" {
+		c.RawBootKeyInterval = "50ms"
+	}
+
+	if c.RawBootKeyGroupInterval == "" {
+		c.RawBootKeyGroupInterval = "0s"
+	}
+
+	if c.BootKeyboardLayout == "" {
+		c.BootKeyboardLayout = "us"
+	}
+
+	if c.RawVNCRecordInterval == "" {
+		c.RawVNCRecordInterval = "1s"
+	}
+
 	if c.ToolsIsoName == "" {
 		c.ToolsIsoName = "xs-tools.iso"
 	}
@@ -116,6 +163,10 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		c.OutputDir = fmt.Sprintf("output-%s", pc.PackerBuildName)
 	}
 
+	if c.RawUploadTimeout == "" {
+		c.RawUploadTimeout = "24h"
+	}
+
 	if c.VMName == "" {
 		c.VMName = fmt.Sprintf("packer-%s-{{timestamp}}", pc.PackerBuildName)
 	}
@@ -124,6 +175,18 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		c.Format = "xva"
 	}
 
+	if c.VHDExport == "" {
+		c.VHDExport = "http"
+	}
+
+	if c.ExportConcurrency == 0 {
+		c.ExportConcurrency = 1
+	}
+
+	if c.ExportCompression == "" {
+		c.ExportCompression = "none"
+	}
+
 	if c.KeepVM == "" {
 		c.KeepVM = "never"
 	}
@@ -132,6 +195,18 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		c.IPGetter = "auto"
 	}
 
+	if c.XAPIProtocol == "" {
+		c.XAPIProtocol = "xmlrpc"
+	}
+
+	if c.Placement == "" {
+		c.Placement = "xapi"
+	}
+
+	if c.RemoteSSHUsername == "" {
+		c.RemoteSSHUsername = c.Username
+	}
+
 	// Validation
 
 	if c.Username == "" {
@@ -146,6 +221,22 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		errs = append(errs, errors.New("remote_host must be specified."))
 	}
 
+	errs = append(errs, c.prepareTLS()...)
+
+	if c.RemoteSSHPrivateKeyFile != "" {
+		if _, err := commonssh.FileSigner(c.RemoteSSHPrivateKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("remote_ssh_private_key_file is invalid: %s", err))
+		}
+	}
+
+	if c.RemoteSSHAgentAuth && os.Getenv("SSH_AUTH_SOCK") == "" {
+		errs = append(errs, errors.New("remote_ssh_agent_auth needs an SSH agent, but SSH_AUTH_SOCK is not set"))
+	}
+
+	if _, err := c.HostSSHKeyCallback(); err != nil {
+		errs = append(errs, fmt.Errorf("remote_ssh_known_hosts or remote_ssh_host_key_fingerprint is invalid: %s", err))
+	}
+
 	if c.HostPortMin > c.HostPortMax {
 		errs = append(errs, errors.New("the host min port must be less than the max"))
 	}
@@ -159,6 +250,27 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		errs = append(errs, fmt.Errorf("Failed to parse boot_wait: %s", err))
 	}
 
+	c.BootKeyInterval, err = time.ParseDuration(c.RawBootKeyInterval)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed to parse boot_key_interval: %s", err))
+	}
+
+	c.BootKeyGroupInterval, err = time.ParseDuration(c.RawBootKeyGroupInterval)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed to parse boot_keygroup_interval: %s", err))
+	}
+
+	if _, ok := layoutDescriptions[c.BootKeyboardLayout]; !ok {
+		errs = append(errs, errors.New("boot_keyboard_layout must be one of 'us', 'uk', 'de', 'fr'"))
+	}
+
+	c.VNCRecordInterval, err = time.ParseDuration(c.RawVNCRecordInterval)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed to parse vnc_record_interval: %s", err))
+	} else if c.VNCRecordInterval <= 0 {
+		errs = append(errs, errors.New("vnc_record_interval must be more than zero"))
+	}
+
 	if c.SSHKeyPath != "" {
 		if _, err := os.Stat(c.SSHKeyPath); err != nil {
 			errs = append(errs, fmt.Errorf("ssh_key_path is invalid: %s", err))
@@ -174,7 +286,7 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		}
 	*/
 
-	if c.SSHUser == "" {
+	if c.SSHUser == "" && (c.Comm.Type == "" || c.Comm.Type == "ssh") {
 		errs = append(errs, errors.New("An ssh_username must be specified."))
 	}
 
@@ -183,10 +295,32 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		errs = append(errs, fmt.Errorf("Failed to parse ssh_wait_timeout: %s", err))
 	}
 
+	c.UploadTimeout, err = time.ParseDuration(c.RawUploadTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed to parse upload_timeout: %s", err))
+	}
+
 	switch c.Format {
-	case "xva", "vdi_raw", "vdi_vhd", "vhd", "none":
+	case "xva", "vdi_raw", "vdi_vhd", "vhd", "qcow2", "vmdk", "ova", "none":
+	default:
+		errs = append(errs, errors.New("format must be one of 'xva', 'vdi_raw', 'vdi_vhd', 'vhd', 'qcow2', 'vmdk', 'ova', 'none'"))
+	}
+
+	switch c.VHDExport {
+	case "http", "nfs":
+	default:
+		errs = append(errs, errors.New("vhd_export must be one of 'http', 'nfs'"))
+	}
+
+	switch c.ExportCompression {
+	case "none":
+	case "gzip", "zstd":
+		switch c.Format {
+		case "qcow2", "vmdk", "ova":
+			errs = append(errs, fmt.Errorf("export_compression can't be used with the '%s' format", c.Format))
+		}
 	default:
-		errs = append(errs, errors.New("format must be one of 'xva', 'vdi_raw', 'vdi_vhd', 'vhd', 'none'"))
+		errs = append(errs, errors.New("export_compression must be one of 'none', 'gzip', 'zstd'"))
 	}
 
 	switch c.KeepVM {
@@ -201,6 +335,22 @@ func (c *CommonConfig) Prepare(ctx *interpolate.Context, pc *common.PackerConfig
 		errs = append(errs, errors.New("ip_getter must be one of 'auto', 'tools', 'http'"))
 	}
 
+	switch c.XAPIProtocol {
+	case "xmlrpc", "jsonrpc":
+	default:
+		errs = append(errs, errors.New("xapi_protocol must be one of 'xmlrpc', 'jsonrpc'"))
+	}
+
+	switch c.Placement {
+	case "xapi", "auto":
+	default:
+		errs = append(errs, errors.New("placement must be one of 'xapi', 'auto'"))
+	}
+
+	if c.AffinityHost != "" && c.Placement == "auto" {
+		errs = append(errs, errors.New("affinity_host can't be combined with placement 'auto'"))
+	}
+
 	return errs
 }
 
@@ -221,7 +371,7 @@ func (c CommonConfig) ShouldKeepVM(state multistep.StateBag) bool {
 	}
 }
 
-func (config CommonConfig) GetSrByName(client xsclient.XenAPIClient, SrName string) (*xsclient.SR, error) {
+func (config CommonConfig) GetSrByName(client Hypervisor, SrName string) (string, error) {
 	if SrName == "" {
 		// Find the default SR
 		return client.GetDefaultSR()
@@ -231,14 +381,14 @@ func (config CommonConfig) GetSrByName(client xsclient.XenAPIClient, SrName stri
 		srs, err := client.GetSRByNameLabel(SrName)
 
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 
 		switch {
 		case len(srs) == 0:
-			return nil, fmt.Errorf("Couldn't find a SR with the specified name-label '%s'", SrName)
+			return "", fmt.Errorf("Couldn't find a SR with the specified name-label '%s'", SrName)
 		case len(srs) > 1:
-			return nil, fmt.Errorf("Found more than one SR with the name '%s'. The name must be unique", SrName)
+			return "", fmt.Errorf("Found more than one SR with the name '%s'. The name must be unique", SrName)
 		}
 
 		return srs[0], nil
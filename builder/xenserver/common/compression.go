@@ -0,0 +1,37 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionSuffixes are the extensions export_compression adds to the
+// exported files.
+var compressionSuffixes = map[string]string{
+	"none": "",
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressor returns a writer that compresses what's written to it into
+// w. Closing it finishes the compressed stream but leaves w open.
+func newCompressor(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("Unknown compression '%s'", compression)
+}
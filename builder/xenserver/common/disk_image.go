@@ -0,0 +1,90 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+ * imageWriters convert a raw disk, written to them front to back as it's
+ * downloaded, into a sparse image format. Blocks that are all zeros aren't
+ * stored. The metadata is written after the data by Close, so nothing has
+ * to be known about the disk up front.
+ */
+
+type imageWriter interface {
+	downloadSink
+	Close() error
+}
+
+func newImageWriter(container string, fh *os.File) (imageWriter, error) {
+	switch container {
+	case "qcow2":
+		return newQcow2Writer(fh), nil
+	case "vmdk":
+		return newVMDKWriter(fh, filepath.Base(fh.Name()), false), nil
+	case "vmdk-stream":
+		return newVMDKWriter(fh, filepath.Base(fh.Name()), true), nil
+	}
+	return nil, fmt.Errorf("Unknown image format '%s'", container)
+}
+
+var zeroBlock = make([]byte, 64*1024)
+
+// sparseWriter splits what's written to it into blocks, passing on those
+// that aren't all zero along with their index on the disk.
+type sparseWriter struct {
+	buf    []byte
+	filled int
+	size   int64
+	block  func(index int64, data []byte) error
+}
+
+func (self *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(self.buf[self.filled:], p)
+		self.filled += n
+		written += n
+		p = p[n:]
+
+		if self.filled == len(self.buf) {
+			if err := self.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush passes on the buffered block, padded with zeros if it's the last.
+func (self *sparseWriter) flush() error {
+	if self.filled == 0 {
+		return nil
+	}
+
+	index := self.size / int64(len(self.buf))
+	copy(self.buf[self.filled:], zeroBlock)
+	self.size += int64(self.filled)
+	self.filled = 0
+
+	if bytes.Equal(self.buf, zeroBlock[:len(self.buf)]) {
+		return nil
+	}
+	return self.block(index, self.buf)
+}
+
+func (self *sparseWriter) reset() {
+	self.filled = 0
+	self.size = 0
+}
+
+// truncate empties fh for a fresh start.
+func truncate(fh *os.File) error {
+	if _, err := fh.Seek(0, 0); err != nil {
+		return err
+	}
+	return fh.Truncate(0)
+}
@@ -0,0 +1,308 @@
+package common
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDisk is a mostly empty raw disk with data at a few offsets.
+type testDisk struct {
+	size int64
+	data map[int64][]byte
+}
+
+func (d testDisk) read(offset int64, p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+	for at, data := range d.data {
+		for i, b := range data {
+			if pos := at + int64(i) - offset; pos >= 0 && pos < int64(len(p)) {
+				p[pos] = b
+			}
+		}
+	}
+}
+
+func (d testDisk) writeTo(w io.Writer) error {
+	buf := make([]byte, 1000*1000)
+	for offset := int64(0); offset < d.size; offset += int64(len(buf)) {
+		n := d.size - offset
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		d.read(offset, buf[:n])
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkClusters compares each cluster read by readCluster, nil meaning
+// sparse, against the disk.
+func (d testDisk) checkClusters(t *testing.T, clusterSize int64, readCluster func(index int64) []byte) {
+	expected := make([]byte, clusterSize)
+	for index := int64(0); index*clusterSize < d.size; index++ {
+		d.read(index*clusterSize, expected)
+		actual := readCluster(index)
+		if actual == nil {
+			if !bytes.Equal(expected, zeroBlock[:clusterSize]) {
+				t.Fatalf("cluster %d with data is missing", index)
+			}
+			continue
+		}
+		if bytes.Equal(expected, zeroBlock[:clusterSize]) {
+			t.Fatalf("empty cluster %d was stored", index)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Fatalf("cluster %d doesn't match", index)
+		}
+	}
+}
+
+func testImageFile(t *testing.T, name string) (*os.File, func()) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fh, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return fh, func() {
+		fh.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readAt(t *testing.T, fh *os.File, offset int64, size int) []byte {
+	buf := make([]byte, size)
+	if _, err := fh.ReadAt(buf, offset); err != nil {
+		t.Fatalf("reading %d bytes at %d: %s", size, offset, err)
+	}
+	return buf
+}
+
+func TestQcow2Writer(t *testing.T) {
+	fh, cleanup := testImageFile(t, "disk.qcow2")
+	defer cleanup()
+
+	// Spans two L2 tables, and ends part way through a cluster
+	disk := testDisk{
+		size: 520<<20 + 3*512,
+		data: map[int64][]byte{
+			0:                      []byte("boot sector"),
+			5*qcow2ClusterSize - 4: []byte("straddles two clusters"),
+			513 << 20:              []byte("second L2 table"),
+			520<<20 + 3*512 - 5:    []byte("end"),
+		},
+	}
+
+	w := newQcow2Writer(fh)
+	w.Write([]byte("thrown away"))
+	if err := w.Reset(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := disk.writeTo(w); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var header qcow2Header
+	if err := binary.Read(bytes.NewReader(readAt(t, fh, 0, 72)), binary.BigEndian, &header); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if header.Magic != qcow2Magic || header.Version != 2 || header.Size != uint64(disk.size) || header.L1Size != 2 {
+		t.Fatalf("bad header: %#v", header)
+	}
+
+	l1 := make([]uint64, header.L1Size)
+	binary.Read(bytes.NewReader(readAt(t, fh, int64(header.L1TableOffset), len(l1)*8)), binary.BigEndian, l1)
+
+	offsetMask := uint64(0x00fffffffffffe00)
+	disk.checkClusters(t, qcow2ClusterSize, func(index int64) []byte {
+		l2Offset := l1[index/qcow2L2Entries] & offsetMask
+		if l2Offset == 0 {
+			return nil
+		}
+		var entry uint64
+		binary.Read(bytes.NewReader(readAt(t, fh, int64(l2Offset)+index%qcow2L2Entries*8, 8)), binary.BigEndian, &entry)
+		if entry&offsetMask == 0 {
+			return nil
+		}
+		if entry&qcow2Copied == 0 {
+			t.Fatalf("cluster %d should be marked as copied", index)
+		}
+		return readAt(t, fh, int64(entry&offsetMask), qcow2ClusterSize)
+	})
+
+	// Every cluster in the file is referenced exactly once
+	info, _ := fh.Stat()
+	if info.Size()%qcow2ClusterSize != 0 {
+		t.Fatalf("the file isn't a whole number of clusters: %d", info.Size())
+	}
+	clusters := info.Size() / qcow2ClusterSize
+	if clusters > 20 {
+		t.Fatalf("the empty clusters weren't left out: %d clusters", clusters)
+	}
+	table := make([]uint64, header.RefcountTableClusters*qcow2ClusterSize/8)
+	binary.Read(bytes.NewReader(readAt(t, fh, int64(header.RefcountTableOffset), len(table)*8)), binary.BigEndian, table)
+	for cluster := int64(0); cluster < clusters+10; cluster++ {
+		var refcount uint16
+		if block := table[cluster/qcow2RefcountEntries]; block != 0 {
+			binary.Read(bytes.NewReader(readAt(t, fh, int64(block)+cluster%qcow2RefcountEntries*2, 2)), binary.BigEndian, &refcount)
+		}
+		if (cluster < clusters && refcount != 1) || (cluster >= clusters && refcount != 0) {
+			t.Fatalf("bad refcount %d for cluster %d of %d", refcount, cluster, clusters)
+		}
+	}
+}
+
+func TestVMDKWriter(t *testing.T) {
+	fh, cleanup := testImageFile(t, "disk.vmdk")
+	defer cleanup()
+
+	// Spans three grain tables, and ends part way through a grain
+	disk := testDisk{
+		size: 70<<20 + 512,
+		data: map[int64][]byte{
+			0:                   []byte("boot sector"),
+			3*vmdkGrainSize - 2: []byte("straddles two grains"),
+			65 << 20:            []byte("third grain table"),
+			70<<20 + 512 - 3:    []byte("end"),
+		},
+	}
+
+	w, err := newImageWriter("vmdk", fh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := disk.writeTo(w); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var header vmdkHeader
+	if err := binary.Read(bytes.NewReader(readAt(t, fh, 0, vmdkSectorSize)), binary.LittleEndian, &header); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	capacity := uint64(disk.size / vmdkSectorSize)
+	if header.MagicNumber != vmdkMagic || header.Capacity != capacity || header.GrainSize != vmdkGrainSectors {
+		t.Fatalf("bad header: %#v", header)
+	}
+
+	descriptor := string(readAt(t, fh, int64(header.DescriptorOffset)*vmdkSectorSize, int(header.DescriptorSize)*vmdkSectorSize))
+	if !strings.Contains(descriptor, `createType="monolithicSparse"`) || !strings.Contains(descriptor, `RW 143361 SPARSE "disk.vmdk"`) {
+		t.Fatalf("bad descriptor:\n%s", descriptor)
+	}
+
+	gd := make([]uint32, 3)
+	binary.Read(bytes.NewReader(readAt(t, fh, int64(header.GdOffset)*vmdkSectorSize, len(gd)*4)), binary.LittleEndian, gd)
+	for i, gt := range gd {
+		if gt == 0 {
+			t.Fatalf("grain table %d wasn't allocated", i)
+		}
+	}
+
+	disk.checkClusters(t, vmdkGrainSize, func(index int64) []byte {
+		var sector uint32
+		gt := int64(gd[index/vmdkGTEntries]) * vmdkSectorSize
+		binary.Read(bytes.NewReader(readAt(t, fh, gt+index%vmdkGTEntries*4, 4)), binary.LittleEndian, &sector)
+		if sector == 0 {
+			return nil
+		}
+		return readAt(t, fh, int64(sector)*vmdkSectorSize, vmdkGrainSize)
+	})
+}
+
+func TestVMDKWriter_Stream(t *testing.T) {
+	fh, cleanup := testImageFile(t, "disk.vmdk")
+	defer cleanup()
+
+	disk := testDisk{
+		size: 40 << 20,
+		data: map[int64][]byte{
+			0:        []byte("boot sector"),
+			33 << 20: []byte("second grain table"),
+		},
+	}
+
+	w, err := newImageWriter("vmdk-stream", fh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := disk.writeTo(w); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var header vmdkHeader
+	binary.Read(bytes.NewReader(readAt(t, fh, 0, vmdkSectorSize)), binary.LittleEndian, &header)
+	if header.Version != 3 || header.CompressAlgorithm != 1 || header.GdOffset != vmdkGDAtEnd {
+		t.Fatalf("bad header: %#v", header)
+	}
+	descriptor := string(readAt(t, fh, vmdkSectorSize, vmdkDescriptorSectors*vmdkSectorSize))
+	if !strings.Contains(descriptor, `createType="streamOptimized"`) {
+		t.Fatalf("bad descriptor:\n%s", descriptor)
+	}
+
+	// The file ends with the footer marker, the footer and the EOS marker
+	info, _ := fh.Stat()
+	var marker vmdkMarker
+	binary.Read(bytes.NewReader(readAt(t, fh, info.Size()-3*vmdkSectorSize, vmdkSectorSize)), binary.LittleEndian, &marker)
+	if marker.Type != vmdkMarkerFooter {
+		t.Fatalf("expected a footer marker, got %#v", marker)
+	}
+	var footer vmdkHeader
+	binary.Read(bytes.NewReader(readAt(t, fh, info.Size()-2*vmdkSectorSize, vmdkSectorSize)), binary.LittleEndian, &footer)
+	if footer.Capacity != header.Capacity || footer.GdOffset == vmdkGDAtEnd {
+		t.Fatalf("bad footer: %#v", footer)
+	}
+	if eos := readAt(t, fh, info.Size()-vmdkSectorSize, vmdkSectorSize); !bytes.Equal(eos, zeroBlock[:vmdkSectorSize]) {
+		t.Fatal("expected an end-of-stream marker")
+	}
+
+	gd := make([]uint32, 2)
+	binary.Read(bytes.NewReader(readAt(t, fh, int64(footer.GdOffset)*vmdkSectorSize, len(gd)*4)), binary.LittleEndian, gd)
+
+	disk.checkClusters(t, vmdkGrainSize, func(index int64) []byte {
+		var sector uint32
+		gt := int64(gd[index/vmdkGTEntries]) * vmdkSectorSize
+		binary.Read(bytes.NewReader(readAt(t, fh, gt+index%vmdkGTEntries*4, 4)), binary.LittleEndian, &sector)
+		if sector == 0 {
+			return nil
+		}
+
+		var lba uint64
+		var size uint32
+		grain := bytes.NewReader(readAt(t, fh, int64(sector)*vmdkSectorSize, 12))
+		binary.Read(grain, binary.LittleEndian, &lba)
+		binary.Read(grain, binary.LittleEndian, &size)
+		if lba != uint64(index*vmdkGrainSectors) {
+			t.Fatalf("grain %d has LBA %d", index, lba)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(readAt(t, fh, int64(sector)*vmdkSectorSize+12, int(size))))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return data
+	})
+}
@@ -0,0 +1,429 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+/*
+ * downloadFile fetches an export from the host. A dropped connection is
+ * retried, picking up where it left off with an HTTP Range request if the
+ * host honours them; if it doesn't the download starts again from scratch.
+ * The file's SHA-256 is computed as it's written. Several downloads can
+ * share an exportProgress, which reports them as one line.
+ *
+ * With export_compression set the file is compressed as it's written, and
+ * the checksum is of the compressed file. Raw disks are written as sparse
+ * files instead, seeking over blocks of zeros rather than writing them.
+ * convertDownload streams a raw disk through an imageWriter instead, so
+ * it's converted to another format without a temporary copy.
+ */
+
+const downloadAttempts = 5
+
+// downloadRetryDelay is multiplied by the attempt number between retries.
+var downloadRetryDelay = 10 * time.Second
+
+// downloadSink receives a download as it arrives. Reset is called if the
+// download has to start again from the beginning.
+type downloadSink interface {
+	io.Writer
+	Reset() error
+}
+
+// fileSink writes a download to a file, compressing and then hashing it as
+// it goes, or leaving holes for zeros if it's sparse. Close must be called
+// to finish the compressed stream or set the sparse file's length.
+type fileSink struct {
+	fh          *os.File
+	hash        hash.Hash
+	compression string
+	w           io.WriteCloser
+	sparse      *sparseFile
+}
+
+func newFileSink(fh *os.File, compression string, sparse bool) (*fileSink, error) {
+	sink := &fileSink{fh: fh, hash: sha256.New(), compression: compression}
+	if sparse {
+		sink.sparse = &sparseFile{fh: fh}
+	}
+	return sink, sink.start()
+}
+
+func (self *fileSink) start() (err error) {
+	if self.sparse != nil {
+		self.sparse.offset = 0
+		self.w = nopWriteCloser{io.MultiWriter(self.sparse, self.hash)}
+		return nil
+	}
+	self.w, err = newCompressor(self.compression, io.MultiWriter(self.fh, self.hash))
+	return
+}
+
+func (self *fileSink) Write(p []byte) (int, error) {
+	return self.w.Write(p)
+}
+
+func (self *fileSink) Reset() error {
+	self.w.Close()
+	if err := truncate(self.fh); err != nil {
+		return err
+	}
+	self.hash.Reset()
+	return self.start()
+}
+
+func (self *fileSink) Close() error {
+	if err := self.w.Close(); err != nil {
+		return err
+	}
+	if self.sparse != nil {
+		return self.sparse.Close()
+	}
+	return nil
+}
+
+// sparseFile writes to a file, skipping blocks that are all zeros so the
+// filesystem can leave them unallocated.
+type sparseFile struct {
+	fh     *os.File
+	offset int64
+}
+
+func (self *sparseFile) Write(p []byte) (int, error) {
+	blockSize := int64(len(zeroBlock))
+	written := 0
+	for written < len(p) {
+		// Work block by block, as aligned in the file
+		n := int(blockSize - self.offset%blockSize)
+		if n > len(p)-written {
+			n = len(p) - written
+		}
+		block := p[written : written+n]
+		if !bytes.Equal(block, zeroBlock[:n]) {
+			if _, err := self.fh.WriteAt(block, self.offset); err != nil {
+				return written, err
+			}
+		}
+		self.offset += int64(n)
+		written += n
+	}
+	return written, nil
+}
+
+// Close extends the file over any zeros at the end.
+func (self *sparseFile) Close() error {
+	return self.fh.Truncate(self.offset)
+}
+
+func (self *fileSink) checksum() string {
+	return hex.EncodeToString(self.hash.Sum(nil))
+}
+
+// download is the state of one file download across attempts.
+type download struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	name     string
+	sink     downloadSink
+	written  int64
+	total    int64
+	progress *exportProgress
+	index    int
+}
+
+// downloadFile downloads url to filename, compressed as given by
+// compression or as a sparse file, reporting as the index'th file of
+// progress. It returns the file's SHA-256 and the size of the download
+// before compression, and gives up with InterruptedError once ctx is
+// cancelled.
+func downloadFile(ctx context.Context, client *http.Client, url, filename, compression string, sparse bool, progress *exportProgress, index int) (checksum string, size int64, err error) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fh.Close()
+
+	sink, err := newFileSink(fh, compression, sparse)
+	if err != nil {
+		return "", 0, err
+	}
+	d := &download{ctx: ctx, client: client, url: url, name: filename, sink: sink, total: -1, progress: progress, index: index}
+	err = d.run()
+	if closeErr := sink.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("Unable to compress %s: %s", filename, closeErr.Error())
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	return sink.checksum(), d.written, nil
+}
+
+// convertDownload downloads a raw disk from url and writes it to filename
+// in the given container format, returning the SHA-256 of the result.
+func convertDownload(ctx context.Context, client *http.Client, url, filename, container string, progress *exportProgress, index int) (checksum string, err error) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	w, err := newImageWriter(container, fh)
+	if err != nil {
+		return "", err
+	}
+	d := &download{ctx: ctx, client: client, url: url, name: filename, sink: w, total: -1, progress: progress, index: index}
+	if err := d.run(); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("Unable to write %s image: %s", container, err.Error())
+	}
+
+	if _, err := fh.Seek(0, 0); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// run makes attempts until the download completes, a failure isn't worth
+// retrying or it runs out of attempts.
+func (d *download) run() error {
+	for attempt := 1; ; attempt++ {
+		retry, err := d.attempt()
+		if d.ctx.Err() != nil {
+			return InterruptedError{}
+		}
+		if err == nil {
+			break
+		}
+		if !retry || attempt == downloadAttempts {
+			return err
+		}
+
+		d.progress.ui.Message(fmt.Sprintf("Download of %s interrupted after %d MB, retrying: %s",
+			d.name, d.written/(1024*1024), err.Error()))
+		select {
+		case <-time.After(time.Duration(attempt) * downloadRetryDelay):
+		case <-d.ctx.Done():
+			return InterruptedError{}
+		}
+	}
+
+	if d.total >= 0 && d.written != d.total {
+		return fmt.Errorf("downloaded %d bytes but expected %d", d.written, d.total)
+	}
+	return nil
+}
+
+// attempt makes one request, resuming from what's already been written. It
+// reports whether a failure is worth retrying.
+func (d *download) attempt() (retry bool, err error) {
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(d.ctx)
+	if d.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if d.written > 0 {
+			log.Printf("The host doesn't support resuming downloads, starting again")
+			if err := d.restart(); err != nil {
+				return false, err
+			}
+		}
+		d.total = resp.ContentLength
+		d.progress.update(d.index, d.written, d.total)
+
+	case http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != d.written {
+			if err := d.restart(); err != nil {
+				return false, err
+			}
+			return true, fmt.Errorf("unexpected Content-Range '%s'", resp.Header.Get("Content-Range"))
+		}
+		d.total = total
+		d.progress.update(d.index, d.written, d.total)
+
+	default:
+		return resp.StatusCode >= 500, fmt.Errorf("GET request got non-200 status code: %s", resp.Status)
+	}
+
+	buffer := make([]byte, 1024*1024)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if _, err := d.sink.Write(buffer[:n]); err != nil {
+				return false, err
+			}
+			d.written += int64(n)
+			d.progress.update(d.index, d.written, d.total)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+
+	if d.total >= 0 && d.written < d.total {
+		return true, fmt.Errorf("connection closed after %d of %d bytes", d.written, d.total)
+	}
+	return false, nil
+}
+
+// restart throws away what's been downloaded so far.
+func (d *download) restart() error {
+	if err := d.sink.Reset(); err != nil {
+		return err
+	}
+	d.written = 0
+	d.progress.update(d.index, d.written, d.total)
+	return nil
+}
+
+// exportProgress adds up the progress of a set of downloads. It reports
+// every 5% once the size of every file is known, and every 100 MB before
+// then.
+type exportProgress struct {
+	ui      packer.Ui
+	mu      sync.Mutex
+	written []int64
+	totals  []int64
+	percent int64
+	mb      int64
+}
+
+func newExportProgress(ui packer.Ui, files int) *exportProgress {
+	progress := &exportProgress{
+		ui:      ui,
+		written: make([]int64, files),
+		totals:  make([]int64, files),
+	}
+	for i := range progress.totals {
+		progress.totals[i] = -1
+	}
+	return progress
+}
+
+func (self *exportProgress) update(index int, written, total int64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.written[index] = written
+	self.totals[index] = total
+
+	var sumWritten, sumTotal int64
+	known := true
+	for i := range self.written {
+		sumWritten += self.written[i]
+		sumTotal += self.totals[i]
+		if self.totals[i] < 0 {
+			known = false
+		}
+	}
+
+	what := "Downloading..."
+	if len(self.written) > 1 {
+		what = fmt.Sprintf("Downloading %d files...", len(self.written))
+	}
+
+	if known && sumTotal > 0 {
+		percent := (sumWritten * 100 / sumTotal) / 5 * 5
+		if percent > self.percent {
+			self.percent = percent
+			self.ui.Message(fmt.Sprintf("%s %d%%", what, percent))
+		}
+		return
+	}
+
+	mb := sumWritten / (1024 * 1024) / 100 * 100
+	if mb > self.mb {
+		self.mb = mb
+		self.ui.Message(fmt.Sprintf("%s %d MB", what, mb))
+	}
+}
+
+// cancelOnInterrupt returns a context that's cancelled when the build is.
+// The caller must call cancel once it's finished with the context.
+func cancelOnInterrupt(state multistep.StateBag) (ctx context.Context, cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		for {
+			if _, ok := state.GetOk(multistep.StateCancelled); ok {
+				cancel()
+				return
+			}
+
+			select {
+			case <-time.After(1 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return
+}
+
+// parseContentRange parses "bytes start-end/total"; total is -1 if it's
+// given as "*".
+func parseContentRange(header string) (start, total int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(header[len("bytes "):], "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	dash := strings.Index(parts[0], "-")
+	if dash < 0 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0][:dash], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if parts[1] == "*" {
+		return start, -1, true
+	}
+	total, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
@@ -0,0 +1,263 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// testDownloadServer serves content, cutting the first response off half way
+// through. With ranges it honours Range requests, otherwise it ignores them.
+func testDownloadServer(content []byte, ranges bool) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Header.Get("Range"))
+		first := len(requests) == 1
+		mu.Unlock()
+
+		if first {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if !ranges {
+			r.Header.Del("Range")
+		}
+		http.ServeContent(w, r, "export", time.Time{}, bytes.NewReader(content))
+	}))
+	return server, &requests
+}
+
+func testDownload(t *testing.T, server *httptest.Server) (string, []byte) {
+	downloadRetryDelay = 0
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "export.xva")
+	ui := &packer.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer), ErrorWriter: new(bytes.Buffer)}
+	checksum, _, err := downloadFile(context.Background(), server.Client(), server.URL, filename, "none", false, newExportProgress(ui, 1), 0)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+
+	written, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return checksum, written
+}
+
+func testContent() ([]byte, string) {
+	content := make([]byte, 3*1024*1024+17)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:])
+}
+
+func TestDownloadFile_Resume(t *testing.T) {
+	content, expected := testContent()
+	server, requests := testDownloadServer(content, true)
+	defer server.Close()
+
+	checksum, written := testDownload(t, server)
+	if !bytes.Equal(written, content) {
+		t.Fatalf("downloaded %d bytes that don't match the %d served", len(written), len(content))
+	}
+	if checksum != expected {
+		t.Fatalf("bad checksum: %s", checksum)
+	}
+	if len(*requests) != 2 || (*requests)[1] != fmt.Sprintf("bytes=%d-", len(content)/2) {
+		t.Fatalf("expected the download to resume with a Range request, got %q", *requests)
+	}
+}
+
+func TestDownloadFile_NoRangeSupport(t *testing.T) {
+	content, expected := testContent()
+	server, requests := testDownloadServer(content, false)
+	defer server.Close()
+
+	checksum, written := testDownload(t, server)
+	if !bytes.Equal(written, content) {
+		t.Fatalf("downloaded %d bytes that don't match the %d served", len(written), len(content))
+	}
+	if checksum != expected {
+		t.Fatalf("bad checksum: %s", checksum)
+	}
+	if len(*requests) != 2 {
+		t.Fatalf("expected the download to start again, got %q", *requests)
+	}
+}
+
+func TestDownloadFile_Compressed(t *testing.T) {
+	downloadRetryDelay = 0
+	content, _ := testContent()
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, compression := range []string{"gzip", "zstd"} {
+		// Both resuming and starting again have to leave a valid stream
+		for _, ranges := range []bool{true, false} {
+			server, _ := testDownloadServer(content, ranges)
+			filename := filepath.Join(dir, "export.xva"+compressionSuffixes[compression])
+			ui := &packer.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer), ErrorWriter: new(bytes.Buffer)}
+			checksum, size, err := downloadFile(context.Background(), server.Client(), server.URL, filename, compression, false, newExportProgress(ui, 1), 0)
+			server.Close()
+			if err != nil {
+				t.Fatalf("%s download failed: %s", compression, err)
+			}
+			if size != int64(len(content)) {
+				t.Fatalf("bad %s size: %d", compression, size)
+			}
+
+			written, _ := ioutil.ReadFile(filename)
+			sum := sha256.Sum256(written)
+			if checksum != hex.EncodeToString(sum[:]) {
+				t.Fatalf("the %s checksum isn't of the compressed file", compression)
+			}
+
+			var zr io.Reader
+			if compression == "gzip" {
+				zr, err = gzip.NewReader(bytes.NewReader(written))
+			} else {
+				zr, err = zstd.NewReader(bytes.NewReader(written))
+			}
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			decompressed, err := ioutil.ReadAll(zr)
+			if err != nil || !bytes.Equal(decompressed, content) {
+				t.Fatalf("the %s download (ranges %v) doesn't decompress to what was served: %v", compression, ranges, err)
+			}
+		}
+	}
+}
+
+func TestDownloadFile_NoContentLength(t *testing.T) {
+	content, expected := testContent()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing first makes the response chunked, with no length
+		w.(http.Flusher).Flush()
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	checksum, written := testDownload(t, server)
+	if !bytes.Equal(written, content) || checksum != expected {
+		t.Fatalf("bad download of unknown length: %d bytes, checksum %s", len(written), checksum)
+	}
+}
+
+func TestDownloadFile_NotFound(t *testing.T) {
+	downloadRetryDelay = 0
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "packer")
+	defer os.RemoveAll(dir)
+
+	ui := &packer.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer), ErrorWriter: new(bytes.Buffer)}
+	if _, _, err := downloadFile(context.Background(), server.Client(), server.URL, filepath.Join(dir, "export.xva"), "none", false, newExportProgress(ui, 1), 0); err == nil {
+		t.Fatal("expected a 404 to fail the download")
+	}
+}
+
+func TestDownloadFile_Interrupted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "packer")
+	defer os.RemoveAll(dir)
+
+	state := new(multistep.BasicStateBag)
+	ctx, cancel := cancelOnInterrupt(state)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		ui := &packer.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer), ErrorWriter: new(bytes.Buffer)}
+		_, _, err := downloadFile(ctx, server.Client(), server.URL, filepath.Join(dir, "export.xva"), "none", false, newExportProgress(ui, 1), 0)
+		result <- err
+	}()
+
+	state.Put(multistep.StateCancelled, true)
+	select {
+	case err := <-result:
+		if _, ok := err.(InterruptedError); !ok {
+			t.Fatalf("expected InterruptedError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download wasn't cancelled")
+	}
+}
+
+func TestExportProgress(t *testing.T) {
+	out := new(bytes.Buffer)
+	progress := newExportProgress(&packer.BasicUi{Reader: new(bytes.Buffer), Writer: out, ErrorWriter: new(bytes.Buffer)}, 2)
+
+	// Until both sizes are known progress is in MB
+	progress.update(0, 0, 100<<20)
+	progress.update(1, 150<<20, -1)
+	progress.update(1, 150<<20, 300<<20)
+	progress.update(0, 100<<20, 100<<20)
+
+	expected := "Downloading 2 files... 100 MB\nDownloading 2 files... 35%\nDownloading 2 files... 60%\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Fatalf("bad progress:\n%s", out.String())
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	cases := []struct {
+		header       string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{"bytes 0-99/*", 0, -1, true},
+		{"bytes */200", 0, 0, false},
+		{"items 0-1/2", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, c := range cases {
+		start, total, ok := parseContentRange(c.header)
+		if ok != c.ok || (ok && (start != c.start || total != c.total)) {
+			t.Errorf("%q: got %d %d %v", c.header, start, total, ok)
+		}
+	}
+}
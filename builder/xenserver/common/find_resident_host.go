@@ -4,14 +4,15 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
+	"net"
 )
 
-func FindResidentHost (state multistep.StateBag, instance *xsclient.VM, uuid string) (err error) {
+func FindResidentHost (state multistep.StateBag, instance string, uuid string) (err error) {
 
 	ui := state.Get("ui").(packer.Ui)
+	client := state.Get("client").(Hypervisor)
 
-	domid, err := instance.GetDomainId()
+	domid, err := client.GetVMDomainId(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get domid of VM with UUID '%s': %s", uuid, err.Error()))
 		return err
@@ -19,13 +20,13 @@ func FindResidentHost (state multistep.StateBag, instance *xsclient.VM, uuid str
 	state.Put("domid", domid)
 
 	// we are connected to a given host, but that might not be where the VM is running
-	host, err := instance.GetResidentOn()
+	host, err := client.GetVMResidentOn(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to determine what host the VM is running on: %s", err.Error()))
 		return err
 	}
 
-	hostAddress, err := host.GetAddress()
+	hostAddress, err := client.GetHostAddress(host)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to determine the IP of the host: %s", err.Error()))
 		return err
@@ -38,6 +39,11 @@ func FindResidentHost (state multistep.StateBag, instance *xsclient.VM, uuid str
 	config.HostIp = hostAddress
 	state.Put("commonconfig", config)
 
+	// dom0 commands and tunnels now need to go to that host
+	if hostSSH, ok := state.GetOk("host_ssh"); ok {
+		hostSSH.(*HostSSHClient).Retarget(net.JoinHostPort(hostAddress, "22"))
+	}
+
 	return nil
 
 }
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+/*
+ * HostSSHClient is the one SSH connection to dom0 that host commands, file
+ * uploads and port forwards are multiplexed over. It's dialled on first use
+ * and redialled if dom0 drops it, e.g. across a toolstack restart.
+ * StepConnectHostSSH keeps it in the state bag under "host_ssh".
+ */
+
+// keepaliveTimeout is how long dom0 has to answer a keepalive before the
+// connection is taken to be dead.
+var keepaliveTimeout = 15 * time.Second
+
+type HostSSHClient struct {
+	addr   string
+	config *gossh.ClientConfig
+
+	// HostKeyAlgorithms, if set, picks the host key types to ask each host
+	// for as it's dialled, since Retarget can change the host.
+	HostKeyAlgorithms func(addr string) ([]string, error)
+
+	// Agent, if set, is the SSH agent config authenticates with, which is
+	// closed along with the connection.
+	Agent *SSHAgent
+
+	mu     sync.Mutex
+	client *gossh.Client
+	closed bool
+}
+
+func NewHostSSHClient(addr string, config *gossh.ClientConfig) *HostSSHClient {
+	return &HostSSHClient{addr: addr, config: config}
+}
+
+// connect returns the current connection, dialling one if needed.
+func (self *HostSSHClient) connect() (*gossh.Client, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.closed {
+		return nil, errors.New("the SSH connection to the host has been closed")
+	}
+	if self.client == nil {
+		log.Printf("Connecting to %s over SSH", self.addr)
+		config := self.config
+		if self.HostKeyAlgorithms != nil {
+			algorithms, err := self.HostKeyAlgorithms(self.addr)
+			if err != nil {
+				return nil, err
+			}
+			withAlgorithms := *self.config
+			withAlgorithms.HostKeyAlgorithms = algorithms
+			config = &withAlgorithms
+		}
+		client, err := gossh.Dial("tcp", self.addr, config)
+		if err != nil {
+			return nil, err
+		}
+		self.client = client
+	}
+	return self.client, nil
+}
+
+// drop forgets a connection that has failed, so the next use redials.
+func (self *HostSSHClient) drop(client *gossh.Client) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.client == client {
+		log.Printf("Dropping broken SSH connection to %s", self.addr)
+		self.client.Close()
+		self.client = nil
+	}
+}
+
+// alive reports whether dom0 still answers on the connection, within
+// keepaliveTimeout. A connection that's been blackholed never answers, and
+// the request is left to fail when the connection is dropped.
+func alive(client *gossh.Client) bool {
+	answered := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-time.After(keepaliveTimeout):
+		return false
+	}
+}
+
+// withClient runs f over the shared connection. If f fails because the
+// connection has died it's redialled and f is tried once more; other
+// failures, such as dom0 refusing a tunnel, are returned as they are.
+func (self *HostSSHClient) withClient(f func(*gossh.Client) error) error {
+	client, err := self.connect()
+	if err != nil {
+		return err
+	}
+	if err = f(client); err == nil || alive(client) {
+		return err
+	}
+
+	self.drop(client)
+	if client, err = self.connect(); err != nil {
+		return err
+	}
+	return f(client)
+}
+
+// Client returns the underlying connection, e.g. for SFTP.
+func (self *HostSSHClient) Client() (*gossh.Client, error) {
+	var result *gossh.Client
+	err := self.withClient(func(client *gossh.Client) error {
+		if !alive(client) {
+			return errors.New("the SSH connection to the host was lost")
+		}
+		result = client
+		return nil
+	})
+	return result, err
+}
+
+func (self *HostSSHClient) NewSession() (*gossh.Session, error) {
+	var session *gossh.Session
+	err := self.withClient(func(client *gossh.Client) (err error) {
+		session, err = client.NewSession()
+		return
+	})
+	return session, err
+}
+
+// Dial opens a connection from dom0 to addr, tunnelled over SSH.
+func (self *HostSSHClient) Dial(network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	err := self.withClient(func(client *gossh.Client) (err error) {
+		conn, err = client.Dial(network, addr)
+		return
+	})
+	return conn, err
+}
+
+// Retarget points the client at a different host, e.g. once the VM turns
+// out to be resident on another member of the pool. Tunnels open to the old
+// host are closed.
+func (self *HostSSHClient) Retarget(addr string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if addr == self.addr {
+		return
+	}
+	log.Printf("Switching SSH connection from %s to %s", self.addr, addr)
+	if self.client != nil {
+		self.client.Close()
+		self.client = nil
+	}
+	self.addr = addr
+}
+
+// Close shuts the connection, along with any tunnels still open over it.
+func (self *HostSSHClient) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.closed = true
+	self.Agent.Close()
+	if self.client == nil {
+		return nil
+	}
+	err := self.client.Close()
+	self.client = nil
+	return err
+}
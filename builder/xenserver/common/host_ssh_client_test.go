@@ -0,0 +1,212 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testHostSSHState returns a state bag with the shared dom0 connection
+// pointed at server, as StepConnectHostSSH would leave it.
+func testHostSSHState(t *testing.T, server *testSSHServer) multistep.StateBag {
+	config := CommonConfig{Username: "root", Password: "secret", HostIp: "127.0.0.1"}
+	sshConfig, _, err := HostSSHConfig(config)
+	if err != nil {
+		t.Fatalf("HostSSHConfig failed: %s", err)
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("commonconfig", config)
+	state.Put("host_ssh", NewHostSSHClient(server.Addr(), sshConfig))
+	state.Put("ui", &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	})
+	return state
+}
+
+// testEchoServer echoes back each line it's sent.
+func testEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestHostSSHClient_Multiplexed(t *testing.T) {
+	server := newTestSSHServer(t, "secret", nil)
+	defer server.Close()
+	echo := testEchoServer(t)
+	defer echo.Close()
+
+	state := testHostSSHState(t, server)
+	connect := new(StepConnectHostSSH)
+
+	for i := 0; i < 3; i++ {
+		if out, err := ExecuteHostSSHCmd(state, "true"); err != nil || out != "true" {
+			t.Fatalf("command failed: %q %v", out, err)
+		}
+	}
+
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+	step := &StepForwardPortOverSSH{
+		RemotePort: func(multistep.StateBag) (uint, error) {
+			var port uint
+			fmt.Sscanf(echoPort, "%d", &port)
+			return port, nil
+		},
+		RemoteDest:  func(multistep.StateBag) (string, error) { return "127.0.0.1", nil },
+		HostPortMin: 14000,
+		HostPortMax: 15000,
+		ResultKey:   "local_test_port",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	localAddr := fmt.Sprintf("127.0.0.1:%d", state.Get("local_test_port").(uint))
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		fmt.Fprintf(conn, "hello %d\n", i)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || strings.TrimSpace(line) != fmt.Sprintf("hello %d", i) {
+			t.Fatalf("bad echo through the tunnel: %q %v", line, err)
+		}
+	}
+
+	if server.Conns() != 1 {
+		t.Fatalf("expected one SSH connection to be shared, got %d", server.Conns())
+	}
+
+	step.Cleanup(state)
+	if conn, err := net.Dial("tcp", localAddr); err == nil {
+		conn.Close()
+		t.Fatal("expected the forwarded port to be closed by Cleanup")
+	}
+
+	connect.Cleanup(state)
+	if _, err := ExecuteHostSSHCmd(state, "true"); err == nil {
+		t.Fatal("expected the host connection to be closed by Cleanup")
+	}
+}
+
+func TestHostSSHClient_Reconnect(t *testing.T) {
+	server := newTestSSHServer(t, "secret", nil)
+	defer server.Close()
+
+	state := testHostSSHState(t, server)
+	defer state.Get("host_ssh").(*HostSSHClient).Close()
+
+	if _, err := ExecuteHostSSHCmd(state, "true"); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+
+	server.Drop()
+
+	if _, err := ExecuteHostSSHCmd(state, "true"); err != nil {
+		t.Fatalf("expected the connection to be redialled: %s", err)
+	}
+	if server.Conns() != 2 {
+		t.Fatalf("expected a second SSH connection, got %d", server.Conns())
+	}
+}
+
+func TestHostSSHClient_Blackholed(t *testing.T) {
+	defer func(timeout time.Duration) { keepaliveTimeout = timeout }(keepaliveTimeout)
+	keepaliveTimeout = 100 * time.Millisecond
+
+	server := newTestSSHServer(t, "secret", nil)
+	defer server.Close()
+
+	state := testHostSSHState(t, server)
+	client := state.Get("host_ssh").(*HostSSHClient)
+	defer client.Close()
+
+	stalled, err := client.connect()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	server.Stall()
+
+	// dom0 never answers the keepalive, so the connection is redialled
+	// rather than waited on
+	done := make(chan error, 1)
+	go func() {
+		done <- client.withClient(func(c *gossh.Client) error {
+			if c == stalled {
+				return errors.New("timed out")
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected the connection to be redialled: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waited on a blackholed connection")
+	}
+	if server.Conns() != 2 {
+		t.Fatalf("expected a second SSH connection, got %d", server.Conns())
+	}
+}
+
+func TestHostSSHClient_Retarget(t *testing.T) {
+	first := newTestSSHServer(t, "secret", nil)
+	defer first.Close()
+	second := newTestSSHServer(t, "secret", nil)
+	defer second.Close()
+
+	state := testHostSSHState(t, first)
+	client := state.Get("host_ssh").(*HostSSHClient)
+	defer client.Close()
+
+	if _, err := ExecuteHostSSHCmd(state, "true"); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+
+	client.Retarget(first.Addr())
+	if _, err := ExecuteHostSSHCmd(state, "true"); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+	if first.Conns() != 1 {
+		t.Fatalf("retargeting to the same host shouldn't reconnect, got %d connections", first.Conns())
+	}
+
+	client.Retarget(second.Addr())
+	if _, err := ExecuteHostSSHCmd(state, "true"); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+	if second.Conns() != 1 {
+		t.Fatalf("expected the command to go to the new host, got %d connections", second.Conns())
+	}
+}
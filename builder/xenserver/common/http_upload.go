@@ -1,18 +1,37 @@
 package common
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 )
 
+/*
+ * HTTPUpload PUTs a file to one of XAPI's import handlers, which report
+ * how it went through a task. XAPI can't pick up a partial import where it
+ * left off, so a failed attempt cancels its task and the upload starts again
+ * from the beginning of the file with a fresh one. Transfer progress,
+ * throughput and an estimate of the time left are shown as it goes.
+ *
+ * HTTPUploadSource does the same for data that isn't in a local file, such
+ * as a download being decompressed on the fly, opening it afresh for each
+ * attempt. If its length isn't known it's sent with chunked encoding.
+ */
+
+const uploadAttempts = 3
+
+// uploadRetryDelay is multiplied by the attempt number between retries.
+var uploadRetryDelay = 10 * time.Second
+
 func appendQuery(urlstring, k, v string) (string, error) {
 	u, err := url.Parse(urlstring)
 	if err != nil {
@@ -24,103 +43,274 @@ func appendQuery(urlstring, k, v string) (string, error) {
 	return u.String(), err
 }
 
-func HTTPUpload(import_url string, fh *os.File, state multistep.StateBag) (result *xsclient.XenAPIObject, err error) {
+// UploadSource opens the data for an upload, returning its length or -1
+// if that isn't known.
+type UploadSource func() (body io.ReadCloser, length int64, err error)
+
+// UploadSourceError is returned by an UploadSource, or read from its body,
+// when the source itself is bad, so there's no point trying again.
+type UploadSourceError struct {
+	Err error
+}
+
+func (err UploadSourceError) Error() string {
+	return err.Err.Error()
+}
+
+// HTTPUpload uploads fh to import_url, closing it once it's done, and
+// returns the reference the import task produced. Each attempt is given
+// upload_timeout to finish.
+func HTTPUpload(import_url string, fh *os.File, state multistep.StateBag) (result string, err error) {
+	defer fh.Close()
+
+	return HTTPUploadSource(import_url, fh.Name(), func() (io.ReadCloser, int64, error) {
+		fstat, err := fh.Stat()
+		if err != nil {
+			return nil, 0, fmt.Errorf("Unable to stat '%s': %s", fh.Name(), err.Error())
+		}
+		if _, err := fh.Seek(0, 0); err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(fh), fstat.Size(), nil
+	}, state)
+}
+
+// HTTPUploadSource uploads what source opens to import_url, naming it name
+// in messages, and returns the reference the import task produced.
+func HTTPUploadSource(import_url, name string, source UploadSource, state multistep.StateBag) (result string, err error) {
+	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		result, retry, err = uploadAttempt(state, import_url, source, config.UploadTimeout)
+		if err == nil {
+			log.Printf("Upload complete")
+			return
+		}
+		if _, ok := err.(InterruptedError); ok {
+			return
+		}
+		if !retry || attempt == uploadAttempts {
+			err = fmt.Errorf("Error uploading: %s", err.Error())
+			return
+		}
+
+		ui.Message(fmt.Sprintf("Upload of '%s' failed, retrying: %s", name, err.Error()))
+		err = InterruptibleWait{Timeout: time.Duration(attempt) * uploadRetryDelay}.Wait(state)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// uploadAttempt makes one upload with its own task, cancelling the task if
+// it fails. It reports whether a failure is worth retrying.
+func uploadAttempt(state multistep.StateBag, import_url string, source UploadSource, timeout time.Duration) (result string, retry bool, err error) {
+	ui := state.Get("ui").(packer.Ui)
+	client := state.Get("client").(Hypervisor)
 
 	task, err := client.CreateTask()
 	if err != nil {
 		err = fmt.Errorf("Unable to create task: %s", err.Error())
 		return
 	}
-	defer task.Destroy()
+	defer client.DestroyTask(task)
 
-	import_task_url, err := appendQuery(import_url, "task_id", task.Ref)
+	// Anything short of success leaves XAPI to stop the import
+	defer func() {
+		if err != nil {
+			if cancelErr := client.CancelTask(task); cancelErr != nil {
+				log.Printf("Unable to cancel task %s: %s", task, cancelErr.Error())
+			}
+		}
+	}()
+
+	import_task_url, err := appendQuery(import_url, "task_id", task)
 	if err != nil {
 		return
 	}
 
-	// Get file length
-	fstat, err := fh.Stat()
+	body, length, err := source()
 	if err != nil {
-		err = fmt.Errorf("Unable to stat '%s': %s", fh.Name(), err.Error())
+		_, bad := err.(UploadSourceError)
+		retry = !bad
 		return
 	}
-	fileLength := fstat.Size()
-
-	// Define a new transport which allows self-signed certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
+	defer body.Close()
 
-	// Create a client
-	httpClient := &http.Client{Transport: tr}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := cancelOnInterrupt(state)
+	defer cancel()
+	ctx, cancelTimeout := context.WithDeadline(ctx, deadline)
+	defer cancelTimeout()
 
-	// Create request and download file
-	request, err := http.NewRequest("PUT", import_task_url, fh)
-	request.ContentLength = fileLength
+	// Create request and upload the data. The body is wrapped so that the
+	// request doesn't close it, and so any error reading it is kept.
+	reader := &uploadReader{r: body, progress: newUploadProgress(ui, length)}
+	request, err := http.NewRequest("PUT", import_task_url, reader)
+	if err != nil {
+		return
+	}
+	request = request.WithContext(ctx)
+	request.ContentLength = length
 
 	ui.Say(fmt.Sprintf("PUT '%s'", import_task_url))
 
-	resp, err := httpClient.Do(request) // Do closes fh for us, according to docs
+	resp, err := client.HTTPClient().Do(request)
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		err = InterruptedError{}
+		return
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if readErr := reader.error(); readErr != nil {
+		// Reading the source failed, whatever the host made of what it got
+		err = readErr
+		_, bad := err.(UploadSourceError)
+		retry = !bad
+		return
+	}
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", timeout)
+			return
+		}
+		retry = true
 		return
 	}
 
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("PUT request got non-200 status code: %s", resp.Status)
+		retry = resp.StatusCode >= 500
 		return
 	}
 
-	logIteration := 0
+	reported := 0.0
 	err = InterruptibleWait{
 		Predicate: func() (bool, error) {
-			status, err := task.GetStatus()
+			status, err := client.GetTaskStatus(task)
 			if err != nil {
 				return false, fmt.Errorf("Failed to get task status: %s", err.Error())
 			}
 			switch status {
-			case xsclient.Pending:
-				progress, err := task.GetProgress()
+			case TaskPending:
+				taskProgress, err := client.GetTaskProgress(task)
 				if err != nil {
 					return false, fmt.Errorf("Failed to get progress: %s", err.Error())
 				}
-				logIteration = logIteration + 1
-				if logIteration%5 == 0 {
-					log.Printf("Upload %.0f%% complete", progress*100)
+				if taskProgress >= reported+0.05 {
+					reported = taskProgress
+					ui.Message(fmt.Sprintf("Importing... %.0f%%", taskProgress*100))
 				}
 				return false, nil
-			case xsclient.Success:
+			case TaskSuccess:
 				return true, nil
-			case xsclient.Failure:
-				errorInfo, err := task.GetErrorInfo()
+			case TaskFailure:
+				errorInfo, err := client.GetTaskErrorInfo(task)
 				if err != nil {
 					errorInfo = []string{fmt.Sprintf("furthermore, failed to get error info: %s", err.Error())}
 				}
 				return false, fmt.Errorf("Task failed: %s", errorInfo)
-			case xsclient.Cancelling, xsclient.Cancelled:
+			case TaskCancelling, TaskCancelled:
 				return false, fmt.Errorf("Task cancelled")
 			default:
 				return false, fmt.Errorf("Unknown task status %v", status)
 			}
 		},
 		PredicateInterval: 1 * time.Second,
-		Timeout:           24 * time.Hour,
+		Timeout:           deadline.Sub(time.Now()),
 	}.Wait(state)
 
-	resp.Body.Close()
-
 	if err != nil {
-		err = fmt.Errorf("Error uploading: %s", err.Error())
+		if _, ok := err.(TimeoutError); ok {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
 		return
 	}
 
-	result, err = task.GetResult()
+	result, err = client.GetTaskResult(task)
 	if err != nil {
 		err = fmt.Errorf("Error getting result: %s", err.Error())
 		return
 	}
-
-	log.Printf("Upload complete")
 	return
 }
+
+// uploadReader passes reads on to progress, and keeps any error other
+// than io.EOF. It has no Close, so the HTTP client leaves the source open.
+type uploadReader struct {
+	r        io.Reader
+	progress *uploadProgress
+	mu       sync.Mutex
+	err      error
+}
+
+func (self *uploadReader) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	self.progress.add(int64(n))
+	if err != nil && err != io.EOF {
+		self.mu.Lock()
+		self.err = err
+		self.mu.Unlock()
+	}
+	return n, err
+}
+
+func (self *uploadReader) error() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.err
+}
+
+// uploadProgress reports every 5% of an upload with its throughput so far
+// and an estimate of the time left, or every 100 MB with its throughput if
+// the length isn't known.
+type uploadProgress struct {
+	ui      packer.Ui
+	mu      sync.Mutex
+	total   int64
+	sent    int64
+	percent int64
+	mb      int64
+	start   time.Time
+}
+
+func newUploadProgress(ui packer.Ui, total int64) *uploadProgress {
+	return &uploadProgress{ui: ui, total: total, start: time.Now()}
+}
+
+func (self *uploadProgress) add(n int64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.sent += n
+	if self.total < 0 {
+		mb := self.sent / (1024 * 1024) / 100 * 100
+		if mb > self.mb {
+			self.mb = mb
+			rate := float64(self.sent) / time.Since(self.start).Seconds()
+			self.ui.Message(fmt.Sprintf("Uploading... %d MB (%.1f MB/s)", mb, rate/(1024*1024)))
+		}
+		return
+	}
+	if self.total == 0 {
+		return
+	}
+	percent := (self.sent * 100 / self.total) / 5 * 5
+	if percent <= self.percent {
+		return
+	}
+	self.percent = percent
+
+	elapsed := time.Since(self.start)
+	if elapsed <= 0 || self.sent == 0 {
+		self.ui.Message(fmt.Sprintf("Uploading... %d%%", percent))
+		return
+	}
+	rate := float64(self.sent) / elapsed.Seconds()
+	left := time.Duration(float64(self.total-self.sent) / rate * float64(time.Second))
+	self.ui.Message(fmt.Sprintf("Uploading... %d%% (%.1f MB/s, %s left)",
+		percent, rate/(1024*1024), left.Round(time.Second)))
+}
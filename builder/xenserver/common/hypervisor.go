@@ -0,0 +1,128 @@
+package common
+
+import (
+	"net/http"
+)
+
+/*
+ * Hypervisor is everything the builder steps need from a XenServer pool.
+ * Objects are passed around by their XAPI opaque reference, so an
+ * implementation only has to map each operation onto the wire protocol it
+ * speaks. Steps find it in the state bag under "client".
+ */
+
+type VDIType int
+
+const (
+	_ VDIType = iota
+	Disk
+	CD
+	Floppy
+)
+
+type TaskStatus int
+
+const (
+	_ TaskStatus = iota
+	TaskPending
+	TaskSuccess
+	TaskFailure
+	TaskCancelling
+	TaskCancelled
+)
+
+type Hypervisor interface {
+	// Hosts
+	GetHosts() ([]string, error)
+	GetHostAddress(host string) (string, error)
+	GetHostSoftwareVersion(host string) (map[string]interface{}, error)
+	GetHostByUuid(uuid string) (string, error)
+	GetHostByNameLabel(name string) ([]string, error)
+	GetHostNameLabel(host string) (string, error)
+	GetHostEnabled(host string) (bool, error)
+	GetHostLive(host string) (bool, error)
+	GetHostMemoryFree(host string) (uint64, error)
+
+	// VM lookup and lifecycle
+	GetVMByUuid(uuid string) (string, error)
+	GetVMByNameLabel(name string) ([]string, error)
+	GetVMUuid(vm string) (string, error)
+	CloneVM(vm, name string) (string, error)
+	CopyVM(vm, name, sr string) (string, error)
+	SnapshotVM(vm, name string) (string, error)
+	DestroyVM(vm string) error
+	StartVM(vm string, paused, force bool) error
+	StartVMOn(vm, host string, paused, force bool) error
+	CleanShutdownVM(vm string) error
+	HardShutdownVM(vm string) error
+	UnpauseVM(vm string) error
+	ResumeVM(vm string, paused, force bool) error
+
+	// VM properties
+	GetVMPowerState(vm string) (string, error)
+	GetVMDomainId(vm string) (string, error)
+	GetVMResidentOn(vm string) (string, error)
+	GetVMMemoryStaticMax(vm string) (uint64, error)
+	GetVMPossibleHosts(vm string) ([]string, error)
+	GetVMVCpuMax(vm string) (uint, error)
+	GetVMHVMBootPolicy(vm string) (string, error)
+	GetVMGuestNetworks(vm string) (map[string]string, error)
+	SetVMIsATemplate(vm string, isATemplate bool) error
+	SetVMStaticMemoryRange(vm string, min, max uint64) error
+	SetVMPlatform(vm string, params map[string]string) error
+	SetVMVCpuMax(vm string, vcpus uint) error
+	SetVMVCpuAtStartup(vm string, vcpus uint) error
+	SetVMDescription(vm, description string) error
+	SetVMHVMBoot(vm, policy, bootOrder string) error
+
+	// VM devices
+	GetVMDisks(vm string) ([]string, error)
+	GetVMVIFs(vm string) ([]string, error)
+	ConnectVdi(vm, vdi string, vdiType VDIType, userdevice string) error
+	DisconnectVdi(vm, vdi string) error
+	ConnectNetwork(vm, network, device string) (string, error)
+	GetVIFNetwork(vif string) (string, error)
+	DestroyVIF(vif string) error
+
+	// Storage
+	GetDefaultSR() (string, error)
+	GetSRByNameLabel(name string) ([]string, error)
+	GetSRUuid(sr string) (string, error)
+	CreateVdi(sr, name string, size int64) (string, error)
+	GetVdiByUuid(uuid string) (string, error)
+	GetVdiByNameLabel(name string) ([]string, error)
+	GetVdiUuid(vdi string) (string, error)
+	GetVdiVirtualSize(vdi string) (string, error)
+	GetVdiNameLabel(vdi string) (string, error)
+	GetVdiSMConfig(vdi string) (map[string]string, error)
+	DestroyVdi(vdi string) error
+	ExposeVdi(vdi, format string) (string, error)
+	UnexposeVdi(vdi string) error
+
+	// Networks
+	GetManagementNetwork() (string, error)
+	GetNetworkByNameLabel(name string) ([]string, error)
+	GetNetworkNameLabel(network string) (string, error)
+	GetNetworkAssignedIPs(network string) (map[string]string, error)
+	CreateNetwork(name, description, bridge string) (string, error)
+	DestroyNetwork(network string) error
+
+	// Tasks
+	CreateTask() (string, error)
+	DestroyTask(task string) error
+	CancelTask(task string) error
+	GetTaskStatus(task string) (TaskStatus, error)
+	GetTaskProgress(task string) (float64, error)
+	GetTaskErrorInfo(task string) ([]string, error)
+	GetTaskResult(task string) (string, error)
+
+	// HTTP transfers. The returned URLs carry whatever authentication the
+	// host needs; HTTPUpload adds the task_id. HTTPClient trusts the host
+	// exactly as far as the XAPI connection does.
+	HTTPClient() *http.Client
+	ImportURL(sr string) string
+	ImportRawVdiURL(vdi string) string
+	ExportURL(vmUuid string) string
+	ExportRawVdiURL(vdiUuid, format string) string
+	ExportDifferencingVdiURL(vdiUuid, baseUuid string) string
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/rpc"
+	"strings"
+
+	"github.com/nilshell/xmlrpc"
+)
+
+/*
+ * jsonrpcCodec lets go-xenserver-client talk to XAPI's /jsonrpc endpoint.
+ * It sits underneath the client's net/rpc connection in place of the
+ * XML-RPC codec and translates replies into the {Status, Value} /
+ * {Status, ErrorDescription} structs the client already understands.
+ *
+ * XML-RPC carries XAPI's int64s as strings, so JSON numbers are turned into
+ * strings too. The only float the client reads is a task's progress.
+ */
+
+var jsonrpcFloatMethods = map[string]bool{
+	"task.get_progress": true,
+}
+
+// errJSONRPCUnavailable is returned when the host has no /jsonrpc endpoint.
+type errJSONRPCUnavailable struct {
+	reason string
+}
+
+func (e errJSONRPCUnavailable) Error() string {
+	return fmt.Sprintf("XAPI JSON-RPC is not available: %s", e.reason)
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      uint64        `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int           `json:"code"`
+	Message string        `json:"message"`
+	Data    []interface{} `json:"data"`
+}
+
+type jsonrpcResponse struct {
+	Result interface{}   `json:"result"`
+	Error  *jsonrpcError `json:"error"`
+}
+
+type jsonrpcReply struct {
+	seq    uint64
+	result xmlrpc.Struct
+}
+
+type jsonrpcCodec struct {
+	url        string
+	httpClient *http.Client
+
+	// replies hands each response from WriteRequest to the net/rpc reader
+	replies chan jsonrpcReply
+	current jsonrpcReply
+}
+
+func newJSONRPCClient(url string, transport *http.Transport) *xmlrpc.Client {
+	if transport == nil {
+		transport = &http.Transport{}
+	}
+
+	codec := &jsonrpcCodec{
+		url:        url + "/jsonrpc",
+		httpClient: &http.Client{Transport: transport},
+		replies:    make(chan jsonrpcReply),
+	}
+	return &xmlrpc.Client{Client: rpc.NewClientWithCodec(codec)}
+}
+
+func (self *jsonrpcCodec) WriteRequest(request *rpc.Request, params interface{}) error {
+	var args []interface{}
+	if p, ok := params.(xmlrpc.Params); ok {
+		args = p.Params
+	}
+	if args == nil {
+		args = make([]interface{}, 0)
+	}
+
+	body, err := json.Marshal(jsonrpcRequest{
+		JSONRPC: "2.0",
+		Method:  request.ServiceMethod,
+		Params:  args,
+		ID:      request.Seq,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := self.httpClient.Post(self.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errJSONRPCUnavailable{resp.Status}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JSON-RPC request got non-200 status code: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var response jsonrpcResponse
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return errJSONRPCUnavailable{fmt.Sprintf("unable to decode reply: %s", err.Error())}
+	}
+
+	result := xmlrpc.Struct{"Status": "Success"}
+	if response.Error != nil {
+		description := []interface{}{response.Error.Message}
+		for _, d := range response.Error.Data {
+			description = append(description, fromJSON(d, false))
+		}
+		result["Status"] = "Failure"
+		result["ErrorDescription"] = description
+	} else {
+		result["Value"] = fromJSON(response.Result, jsonrpcFloatMethods[request.ServiceMethod])
+	}
+
+	self.replies <- jsonrpcReply{seq: request.Seq, result: result}
+	return nil
+}
+
+func (self *jsonrpcCodec) ReadResponseHeader(response *rpc.Response) error {
+	reply, ok := <-self.replies
+	if !ok {
+		return io.EOF
+	}
+	self.current = reply
+	response.Seq = reply.seq
+	return nil
+}
+
+func (self *jsonrpcCodec) ReadResponseBody(x interface{}) error {
+	if result, ok := x.(*xmlrpc.Struct); ok {
+		*result = self.current.result
+	}
+	return nil
+}
+
+func (self *jsonrpcCodec) Close() error {
+	close(self.replies)
+	if transport, ok := self.httpClient.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// fromJSON converts a decoded JSON value into what the XML-RPC codec would
+// have produced for the same XAPI reply.
+func fromJSON(v interface{}, floats bool) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case json.Number:
+		if floats {
+			f, _ := t.Float64()
+			return f
+		}
+		return strings.TrimSuffix(t.String(), ".0")
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, elem := range t {
+			a[i] = fromJSON(elem, floats)
+		}
+		return a
+	case map[string]interface{}:
+		s := make(xmlrpc.Struct, len(t))
+		for k, elem := range t {
+			s[k] = fromJSON(elem, floats)
+		}
+		return s
+	}
+	return v
+}
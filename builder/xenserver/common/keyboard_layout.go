@@ -0,0 +1,124 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+ * XenServer's VNC console turns the keysyms it's sent into scancodes with a
+ * US keymap, and the guest turns them back into characters with its own
+ * layout. So to type a character into a guest with, say, a German keyboard,
+ * the console has to be sent the US key that's in the same place as the
+ * character's key on a German keyboard, with Shift or AltGr as the German
+ * layout needs them.
+ *
+ * A layout is described by what each key produces, unshifted, shifted and
+ * with AltGr, listed in the order of keyPositions; a space means the key
+ * produces nothing. dead lists the characters that are first found on dead
+ * keys, which are typed followed by a space unless they're also on a live
+ * key.
+ */
+
+// keyPositions are the keys of a 102 key keyboard, as the US keysyms the
+// console maps to them. 0x3c is the extra key left of Z on ISO keyboards.
+var keyPositions = []uint32{
+	'`', '1', '2', '3', '4', '5', '6', '7', '8', '9', '0', '-', '=',
+	'q', 'w', 'e', 'r', 't', 'y', 'u', 'i', 'o', 'p', '[', ']', '\\',
+	'a', 's', 'd', 'f', 'g', 'h', 'j', 'k', 'l', ';', '\'',
+	0x3c, 'z', 'x', 'c', 'v', 'b', 'n', 'm', ',', '.', '/',
+}
+
+const keyAltGr uint32 = 0xFFEA
+
+type layoutDescription struct {
+	normal, shift, altGr string
+	dead                 string
+}
+
+var layoutDescriptions = map[string]layoutDescription{
+	"us": {
+		normal: "`1234567890-=qwertyuiop[]\\asdfghjkl;' zxcvbnm,./",
+		shift:  "~!@#$%^&*()_+QWERTYUIOP{}|ASDFGHJKL:\" ZXCVBNM<>?",
+		altGr:  "                                                ",
+	},
+	"uk": {
+		normal: "`1234567890-=qwertyuiop[]#asdfghjkl;'\\zxcvbnm,./",
+		shift:  "¬!\"£$%^&*()_+QWERTYUIOP{}~ASDFGHJKL:@|ZXCVBNM<>?",
+		altGr:  "¦   €                                           ",
+	},
+	"de": {
+		normal: "^1234567890ß´qwertzuiopü+#asdfghjklöä<yxcvbnm,.-",
+		shift:  "°!\"§$%&/()=?`QWERTZUIOPÜ*'ASDFGHJKLÖÄ>YXCVBNM;:_",
+		altGr:  "  ²³   {[]}\\ @ €        ~            |      µ   ",
+		dead:   "^´`",
+	},
+	"fr": {
+		normal: "²&é\"'(-è_çà)=azertyuiop^$*qsdfghjklmù<wxcvbn,;:!",
+		shift:  " 1234567890°+AZERTYUIOP¨£µQSDFGHJKLM%>WXCVBN?./§",
+		altGr:  "  ~#{[|`\\^@]}  €        ¤                       ",
+		dead:   "^¨~`",
+	},
+}
+
+// layoutKey is how to type a character: the key to press, the modifiers to
+// hold, and whether it's on a dead key.
+type layoutKey struct {
+	keysym uint32
+	shift  bool
+	altGr  bool
+	dead   bool
+}
+
+// keyboardLayout maps characters to the keys that type them.
+type keyboardLayout map[rune]layoutKey
+
+// newKeyboardLayout returns the named layout.
+func newKeyboardLayout(name string) (keyboardLayout, error) {
+	description, ok := layoutDescriptions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyboard layout '%s'", name)
+	}
+
+	layout := keyboardLayout{' ': {keysym: ' '}}
+	levels := []struct {
+		chars        string
+		shift, altGr bool
+	}{
+		{description.normal, false, false},
+		{description.shift, true, false},
+		{description.altGr, false, true},
+	}
+	for _, level := range levels {
+		if utf8.RuneCountInString(level.chars) != len(keyPositions) {
+			return nil, fmt.Errorf("keyboard layout '%s' doesn't describe %d keys", name, len(keyPositions))
+		}
+		position := 0
+		for _, r := range level.chars {
+			// A character on a dead key is better typed from a live key
+			if existing, ok := layout[r]; r != ' ' && (!ok || existing.dead) {
+				layout[r] = layoutKey{
+					keysym: keyPositions[position],
+					shift:  level.shift,
+					altGr:  level.altGr,
+					dead:   !ok && strings.ContainsRune(description.dead, r),
+				}
+			}
+			position++
+		}
+	}
+	return layout, nil
+}
+
+// key returns how to type r. Characters the layout doesn't have are sent
+// as their own keysyms, for the console to make what it can of them.
+func (self keyboardLayout) key(r rune) layoutKey {
+	if key, ok := self[r]; ok {
+		return key
+	}
+	if r < 0x100 {
+		return layoutKey{keysym: uint32(r)}
+	}
+	return layoutKey{keysym: 0x01000000 | uint32(r)}
+}
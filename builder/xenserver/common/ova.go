@@ -0,0 +1,303 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/mitchellh/multistep"
+)
+
+/*
+ * An ova packages the VM for other hypervisors. It's a tar of an OVF
+ * descriptor of the VM's hardware, a manifest of the SHA-256 digests of the
+ * other files, and the disks as streamOptimized VMDKs, in that order.
+ */
+
+type ovfDisk struct {
+	Name       string
+	File       string // the VMDK's name within the ova
+	Size       int64
+	Capacity   uint64
+	InstanceID int
+}
+
+type ovfNIC struct {
+	Network    string
+	InstanceID int
+}
+
+type ovfVM struct {
+	Name     string
+	VCpus    uint
+	MemoryMB uint64
+	Disks    []ovfDisk
+	NICs     []ovfNIC
+	Networks []string
+}
+
+// describeVM gathers what the OVF descriptor needs, preferring the
+// builder's configuration to what's read back from the VM.
+func (self *StepExport) describeVM(state multistep.StateBag, instance string, diskFiles []string) (*ovfVM, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	client := state.Get("client").(Hypervisor)
+
+	vm := &ovfVM{Name: config.VMName, VCpus: self.VMVCpus, MemoryMB: uint64(self.VMMemory)}
+
+	if vm.VCpus == 0 {
+		vcpus, err := client.GetVMVCpuMax(instance)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get the VM's vCPUs: %s", err.Error())
+		}
+		vm.VCpus = vcpus
+	}
+
+	if vm.MemoryMB == 0 {
+		memory, err := client.GetVMMemoryStaticMax(instance)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get the VM's memory size: %s", err.Error())
+		}
+		vm.MemoryMB = memory / (1024 * 1024)
+	}
+
+	disks, err := client.GetVMDisks(instance)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get VM disks: %s", err.Error())
+	}
+	if len(disks) != len(diskFiles) {
+		return nil, fmt.Errorf("Expected %d disks but the VM has %d", len(diskFiles), len(disks))
+	}
+
+	// The vCPUs, memory and disk controller come first
+	instanceID := 4
+
+	for i, disk := range disks {
+		var name string
+		if i < len(self.VMDisks) && len(self.VMDisks[i]) > 0 {
+			name = self.VMDisks[i][0]
+		} else if name, err = client.GetVdiNameLabel(disk); err != nil {
+			return nil, fmt.Errorf("Unable to get the name of disk %d: %s", i, err.Error())
+		}
+
+		size, err := client.GetVdiVirtualSize(disk)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get the size of disk %d: %s", i, err.Error())
+		}
+		capacity, err := strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad size '%s' for disk %d", size, i)
+		}
+
+		info, err := os.Stat(diskFiles[i])
+		if err != nil {
+			return nil, err
+		}
+
+		vm.Disks = append(vm.Disks, ovfDisk{
+			Name:       name,
+			File:       filepath.Base(diskFiles[i]),
+			Size:       info.Size(),
+			Capacity:   capacity,
+			InstanceID: instanceID,
+		})
+		instanceID++
+	}
+
+	vifs, err := client.GetVMVIFs(instance)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get VM VIFs: %s", err.Error())
+	}
+	seen := make(map[string]bool)
+	for _, vif := range vifs {
+		network, err := client.GetVIFNetwork(vif)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get the network of VIF '%s': %s", vif, err.Error())
+		}
+		name, err := client.GetNetworkNameLabel(network)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get the name of network '%s': %s", network, err.Error())
+		}
+
+		vm.NICs = append(vm.NICs, ovfNIC{Network: name, InstanceID: instanceID})
+		instanceID++
+		if !seen[name] {
+			seen[name] = true
+			vm.Networks = append(vm.Networks, name)
+		}
+	}
+
+	return vm, nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// The rasd elements must be in alphabetical order.
+var ovfTemplate = template.Must(template.New("ovf").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(
+	`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData">
+  <References>
+{{- range $i, $disk := .Disks}}
+    <File ovf:href="{{xml $disk.File}}" ovf:id="file{{$i}}" ovf:size="{{$disk.Size}}"/>
+{{- end}}
+  </References>
+  <DiskSection>
+    <Info>Virtual disks</Info>
+{{- range $i, $disk := .Disks}}
+    <Disk ovf:capacity="{{$disk.Capacity}}" ovf:diskId="vmdisk{{$i}}" ovf:fileRef="file{{$i}}" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+{{- end}}
+  </DiskSection>
+{{- if .Networks}}
+  <NetworkSection>
+    <Info>Logical networks</Info>
+{{- range .Networks}}
+    <Network ovf:name="{{xml .}}">
+      <Description>{{xml .}}</Description>
+    </Network>
+{{- end}}
+  </NetworkSection>
+{{- end}}
+  <VirtualSystem ovf:id="{{xml .Name}}">
+    <Info>A virtual machine</Info>
+    <Name>{{xml .Name}}</Name>
+    <OperatingSystemSection ovf:id="1">
+      <Info>The guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{xml .Name}}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-07</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>{{.VCpus}} virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.VCpus}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>{{.MemoryMB}}MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>{{.MemoryMB}}</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>lsilogic</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+{{- range $i, $disk := .Disks}}
+      <Item>
+        <rasd:AddressOnParent>{{$i}}</rasd:AddressOnParent>
+        <rasd:ElementName>{{xml $disk.Name}}</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk{{$i}}</rasd:HostResource>
+        <rasd:InstanceID>{{$disk.InstanceID}}</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+{{- end}}
+{{- range .NICs}}
+      <Item>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>{{xml .Network}}</rasd:Connection>
+        <rasd:ElementName>Ethernet adapter on {{xml .Network}}</rasd:ElementName>
+        <rasd:InstanceID>{{.InstanceID}}</rasd:InstanceID>
+        <rasd:ResourceSubType>E1000</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+{{- end}}
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`))
+
+// writeOVA packages the disks, whose SHA-256 digests are given by path,
+// into filename and returns the ova's own digest.
+func writeOVA(filename string, vm *ovfVM, diskFiles []string, digests map[string]string) (string, error) {
+	var ovf bytes.Buffer
+	if err := ovfTemplate.Execute(&ovf, vm); err != nil {
+		return "", err
+	}
+	ovfName := vm.Name + ".ovf"
+
+	var manifest bytes.Buffer
+	ovfDigest := sha256.Sum256(ovf.Bytes())
+	fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", ovfName, hex.EncodeToString(ovfDigest[:]))
+	for _, file := range diskFiles {
+		fmt.Fprintf(&manifest, "SHA256(%s)= %s\n", filepath.Base(file), digests[file])
+	}
+
+	fh, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	hash := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(fh, hash))
+
+	add := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(ovaHeader(name, size)); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+
+	if err := add(ovfName, int64(ovf.Len()), &ovf); err != nil {
+		return "", err
+	}
+	if err := add(vm.Name+".mf", int64(manifest.Len()), &manifest); err != nil {
+		return "", err
+	}
+	for i, file := range diskFiles {
+		disk, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		err = add(filepath.Base(file), vm.Disks[i].Size, disk)
+		disk.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ovaHeader describes a file in the ova. The format is left to archive/tar,
+// which writes USTAR, as the OVF spec asks for, unless the file is too big
+// for it: a disk of 8 GiB or more gets a PAX size record instead.
+func ovaHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+}
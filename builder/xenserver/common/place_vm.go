@@ -0,0 +1,150 @@
+package common
+
+import (
+	"fmt"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"log"
+)
+
+/*
+ * Placement of the VM within a pool. By default XAPI chooses a host when
+ * the VM starts. affinity_host pins the VM to one host, and placement
+ * "auto" picks the host with the most free memory. Either way the host must
+ * be enabled, live, able to reach every SR the VM has disks in (as
+ * VM.get_possible_hosts says) and have room for the VM's memory_static_max.
+ */
+
+// StartVMOnChosenHost starts the VM on the host chosen by ChooseHost.
+func StartVMOnChosenHost(state multistep.StateBag, instance string, paused bool) error {
+	ui := state.Get("ui").(packer.Ui)
+	client := state.Get("client").(Hypervisor)
+
+	host, err := ChooseHost(state, instance)
+	if err != nil {
+		return err
+	}
+
+	if host == "" {
+		return client.StartVM(instance, paused, false)
+	}
+
+	name, _ := client.GetHostNameLabel(host)
+	ui.Message(fmt.Sprintf("Starting the VM on host '%s'", name))
+	return client.StartVMOn(instance, host, paused, false)
+}
+
+// ChooseHost returns the host the VM should start on, or "" to leave the
+// choice to XAPI.
+func ChooseHost(state multistep.StateBag, instance string) (string, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	client := state.Get("client").(Hypervisor)
+
+	if config.AffinityHost == "" && config.Placement != "auto" {
+		return "", nil
+	}
+
+	required, err := client.GetVMMemoryStaticMax(instance)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get the VM's memory size: %s", err.Error())
+	}
+
+	possibleHosts, err := client.GetVMPossibleHosts(instance)
+	if err != nil {
+		return "", fmt.Errorf("Unable to find the hosts that can run the VM: %s", err.Error())
+	}
+	possible := make(map[string]bool)
+	for _, host := range possibleHosts {
+		possible[host] = true
+	}
+
+	if config.AffinityHost != "" {
+		host, err := findHost(client, config.AffinityHost)
+		if err != nil {
+			return "", err
+		}
+		if !possible[host] {
+			return "", fmt.Errorf("Unable to start the VM on affinity_host '%s': the host can't reach the VM's storage", config.AffinityHost)
+		}
+		if _, err := hostCapacity(client, host, required); err != nil {
+			return "", fmt.Errorf("Unable to start the VM on affinity_host '%s': %s", config.AffinityHost, err.Error())
+		}
+		return host, nil
+	}
+
+	hosts, err := client.GetHosts()
+	if err != nil {
+		return "", fmt.Errorf("Unable to list the hosts in the pool: %s", err.Error())
+	}
+
+	best := ""
+	var bestFree uint64
+	for _, host := range hosts {
+		if !possible[host] {
+			log.Printf("Not placing the VM on host '%s': the host can't reach the VM's storage", host)
+			continue
+		}
+		free, err := hostCapacity(client, host, required)
+		if err != nil {
+			log.Printf("Not placing the VM on host '%s': %s", host, err.Error())
+			continue
+		}
+		if best == "" || free > bestFree {
+			best, bestFree = host, free
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("No host in the pool can reach the VM's storage and has %d MB of free memory for it", required/(1024*1024))
+	}
+	return best, nil
+}
+
+// findHost looks a host up by UUID, then by name label.
+func findHost(client Hypervisor, nameOrUuid string) (string, error) {
+	if host, err := client.GetHostByUuid(nameOrUuid); err == nil {
+		return host, nil
+	}
+
+	hosts, err := client.GetHostByNameLabel(nameOrUuid)
+	if err != nil {
+		return "", fmt.Errorf("Unable to find host '%s': %s", nameOrUuid, err.Error())
+	}
+	switch len(hosts) {
+	case 0:
+		return "", fmt.Errorf("Couldn't find a host with name or UUID '%s'", nameOrUuid)
+	case 1:
+		return hosts[0], nil
+	}
+	return "", fmt.Errorf("Found more than one host named '%s'; use its UUID instead", nameOrUuid)
+}
+
+// hostCapacity checks the host can take a VM needing required bytes of
+// memory, and returns its free memory.
+func hostCapacity(client Hypervisor, host string, required uint64) (uint64, error) {
+	enabled, err := client.GetHostEnabled(host)
+	if err != nil {
+		return 0, err
+	}
+	if !enabled {
+		return 0, fmt.Errorf("the host is disabled")
+	}
+
+	live, err := client.GetHostLive(host)
+	if err != nil {
+		return 0, err
+	}
+	if !live {
+		return 0, fmt.Errorf("the host is not live")
+	}
+
+	free, err := client.GetHostMemoryFree(host)
+	if err != nil {
+		return 0, err
+	}
+	if free < required {
+		return 0, fmt.Errorf("the host has %d MB of free memory, but the VM needs %d MB",
+			free/(1024*1024), required/(1024*1024))
+	}
+	return free, nil
+}
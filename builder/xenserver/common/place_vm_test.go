@@ -0,0 +1,124 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+// testPool adds hosts alongside the server's own, which has 8GB free.
+func testPool(server *xapitest.Server) (big, small string) {
+	big = server.AddHost("big", "10.0.0.2", 12<<30)
+	small = server.AddHost("small", "10.0.0.3", 1<<30)
+	disabled := server.AddHost("disabled", "10.0.0.4", 32<<30)
+	server.Set(disabled, "enabled", false)
+	return
+}
+
+func testPlacementState(t *testing.T, server *xapitest.Server, config CommonConfig) (multistep.StateBag, string) {
+	state := testState(t, server)
+	config.KeepVM = "never"
+	state.Put("commonconfig", config)
+
+	instance := server.Create("VM", map[string]interface{}{
+		"name_label":        "packer-test",
+		"memory_static_max": "2147483648",
+	})
+	return state, instance
+}
+
+func TestStartVMOnChosenHost_Default(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	testPool(server)
+
+	state, instance := testPlacementState(t, server, CommonConfig{Placement: "xapi"})
+	if err := StartVMOnChosenHost(state, instance, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if server.Record(instance)["resident_on"] != server.HostRef {
+		t.Fatalf("expected XAPI to choose the host, got %v", server.Record(instance)["resident_on"])
+	}
+	for _, call := range server.Calls() {
+		if call == "VM.start_on" {
+			t.Fatal("VM.start_on shouldn't be used without a placement option")
+		}
+	}
+}
+
+func TestStartVMOnChosenHost_Auto(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	big, _ := testPool(server)
+
+	state, instance := testPlacementState(t, server, CommonConfig{Placement: "auto"})
+	if err := StartVMOnChosenHost(state, instance, true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rec := server.Record(instance)
+	if rec["resident_on"] != big {
+		t.Fatalf("expected the host with the most free memory, got %v", rec["resident_on"])
+	}
+	if rec["power_state"] != "Paused" {
+		t.Fatalf("expected the VM to start paused, got %v", rec["power_state"])
+	}
+
+	// Nothing has room for a 64GB VM
+	state, instance = testPlacementState(t, server, CommonConfig{Placement: "auto"})
+	server.Set(instance, "memory_static_max", "68719476736")
+	if err := StartVMOnChosenHost(state, instance, false); err == nil {
+		t.Fatal("expected placement to fail when no host has room")
+	}
+}
+
+func TestStartVMOnChosenHost_Affinity(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	testPool(server)
+
+	uuid := server.Record(server.HostRef)["uuid"].(string)
+	state, instance := testPlacementState(t, server, CommonConfig{AffinityHost: uuid, Placement: "xapi"})
+	if err := StartVMOnChosenHost(state, instance, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if server.Record(instance)["resident_on"] != server.HostRef {
+		t.Fatalf("expected the affinity host, got %v", server.Record(instance)["resident_on"])
+	}
+
+	for _, name := range []string{"small", "disabled", "missing"} {
+		state, instance = testPlacementState(t, server, CommonConfig{AffinityHost: name, Placement: "xapi"})
+		if err := StartVMOnChosenHost(state, instance, false); err == nil {
+			t.Fatalf("expected affinity_host '%s' to be refused", name)
+		}
+		if server.Record(instance)["power_state"] != "Halted" {
+			t.Fatalf("the VM shouldn't have started for affinity_host '%s'", name)
+		}
+	}
+}
+
+func TestStartVMOnChosenHost_AutoStorage(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	testPool(server)
+
+	// The VM's disk is in an SR only the server's own host can see
+	sr := server.Create("SR", map[string]interface{}{"name_label": "local"})
+	server.Create("PBD", map[string]interface{}{"SR": sr, "host": server.HostRef})
+	vdi := server.Create("VDI", map[string]interface{}{"SR": sr})
+
+	state, instance := testPlacementState(t, server, CommonConfig{Placement: "auto"})
+	server.Create("VBD", map[string]interface{}{"VM": instance, "VDI": vdi, "userdevice": "0"})
+	if err := StartVMOnChosenHost(state, instance, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if server.Record(instance)["resident_on"] != server.HostRef {
+		t.Fatalf("expected the host that can see the VM's SR, got %v", server.Record(instance)["resident_on"])
+	}
+
+	state, instance = testPlacementState(t, server, CommonConfig{AffinityHost: "big", Placement: "xapi"})
+	server.Create("VBD", map[string]interface{}{"VM": instance, "VDI": vdi, "userdevice": "0"})
+	if err := StartVMOnChosenHost(state, instance, false); err == nil {
+		t.Fatal("expected affinity_host 'big' to be refused, as it can't see the VM's SR")
+	}
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+)
+
+/*
+ * qcow2Writer writes a version 2 qcow2 image with 64K clusters. The header
+ * takes the first cluster and the data clusters follow in disk order. On
+ * Close the L1 table, refcount blocks and refcount table are appended; each
+ * L2 table is appended as soon as the data it maps has been written, so
+ * only one is held in memory.
+ */
+
+const (
+	qcow2ClusterBits     = 16
+	qcow2ClusterSize     = 1 << qcow2ClusterBits
+	qcow2L2Entries       = qcow2ClusterSize / 8
+	qcow2RefcountEntries = qcow2ClusterSize / 2
+	qcow2Copied          = uint64(1) << 63
+	qcow2Magic           = 0x514649fb
+)
+
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+type qcow2Writer struct {
+	sparseWriter
+	fh *os.File
+
+	next    int64            // next free cluster
+	l1      map[int64]uint64 // L2 table offsets by L1 index
+	l2Index int64
+	l2      []uint64 // the L2 table being filled
+}
+
+func newQcow2Writer(fh *os.File) *qcow2Writer {
+	w := &qcow2Writer{fh: fh}
+	w.sparseWriter = sparseWriter{buf: make([]byte, qcow2ClusterSize), block: w.writeCluster}
+	w.start()
+	return w
+}
+
+func (self *qcow2Writer) start() {
+	self.reset()
+	self.next = 1
+	self.l1 = make(map[int64]uint64)
+	self.l2Index = 0
+	self.l2 = make([]uint64, qcow2L2Entries)
+}
+
+func (self *qcow2Writer) Reset() error {
+	self.start()
+	return truncate(self.fh)
+}
+
+func (self *qcow2Writer) allocate(clusters int64) int64 {
+	offset := self.next * qcow2ClusterSize
+	self.next += clusters
+	return offset
+}
+
+func (self *qcow2Writer) writeCluster(index int64, data []byte) error {
+	if index/qcow2L2Entries != self.l2Index {
+		if err := self.flushL2(); err != nil {
+			return err
+		}
+		self.l2Index = index / qcow2L2Entries
+	}
+
+	offset := self.allocate(1)
+	if _, err := self.fh.WriteAt(data, offset); err != nil {
+		return err
+	}
+	self.l2[index%qcow2L2Entries] = uint64(offset) | qcow2Copied
+	return nil
+}
+
+// flushL2 writes out the current L2 table if it maps anything.
+func (self *qcow2Writer) flushL2() error {
+	used := false
+	for _, entry := range self.l2 {
+		if entry != 0 {
+			used = true
+			break
+		}
+	}
+	if !used {
+		return nil
+	}
+
+	offset := self.allocate(1)
+	if err := writeBigEndian(self.fh, offset, self.l2); err != nil {
+		return err
+	}
+	self.l1[self.l2Index] = uint64(offset) | qcow2Copied
+	self.l2 = make([]uint64, qcow2L2Entries)
+	return nil
+}
+
+func (self *qcow2Writer) Close() error {
+	if err := self.flush(); err != nil {
+		return err
+	}
+	if err := self.flushL2(); err != nil {
+		return err
+	}
+
+	l1Size := (self.size + qcow2ClusterSize*qcow2L2Entries - 1) / (qcow2ClusterSize * qcow2L2Entries)
+	if l1Size == 0 {
+		l1Size = 1
+	}
+	l1 := make([]uint64, l1Size)
+	for i, offset := range self.l1 {
+		l1[i] = offset
+	}
+	l1Offset := self.allocate(clustersFor(l1Size * 8))
+	if err := writeBigEndian(self.fh, l1Offset, l1); err != nil {
+		return err
+	}
+
+	// The refcount blocks and table have to count themselves as well
+	var blocks, tableClusters int64
+	for {
+		total := self.next + blocks + tableClusters
+		b := (total + qcow2RefcountEntries - 1) / qcow2RefcountEntries
+		t := clustersFor(b * 8)
+		if b == blocks && t == tableClusters {
+			break
+		}
+		blocks, tableClusters = b, t
+	}
+	total := self.next + blocks + tableClusters
+
+	table := make([]uint64, tableClusters*qcow2ClusterSize/8)
+	for i := int64(0); i < blocks; i++ {
+		refcounts := make([]uint16, qcow2RefcountEntries)
+		for j := range refcounts {
+			if i*qcow2RefcountEntries+int64(j) < total {
+				refcounts[j] = 1
+			}
+		}
+
+		offset := self.allocate(1)
+		if err := writeBigEndian(self.fh, offset, refcounts); err != nil {
+			return err
+		}
+		table[i] = uint64(offset)
+	}
+
+	tableOffset := self.allocate(tableClusters)
+	if err := writeBigEndian(self.fh, tableOffset, table); err != nil {
+		return err
+	}
+
+	header := qcow2Header{
+		Magic:                 qcow2Magic,
+		Version:               2,
+		ClusterBits:           qcow2ClusterBits,
+		Size:                  uint64(self.size),
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         uint64(l1Offset),
+		RefcountTableOffset:   uint64(tableOffset),
+		RefcountTableClusters: uint32(tableClusters),
+	}
+	return writeBigEndian(self.fh, 0, header)
+}
+
+func clustersFor(n int64) int64 {
+	return (n + qcow2ClusterSize - 1) / qcow2ClusterSize
+}
+
+func writeBigEndian(fh *os.File, offset int64, data interface{}) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, data); err != nil {
+		return err
+	}
+	_, err := fh.WriteAt(buf.Bytes(), offset)
+	return err
+}
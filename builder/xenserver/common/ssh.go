@@ -7,13 +7,16 @@ import (
 	"github.com/mitchellh/packer/communicator/ssh"
 	"github.com/mitchellh/packer/packer"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	commonssh "github.com/mitchellh/packer/common/ssh"
 	"github.com/pkg/sftp"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 func SSHAddress(state multistep.StateBag) (string, error) {
@@ -23,7 +26,7 @@ func SSHAddress(state multistep.StateBag) (string, error) {
 }
 
 func SSHLocalAddress(state multistep.StateBag) (string, error) {
-	sshLocalPort, ok := state.Get("local_ssh_port").(uint)
+	sshLocalPort, ok := state.Get("local_comm_port").(uint)
 	if !ok {
 		return "", fmt.Errorf("SSH port forwarding hasn't been set up yet")
 	}
@@ -32,14 +35,10 @@ func SSHLocalAddress(state multistep.StateBag) (string, error) {
 }
 
 func SSHPort(state multistep.StateBag) (int, error) {
-	sshHostPort := state.Get("local_ssh_port").(uint)
+	sshHostPort := state.Get("local_comm_port").(uint)
 	return int(sshHostPort), nil
 }
 
-func CommHost(state multistep.StateBag) (string, error) {
-	return "127.0.0.1", nil
-}
-
 func SSHConfigFunc(config SSHConfig) func(multistep.StateBag) (*gossh.ClientConfig, error) {
 	return func(state multistep.StateBag) (*gossh.ClientConfig, error) {
 		config := state.Get("commonconfig").(CommonConfig)
@@ -58,19 +57,143 @@ func SSHConfigFunc(config SSHConfig) func(multistep.StateBag) (*gossh.ClientConf
 			auth = append(auth, gossh.PublicKeys(signer))
 		}
 
+		hostKeyCallback, err := HostKeyCallback("", config.SSHHostKeyFingerprint)
+		if err != nil {
+			return nil, err
+		}
+
 		return &gossh.ClientConfig{
-			User: config.SSHUser,
-			Auth: auth,
+			User:            config.SSHUser,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
 		}, nil
 	}
 }
 
-func doExecuteSSHCmd(cmd, target string, config *gossh.ClientConfig) (stdout string, err error) {
-	client, err := gossh.Dial("tcp", target, config)
+// HostSSHKeyCallback checks dom0's host key against remote_ssh_known_hosts
+// and remote_ssh_host_key_fingerprint.
+func (config CommonConfig) HostSSHKeyCallback() (func(string, net.Addr, gossh.PublicKey) error, error) {
+	return HostKeyCallback(config.RemoteSSHKnownHosts, config.RemoteSSHHostKeyFingerprint)
+}
+
+// HostSSHKeyAlgorithms returns the host key types to ask the dom0 at addr
+// for, as remote_ssh_known_hosts has them.
+func (config CommonConfig) HostSSHKeyAlgorithms(addr string) ([]string, error) {
+	return HostKeyAlgorithms(config.RemoteSSHKnownHosts, addr)
+}
+
+// HostSSHConfig returns the client config for connecting to dom0, along
+// with the SSH agent it authenticates with, if remote_ssh_agent_auth is set,
+// which the HostSSHClient using the config should close.
+func HostSSHConfig(config CommonConfig) (*gossh.ClientConfig, *SSHAgent, error) {
+	hostKeyCallback, err := config.HostSSHKeyCallback()
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+
+	var sshAgent *SSHAgent
+	if config.RemoteSSHAgentAuth {
+		sshAgent = new(SSHAgent)
+	}
+
+	auth, err := hostSSHAuth(config, sshAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := config.RemoteSSHUsername
+	if user == "" {
+		user = config.Username
+	}
+
+	return &gossh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, sshAgent, nil
+}
+
+// hostSSHAuth returns the ways to authenticate to dom0. The XAPI password is
+// only offered when neither a key nor the agent is configured, so that
+// password logins can be turned off on the host.
+func hostSSHAuth(config CommonConfig, sshAgent *SSHAgent) ([]gossh.AuthMethod, error) {
+	var auth []gossh.AuthMethod
+
+	if config.RemoteSSHPrivateKeyFile != "" {
+		signer, err := commonssh.FileSigner(config.RemoteSSHPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, gossh.PublicKeys(signer))
+	}
+
+	if sshAgent != nil {
+		auth = append(auth, gossh.PublicKeysCallback(sshAgent.Signers))
+	}
+
+	if len(auth) == 0 {
+		auth = append(auth, gossh.Password(config.Password))
+	}
+
+	return auth, nil
+}
+
+// SSHAgent is a connection to the local SSH agent at SSH_AUTH_SOCK. It's
+// dialled when a handshake first asks for the agent's keys and kept for the
+// handshakes that follow, as the agent does the signing, until it's closed.
+type SSHAgent struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Signers returns the keys held by the agent.
+func (self *SSHAgent) Signers() ([]gossh.Signer, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.conn == nil {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+		}
+
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("Error connecting to the SSH agent: %s", err)
+		}
+		self.conn = conn
+	}
+
+	signers, err := agent.NewClient(self.conn).Signers()
+	if err != nil {
+		self.conn.Close()
+		self.conn = nil
 	}
+	return signers, err
+}
+
+// Close closes the connection to the agent, if there is one.
+func (self *SSHAgent) Close() error {
+	if self == nil {
+		return nil
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+// sshSessionOpener is satisfied by both *gossh.Client and *HostSSHClient.
+type sshSessionOpener interface {
+	NewSession() (*gossh.Session, error)
+}
+
+func doExecuteSSHCmd(cmd string, client sshSessionOpener) (stdout string, err error) {
 	//Create session
 	session, err := client.NewSession()
 	if err != nil {
@@ -88,13 +211,8 @@ func doExecuteSSHCmd(cmd, target string, config *gossh.ClientConfig) (stdout str
 	return strings.Trim(b.String(), "\n"), nil
 }
 
-func doExecuteSSHCmds(state multistep.StateBag, cmds[] string, target string, config *gossh.ClientConfig) (stdout string, err error) {
+func doExecuteSSHCmds(state multistep.StateBag, cmds[] string, client sshSessionOpener) (stdout string, err error) {
 	ui := state.Get("ui").(packer.Ui)
-	client, err := gossh.Dial("tcp", target, config)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Error connecting to host. '%s'.", err))
-		return "", err
-	}
 
 	var results bytes.Buffer
 
@@ -128,63 +246,50 @@ func doExecuteSSHCmds(state multistep.StateBag, cmds[] string, target string, co
 }
 
 func ExecuteHostSSHCmds(state multistep.StateBag, cmds[] string) (stdout string, err error) {
-	config := state.Get("commonconfig").(CommonConfig)
-
-	// Setup connection config
-	sshConfig := &gossh.ClientConfig{
-		User: config.Username,
-		Auth: []gossh.AuthMethod{
-			gossh.Password(config.Password),
-		},
-	}
-	return doExecuteSSHCmds(state, cmds, config.HostIp + ":22", sshConfig)
+	client := state.Get("host_ssh").(*HostSSHClient)
+	return doExecuteSSHCmds(state, cmds, client)
 }
 
 
 func ExecuteHostSSHCmd(state multistep.StateBag, cmd string) (stdout string, err error) {
-	config := state.Get("commonconfig").(CommonConfig)
-	// Setup connection config
-	sshConfig := &gossh.ClientConfig{
-		User: config.Username,
-		Auth: []gossh.AuthMethod{
-			gossh.Password(config.Password),
-		},
-	}
-	return doExecuteSSHCmd(cmd, config.HostIp+":22", sshConfig)
+	client := state.Get("host_ssh").(*HostSSHClient)
+	return doExecuteSSHCmd(cmd, client)
 }
 
 func ExecuteGuestSSHCmd(state multistep.StateBag, cmd string) (stdout string, err error) {
 	config := state.Get("commonconfig").(CommonConfig)
-	localAddress, err := SSHLocalAddress(state)
+	host, err := CommHost(state)
 	if err != nil {
 		return
 	}
+	port, err := CommPort(state)
+	if err != nil {
+		return
+	}
+	localAddress := net.JoinHostPort(host, strconv.Itoa(port))
 	sshConfig, err := SSHConfigFunc(config.SSHConfig)(state)
 	if err != nil {
 		return
 	}
 
-	return doExecuteSSHCmd(cmd, localAddress, sshConfig)
+	client, err := gossh.Dial("tcp", localAddress, sshConfig)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	return doExecuteSSHCmd(cmd, client)
 }
 
 func UploadFile (state multistep.StateBag, localFilename string, remoteFilename string, allowExecute bool) error {
 	ui := state.Get("ui").(packer.Ui)
 	config := state.Get("commonconfig").(CommonConfig)
 
-	// Setup connection config
-	sshConfig := &gossh.ClientConfig{
-		User: config.Username,
-		Auth: []gossh.AuthMethod{
-			gossh.Password(config.Password),
-		},
-	}
-
-	sshClient, err := gossh.Dial("tcp", config.HostIp + ":22", sshConfig)
+	sshClient, err := state.Get("host_ssh").(*HostSSHClient).Client()
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error connecting to host. '%s'.", err))
 		return err
 	}
-	defer sshClient.Close()
 
 	sftpClient, err := sftp.NewClient(sshClient)
 	if err != nil {
@@ -223,18 +328,11 @@ func UploadFile (state multistep.StateBag, localFilename string, remoteFilename
 	return nil
 }
 
-func forward(local_conn net.Conn, config *gossh.ClientConfig, server, remote_dest string, remote_port uint) error {
+func forward(local_conn net.Conn, client *HostSSHClient, remote_dest string, remote_port uint) error {
 	defer local_conn.Close()
 
-	ssh_client_conn, err := gossh.Dial("tcp", server+":22", config)
-	if err != nil {
-		log.Printf("local ssh.Dial error: %s", err)
-		return err
-	}
-	defer ssh_client_conn.Close()
-
 	remote_loc := fmt.Sprintf("%s:%d", remote_dest, remote_port)
-	ssh_conn, err := ssh_client_conn.Dial("tcp", remote_loc)
+	ssh_conn, err := client.Dial("tcp", remote_loc)
 	if err != nil {
 		log.Printf("ssh.Dial error: %s", err)
 		return err
@@ -245,7 +343,7 @@ func forward(local_conn net.Conn, config *gossh.ClientConfig, server, remote_des
 	rxDone := make(chan struct{})
 
 	go func() {
-		_, err = io.Copy(ssh_conn, local_conn)
+		_, err := io.Copy(ssh_conn, local_conn)
 		if err != nil {
 			log.Printf("io.copy failed: %v", err)
 		}
@@ -253,7 +351,7 @@ func forward(local_conn net.Conn, config *gossh.ClientConfig, server, remote_des
 	}()
 
 	go func() {
-		_, err = io.Copy(local_conn, ssh_conn)
+		_, err := io.Copy(local_conn, ssh_conn)
 		if err != nil {
 			log.Printf("io.copy failed: %v", err)
 		}
@@ -266,14 +364,7 @@ func forward(local_conn net.Conn, config *gossh.ClientConfig, server, remote_des
 	return nil
 }
 
-func ssh_port_forward(local_listener net.Listener, remote_port uint, remote_dest, host, username, password string) error {
-
-	config := &gossh.ClientConfig{
-		User: username,
-		Auth: []gossh.AuthMethod{
-			gossh.Password(password),
-		},
-	}
+func ssh_port_forward(local_listener net.Listener, remote_port uint, remote_dest string, client *HostSSHClient) error {
 
 	for {
 		local_connection, err := local_listener.Accept()
@@ -284,7 +375,7 @@ func ssh_port_forward(local_listener net.Listener, remote_port uint, remote_dest
 		}
 
 		// Forward to a remote port
-		go forward(local_connection, config, host, remote_dest, remote_port)
+		go forward(local_connection, client, remote_dest, remote_port)
 	}
 
 	return nil
@@ -2,6 +2,7 @@ package common
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/mitchellh/packer/helper/communicator"
@@ -15,6 +16,13 @@ type SSHConfig struct {
 	SSHHostPortMax    uint `mapstructure:"ssh_host_port_max"`
 	SSHSkipNatMapping bool `mapstructure:"ssh_skip_nat_mapping"`
 
+	SSHHostKeyFingerprint string `mapstructure:"ssh_host_key_fingerprint"`
+
+	// SSHConnectMode is "tunnel" to reach the guest communicator through a
+	// port forward over SSH to dom0, or "direct" to connect to the guest's
+	// IP from this machine.
+	SSHConnectMode string `mapstructure:"ssh_connect_mode"`
+
 	// These are deprecated, but we keep them around for BC
 	// TODO(@mitchellh): remove
 	SSHKeyPath     string        `mapstructure:"ssh_key_path"`
@@ -30,6 +38,10 @@ func (c *SSHConfig) Prepare(ctx *interpolate.Context) []error {
 		c.SSHHostPortMax = 4444
 	}
 
+	if c.SSHConnectMode == "" {
+		c.SSHConnectMode = "tunnel"
+	}
+
 	// TODO: backwards compatibility, write fixer instead
 	if c.SSHKeyPath != "" {
 		c.Comm.SSHPrivateKey = c.SSHKeyPath
@@ -39,6 +51,17 @@ func (c *SSHConfig) Prepare(ctx *interpolate.Context) []error {
 	}
 
 	errs := c.Comm.Prepare(ctx)
+	switch c.SSHConnectMode {
+	case "tunnel", "direct":
+	default:
+		errs = append(errs, errors.New("ssh_connect_mode must be one of 'tunnel', 'direct'"))
+	}
+
+	if c.SSHHostKeyFingerprint != "" {
+		if _, err := parseSSHFingerprint(c.SSHHostKeyFingerprint); err != nil {
+			errs = append(errs, fmt.Errorf("ssh_host_key_fingerprint is invalid: %s", err))
+		}
+	}
 	if c.SSHHostPortMin > c.SSHHostPortMax {
 		errs = append(errs,
 			errors.New("ssh_host_port_min must be less than ssh_host_port_max"))
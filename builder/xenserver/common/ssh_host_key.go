@@ -0,0 +1,264 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+/*
+ * Host key checking for the SSH connections to dom0 and to the guest.
+ *
+ * dom0 can be checked against a known_hosts file, a pinned fingerprint, or
+ * both. The guest is only ever reached through a local port forward, so
+ * there's no meaningful host name to look up and only pinning is offered.
+ * When nothing is configured any key is accepted, as before, and its
+ * fingerprint is logged so it can be pinned. A host that has keys of
+ * several types is only asked for the types known_hosts has for it, else it
+ * may offer one that can't be checked.
+ */
+
+// SSHFingerprint returns the OpenSSH SHA-256 fingerprint of key, e.g.
+// "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+func SSHFingerprint(key gossh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func sshMD5Fingerprint(key gossh.PublicKey) string {
+	sum := md5.Sum(key.Marshal())
+	return md5FingerprintString(sum[:])
+}
+
+func md5FingerprintString(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return "MD5:" + strings.Join(parts, ":")
+}
+
+// parseSSHFingerprint accepts a fingerprint as printed by `ssh-keygen -l`:
+// either "SHA256:<base64>" or the older colon separated MD5 form, with or
+// without its "MD5:" prefix. It returns the fingerprint in the form
+// SSHFingerprint or sshMD5Fingerprint would produce.
+func parseSSHFingerprint(fingerprint string) (string, error) {
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		encoded := strings.TrimRight(strings.TrimPrefix(fingerprint, "SHA256:"), "=")
+		sum, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil || len(sum) != sha256.Size {
+			return "", errors.New("expected a fingerprint of the form SHA256:<base64>")
+		}
+		return "SHA256:" + encoded, nil
+	}
+
+	md5hex := strings.Replace(strings.TrimPrefix(fingerprint, "MD5:"), ":", "", -1)
+	sum, err := hex.DecodeString(md5hex)
+	if err != nil || len(sum) != md5.Size {
+		return "", errors.New("expected a fingerprint of the form SHA256:<base64> or MD5:xx:xx:...")
+	}
+	return md5FingerprintString(sum), nil
+}
+
+// knownHost is one usable line of a known_hosts file.
+type knownHost struct {
+	revoked bool
+	hosts   []string
+	key     gossh.PublicKey
+}
+
+func loadKnownHosts(filename string) ([]knownHost, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []knownHost
+	for {
+		marker, hosts, key, _, rest, err := gossh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse '%s': %s", filename, err)
+		}
+		data = rest
+
+		// Host certificates aren't supported by this version of the ssh
+		// package, so CA lines can't match anything.
+		if marker == "cert-authority" {
+			continue
+		}
+		entries = append(entries, knownHost{revoked: marker == "revoked", hosts: hosts, key: key})
+	}
+	return entries, nil
+}
+
+// matchKnownHost reports whether a host pattern from known_hosts names the
+// given host and port. Both plain names and `HashKnownHosts` entries are
+// understood; wildcard patterns are not.
+func matchKnownHost(pattern, host, port string) bool {
+	name := host
+	if port != "22" {
+		name = fmt.Sprintf("[%s]:%s", host, port)
+	}
+
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[len("|1|"):], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(name))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+
+	return pattern == name
+}
+
+// HostKeyCallback returns a callback for gossh.ClientConfig that checks the
+// server's key against the known_hosts file and/or the pinned fingerprint.
+// Either may be empty; with neither, every key is accepted.
+func HostKeyCallback(knownHostsFile, fingerprint string) (func(string, net.Addr, gossh.PublicKey) error, error) {
+	var entries []knownHost
+	if knownHostsFile != "" {
+		var err error
+		if entries, err = loadKnownHosts(knownHostsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if fingerprint != "" {
+		var err error
+		if fingerprint, err = parseSSHFingerprint(fingerprint); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		host, port, err := net.SplitHostPort(hostname)
+		if err != nil {
+			host, port = hostname, "22"
+		}
+
+		if knownHostsFile != "" {
+			if err := checkKnownHosts(entries, host, port, key); err != nil {
+				return fmt.Errorf("host key verification failed for %s: %s", hostname, err)
+			}
+		}
+
+		if fingerprint != "" {
+			actual := SSHFingerprint(key)
+			if strings.HasPrefix(fingerprint, "MD5:") {
+				actual = sshMD5Fingerprint(key)
+			}
+			if actual != fingerprint {
+				return fmt.Errorf("host key verification failed for %s: the %s key has fingerprint %s, expected %s",
+					hostname, key.Type(), actual, fingerprint)
+			}
+		}
+
+		if knownHostsFile == "" && fingerprint == "" {
+			log.Printf("Accepting unverified %s host key %s for %s", key.Type(), SSHFingerprint(key), hostname)
+		}
+		return nil
+	}, nil
+}
+
+// HostKeyAlgorithms returns the types of the keys the known_hosts file has
+// for addr, for gossh.ClientConfig.HostKeyAlgorithms. It's nil, leaving the
+// defaults, when there's no file or it has nothing for addr.
+func HostKeyAlgorithms(knownHostsFile, addr string) ([]string, error) {
+	if knownHostsFile == "" {
+		return nil, nil
+	}
+	entries, err := loadKnownHosts(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "22"
+	}
+	return knownHostKeyAlgorithms(entries, host, port), nil
+}
+
+func knownHostKeyAlgorithms(entries []knownHost, host, port string) []string {
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.revoked || seen[entry.key.Type()] {
+			continue
+		}
+		for _, pattern := range entry.hosts {
+			if matchKnownHost(pattern, host, port) {
+				seen[entry.key.Type()] = true
+				algorithms = append(algorithms, entry.key.Type())
+				break
+			}
+		}
+	}
+	return algorithms
+}
+
+func checkKnownHosts(entries []knownHost, host, port string, key gossh.PublicKey) error {
+	marshalled := key.Marshal()
+
+	// A revoked key is refused whichever hosts its line names, as those are
+	// usually wildcards.
+	for _, entry := range entries {
+		if entry.revoked && bytes.Equal(entry.key.Marshal(), marshalled) {
+			return fmt.Errorf("the %s key %s is marked as revoked", key.Type(), SSHFingerprint(key))
+		}
+	}
+
+	found := false
+	for _, entry := range entries {
+		if entry.revoked {
+			continue
+		}
+
+		matched := false
+		for _, pattern := range entry.hosts {
+			if matchKnownHost(pattern, host, port) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		found = true
+		if bytes.Equal(entry.key.Marshal(), marshalled) {
+			return nil
+		}
+	}
+
+	if found {
+		return fmt.Errorf("the %s key %s doesn't match the known_hosts entry; this could mean someone is intercepting the connection",
+			key.Type(), SSHFingerprint(key))
+	}
+	return fmt.Errorf("no known_hosts entry for the %s key %s", key.Type(), SSHFingerprint(key))
+}
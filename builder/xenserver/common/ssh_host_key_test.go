@@ -0,0 +1,220 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func testHostKey(t *testing.T) gossh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	key, err := gossh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return key
+}
+
+func testRSAHostKey(t *testing.T) gossh.Signer {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return signer
+}
+
+func testKnownHostsFile(t *testing.T, lines ...string) string {
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tf.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	tf.Close()
+	return tf.Name()
+}
+
+func knownHostsLine(hosts string, key gossh.PublicKey) string {
+	return hosts + " " + strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+}
+
+func TestHostKeyCallback_Unverified(t *testing.T) {
+	callback, err := HostKeyCallback("", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := callback("10.0.0.1:22", nil, testHostKey(t)); err != nil {
+		t.Fatalf("expected any key to be accepted: %s", err)
+	}
+}
+
+func TestHostKeyCallback_KnownHosts(t *testing.T) {
+	key := testHostKey(t)
+	other := testHostKey(t)
+
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("10.0.0.3"))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	filename := testKnownHostsFile(t,
+		"# a comment",
+		knownHostsLine("10.0.0.1,xenserver", key),
+		knownHostsLine("[10.0.0.2]:2222", key),
+		knownHostsLine(hashed, key),
+		knownHostsLine("10.0.0.4", other),
+	)
+	defer os.Remove(filename)
+
+	callback, err := HostKeyCallback(filename, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, hostname := range []string{"10.0.0.1:22", "xenserver:22", "10.0.0.2:2222", "10.0.0.3:22"} {
+		if err := callback(hostname, nil, key); err != nil {
+			t.Fatalf("expected %s to be accepted: %s", hostname, err)
+		}
+	}
+
+	if err := callback("10.0.0.4:22", nil, key); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("expected a mismatch for a changed key, got %v", err)
+	}
+	if err := callback("10.0.0.2:22", nil, key); err == nil || !strings.Contains(err.Error(), "no known_hosts entry") {
+		t.Fatalf("expected an unknown host to be rejected, got %v", err)
+	}
+}
+
+func TestHostKeyCallback_Revoked(t *testing.T) {
+	key := testHostKey(t)
+	filename := testKnownHostsFile(t,
+		knownHostsLine("10.0.0.1", key),
+		"@revoked "+knownHostsLine("*", key),
+	)
+	defer os.Remove(filename)
+
+	callback, err := HostKeyCallback(filename, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := callback("10.0.0.1:22", nil, key); err == nil {
+		t.Fatal("expected a revoked key to be rejected")
+	}
+}
+
+func TestHostKeyCallback_Fingerprint(t *testing.T) {
+	key := testHostKey(t)
+
+	md5Fingerprint := sshMD5Fingerprint(key)
+	fingerprints := []string{
+		SSHFingerprint(key),
+		md5Fingerprint,
+		strings.ToUpper(md5Fingerprint[len("MD5:"):]),
+		strings.Replace(md5Fingerprint, ":", "", -1)[len("MD5"):],
+		"MD5:" + strings.Replace(md5Fingerprint[len("MD5:"):], ":", "", -1),
+	}
+	for _, fingerprint := range fingerprints {
+		callback, err := HostKeyCallback("", fingerprint)
+		if err != nil {
+			t.Fatalf("bad fingerprint %s: %s", fingerprint, err)
+		}
+		if err := callback("127.0.0.1:2222", nil, key); err != nil {
+			t.Fatalf("expected %s to match: %s", fingerprint, err)
+		}
+		if err := callback("127.0.0.1:2222", nil, testHostKey(t)); err == nil {
+			t.Fatalf("expected a different key not to match %s", fingerprint)
+		}
+	}
+
+	if _, err := HostKeyCallback("", "SHA256:nope"); err == nil {
+		t.Fatal("expected a malformed fingerprint to be rejected")
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	ecdsaKey := testHostKey(t)
+	rsaKey := testRSAHostKey(t).PublicKey()
+
+	filename := testKnownHostsFile(t,
+		knownHostsLine("10.0.0.1", rsaKey),
+		knownHostsLine("10.0.0.1,10.0.0.2", ecdsaKey),
+		knownHostsLine("10.0.0.1", testRSAHostKey(t).PublicKey()),
+		knownHostsLine("[10.0.0.3]:2222", rsaKey),
+		"@revoked "+knownHostsLine("10.0.0.3", ecdsaKey),
+	)
+	defer os.Remove(filename)
+
+	cases := []struct {
+		addr       string
+		algorithms []string
+	}{
+		{"10.0.0.1:22", []string{gossh.KeyAlgoRSA, gossh.KeyAlgoECDSA256}},
+		{"10.0.0.2:22", []string{gossh.KeyAlgoECDSA256}},
+		{"10.0.0.3:2222", []string{gossh.KeyAlgoRSA}},
+		{"10.0.0.3:22", nil},
+		{"10.0.0.4:22", nil},
+	}
+	for _, c := range cases {
+		algorithms, err := HostKeyAlgorithms(filename, c.addr)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(algorithms, c.algorithms) {
+			t.Errorf("%s: expected %v, got %v", c.addr, c.algorithms, algorithms)
+		}
+	}
+
+	if algorithms, err := HostKeyAlgorithms("", "10.0.0.1:22"); err != nil || algorithms != nil {
+		t.Fatalf("expected the defaults without known_hosts, got %v, %v", algorithms, err)
+	}
+}
+
+// A host with an ecdsa key as well as the rsa one in known_hosts is asked
+// for the rsa key, rather than offering the ecdsa key it prefers.
+func TestHostSSHClient_KnownHostKeyType(t *testing.T) {
+	rsaKey := testRSAHostKey(t)
+	server := newTestSSHServer(t, "secret", nil, rsaKey)
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.Addr())
+	filename := testKnownHostsFile(t, knownHostsLine("["+host+"]:"+port, rsaKey.PublicKey()))
+	defer os.Remove(filename)
+
+	config := CommonConfig{Username: "root", Password: "secret", RemoteSSHKnownHosts: filename}
+	sshConfig, _, err := HostSSHConfig(config)
+	if err != nil {
+		t.Fatalf("HostSSHConfig failed: %s", err)
+	}
+
+	client := NewHostSSHClient(server.Addr(), sshConfig)
+	_, err = doExecuteSSHCmd("echo hello", client)
+	client.Close()
+	if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("expected the ecdsa key to be offered and refused, got %v", err)
+	}
+
+	client = NewHostSSHClient(server.Addr(), sshConfig)
+	client.HostKeyAlgorithms = config.HostSSHKeyAlgorithms
+	defer client.Close()
+	if _, err := doExecuteSSHCmd("echo hello", client); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+}
@@ -0,0 +1,365 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testSSHServer is a minimal dom0 stand-in: it authenticates with either a
+// password or one authorized key, answers every exec request by echoing the
+// command back, and opens direct-tcpip tunnels.
+type testSSHServer struct {
+	listener net.Listener
+	config   *gossh.ServerConfig
+
+	mu        sync.Mutex
+	passwords int
+	conns     []*stallableConn
+}
+
+// stallableConn is a server side connection that can be made to swallow
+// everything it's sent, as a blackholed network would.
+type stallableConn struct {
+	net.Conn
+	stalled chan struct{}
+}
+
+func (c *stallableConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	select {
+	case <-c.stalled:
+		for err == nil {
+			_, err = c.Conn.Read(b)
+		}
+		return 0, err
+	default:
+	}
+	return n, err
+}
+
+func newTestSSHServer(t *testing.T, password string, authorized gossh.PublicKey, hostKeys ...gossh.Signer) *testSSHServer {
+	hostKey, err := gossh.NewSignerFromKey(testECDSAKey(t))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s := &testSSHServer{}
+	s.config = &gossh.ServerConfig{
+		PasswordCallback: func(conn gossh.ConnMetadata, pass []byte) (*gossh.Permissions, error) {
+			s.mu.Lock()
+			s.passwords++
+			s.mu.Unlock()
+			if password != "" && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("bad password")
+		},
+		PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if authorized != nil && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	s.config.AddHostKey(hostKey)
+	for _, key := range hostKeys {
+		s.config.AddHostKey(key)
+	}
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testSSHServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testSSHServer) Close() {
+	s.listener.Close()
+}
+
+// Passwords returns how many password attempts the server has seen.
+func (s *testSSHServer) Passwords() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.passwords
+}
+
+// Conns returns how many SSH connections the server has accepted.
+func (s *testSSHServer) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Stall stops the server answering on its current connections, without
+// closing them. New connections are answered as usual.
+func (s *testSSHServer) Stall() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		select {
+		case <-conn.stalled:
+		default:
+			close(conn.stalled)
+		}
+	}
+}
+
+// Drop closes every connection, as a restarting sshd would.
+func (s *testSSHServer) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSSHServer) handle(netConn net.Conn) {
+	conn := &stallableConn{Conn: netConn, stalled: make(chan struct{})}
+	_, chans, reqs, err := gossh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	go gossh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go s.tunnel(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(gossh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				gossh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+				channel.Write([]byte(payload.Command + "\n"))
+				channel.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+func (s *testSSHServer) tunnel(newChannel gossh.NewChannel) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	gossh.Unmarshal(newChannel.ExtraData(), &payload)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChannel.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go gossh.DiscardRequests(requests)
+
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
+	channel.Close()
+}
+
+func testECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return key
+}
+
+func testPrivateKeyFile(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pem.Encode(tf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	tf.Close()
+	return tf.Name()
+}
+
+func testHostSSHCmd(t *testing.T, server *testSSHServer, config CommonConfig) (string, error) {
+	sshConfig, sshAgent, err := HostSSHConfig(config)
+	if err != nil {
+		t.Fatalf("HostSSHConfig failed: %s", err)
+	}
+	client := NewHostSSHClient(server.Addr(), sshConfig)
+	client.Agent = sshAgent
+	defer client.Close()
+	return doExecuteSSHCmd("echo hello", client)
+}
+
+func TestHostSSHConfig_Password(t *testing.T) {
+	server := newTestSSHServer(t, "secret", nil)
+	defer server.Close()
+
+	out, err := testHostSSHCmd(t, server, CommonConfig{Username: "root", Password: "secret"})
+	if err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+	if out != "echo hello" {
+		t.Fatalf("bad output: %q", out)
+	}
+}
+
+func TestHostSSHConfig_PrivateKey(t *testing.T) {
+	key := testECDSAKey(t)
+	public, _ := gossh.NewPublicKey(&key.PublicKey)
+	server := newTestSSHServer(t, "secret", public)
+	defer server.Close()
+
+	keyFile := testPrivateKeyFile(t, key)
+	defer os.Remove(keyFile)
+
+	config := CommonConfig{
+		Username:                "root",
+		Password:                "secret",
+		RemoteSSHUsername:       "packer",
+		RemoteSSHPrivateKeyFile: keyFile,
+	}
+	if _, err := testHostSSHCmd(t, server, config); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+	if server.Passwords() != 0 {
+		t.Fatal("the XAPI password shouldn't be offered when a key is configured")
+	}
+
+	sshConfig, _, _ := HostSSHConfig(config)
+	if sshConfig.User != "packer" {
+		t.Fatalf("expected remote_ssh_username to be used, got %s", sshConfig.User)
+	}
+}
+
+func TestHostSSHConfig_Agent(t *testing.T) {
+	key := testECDSAKey(t)
+	public, _ := gossh.NewPublicKey(&key.PublicKey)
+	server := newTestSSHServer(t, "", public)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "test"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	accepted := make(chan struct{}, 10)
+	closed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	oldSocket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	defer os.Setenv("SSH_AUTH_SOCK", oldSocket)
+
+	config := CommonConfig{Username: "root", Password: "secret", RemoteSSHAgentAuth: true}
+	sshConfig, sshAgent, err := HostSSHConfig(config)
+	if err != nil {
+		t.Fatalf("HostSSHConfig failed: %s", err)
+	}
+	client := NewHostSSHClient(server.Addr(), sshConfig)
+	client.Agent = sshAgent
+
+	if _, err := doExecuteSSHCmd("echo hello", client); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+
+	// Redialling dom0 uses the same agent connection
+	server.Drop()
+	if _, err := doExecuteSSHCmd("echo hello", client); err != nil {
+		t.Fatalf("command failed: %s", err)
+	}
+	if server.Conns() != 2 || len(accepted) != 1 {
+		t.Fatalf("expected 2 SSH connections over 1 agent connection, got %d and %d", server.Conns(), len(accepted))
+	}
+
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the agent connection should be closed along with the client")
+	}
+}
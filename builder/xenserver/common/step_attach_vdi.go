@@ -4,20 +4,19 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
 	"log"
 )
 
 type StepAttachVdi struct {
 	VdiUuidKey string
-	VdiType    xsclient.VDIType
+	VdiType    VDIType
 
-	vdi *xsclient.VDI
+	vdi string
 }
 
 func (self *StepAttachVdi) Run(state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 
 	var vdiUuid string
 	if vdiUuidRaw, ok := state.GetOk(self.VdiUuidKey); ok {
@@ -41,7 +40,7 @@ func (self *StepAttachVdi) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
-	err = instance.ConnectVdi(self.vdi, self.VdiType, "")
+	err = client.ConnectVdi(instance, self.vdi, self.VdiType, "")
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error attaching VDI '%s': '%s'", vdiUuid, err.Error()))
 		return multistep.ActionHalt
@@ -54,12 +53,12 @@ func (self *StepAttachVdi) Run(state multistep.StateBag) multistep.StepAction {
 
 func (self *StepAttachVdi) Cleanup(state multistep.StateBag) {
 	config := state.Get("commonconfig").(CommonConfig)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	if config.ShouldKeepVM(state) {
 		return
 	}
 
-	if self.vdi == nil {
+	if self.vdi == "" {
 		return
 	}
 
@@ -72,7 +71,7 @@ func (self *StepAttachVdi) Cleanup(state multistep.StateBag) {
 
 	vdiUuid := state.Get(self.VdiUuidKey).(string)
 
-	err = instance.DisconnectVdi(self.vdi)
+	err = client.DisconnectVdi(instance, self.vdi)
 	if err != nil {
 		log.Printf("Unable to disconnect VDI '%s': %s", vdiUuid, err.Error())
 		return
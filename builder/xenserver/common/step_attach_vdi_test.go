@@ -0,0 +1,57 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+func TestStepAttachVdi(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	vm := server.Create("VM", map[string]interface{}{"name_label": "packer-test"})
+	state.Put("instance_uuid", server.Record(vm)["uuid"])
+	state.Put("tools_vdi_uuid", server.Record(server.ToolsVDIRef)["uuid"])
+
+	step := &StepAttachVdi{
+		VdiUuidKey: "tools_vdi_uuid",
+		VdiType:    CD,
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vbds := server.Record(vm)["VBDs"].([]string)
+	if len(vbds) != 1 {
+		t.Fatalf("expected one VBD, got %v", vbds)
+	}
+	if vbd := server.Record(vbds[0]); vbd["VDI"] != server.ToolsVDIRef || vbd["type"] != "CD" {
+		t.Fatalf("bad VBD: %#v", vbd)
+	}
+
+	step.Cleanup(state)
+	if vbds := server.Record(vm)["VBDs"].([]string); len(vbds) != 0 {
+		t.Fatalf("expected cleanup to remove the VBD, got %v", vbds)
+	}
+}
+
+func TestStepAttachVdi_Skipped(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	step := &StepAttachVdi{VdiUuidKey: "tools_vdi_uuid"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+
+	for _, call := range server.Calls() {
+		if call != "session.login_with_password" {
+			t.Fatalf("unexpected XAPI call: %s", call)
+		}
+	}
+}
@@ -5,31 +5,30 @@ import (
 	"strings"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type StepBootWait struct{}
 
 func (self *StepBootWait) Run(state multistep.StateBag) multistep.StepAction {
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
 
 	instance, _ := client.GetVMByUuid(state.Get("instance_uuid").(string))
 	
-	powerState, _ := instance.GetPowerState()
+	powerState, _ := client.GetVMPowerState(instance)
 	switch strings.ToLower(powerState) {
 		case "halted":
 			ui.Say("Starting VM " + state.Get("instance_uuid").(string))
-			instance.Start(false, false)
+			client.StartVM(instance, false, false)
 
 		case "paused":
 			ui.Say("Unpaused VM " + state.Get("instance_uuid").(string))
-			instance.Unpause()
+			client.UnpauseVM(instance)
 		
 		case "suspended":
 			ui.Say("Resuming VM " + state.Get("instance_uuid").(string))
-			instance.Resume(false, false)	
+			client.ResumeVM(instance, false, false)	
 
 /*		case "running":
 			ui.Error("VM " + state.Get("instance_uuid").(string) + " is already running")
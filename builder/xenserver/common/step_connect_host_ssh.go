@@ -0,0 +1,35 @@
+package common
+
+import (
+	"fmt"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"net"
+)
+
+// StepConnectHostSSH sets up the shared SSH connection to dom0. Nothing is
+// dialled until a later step first needs it.
+type StepConnectHostSSH struct{}
+
+func (self *StepConnectHostSSH) Run(state multistep.StateBag) multistep.StepAction {
+	config := state.Get("commonconfig").(CommonConfig)
+	ui := state.Get("ui").(packer.Ui)
+
+	sshConfig, sshAgent, err := HostSSHConfig(config)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error configuring the connection to the host: %s", err))
+		return multistep.ActionHalt
+	}
+
+	client := NewHostSSHClient(net.JoinHostPort(config.HostIp, "22"), sshConfig)
+	client.HostKeyAlgorithms = config.HostSSHKeyAlgorithms
+	client.Agent = sshAgent
+	state.Put("host_ssh", client)
+	return multistep.ActionContinue
+}
+
+func (self *StepConnectHostSSH) Cleanup(state multistep.StateBag) {
+	if client, ok := state.GetOk("host_ssh"); ok {
+		client.(*HostSSHClient).Close()
+	}
+}
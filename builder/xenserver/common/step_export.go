@@ -1,93 +1,43 @@
 package common
 
 import (
-	"crypto/tls"
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
 	"io"
-	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type StepExport struct {
 	OutputFormat string
-}
-
-func downloadFile(url, filename string, ui packer.Ui) (err error) {
-
-	// Create the file
-	fh, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-
-	// Define a new transport which allows self-signed certs
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	// Create a client
-	client := &http.Client{Transport: tr}
-
-	// Create request and download file
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	var progress uint
-	var total uint
-	var percentage uint
-	var marker_len uint
-
-	progress = uint(0)
-	total = uint(resp.ContentLength)
-	percentage = uint(0)
-	marker_len = uint(5)
-
-	var buffer [4096]byte
-	for {
-		n, err := resp.Body.Read(buffer[:])
-		if err != nil && err != io.EOF {
-			return err
-		}
-
-		progress += uint(n)
-
-		if _, write_err := fh.Write(buffer[:n]); write_err != nil {
-			return write_err
-		}
-
-		if err == io.EOF {
-			break
-		}
-
-		// Increment percentage in multiples of marker_len
-		cur_percentage := ((progress * 100 / total) / marker_len) * marker_len
-		if cur_percentage > percentage {
-			percentage = cur_percentage
-			ui.Message(fmt.Sprintf("Downloading... %d%%", percentage))
-		}
-
-	}
 
-	return nil
+	// The VM's hardware as configured, for the ova descriptor. Anything
+	// left unset is read back from the VM.
+	VMMemory uint
+	VMVCpus  uint
+	VMDisks  [][]string
 }
 
 func (self *StepExport) Run(state multistep.StateBag) multistep.StepAction {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	instance_uuid := state.Get("instance_uuid").(string)
 	suffix := ".vhd"
-	extrauri := "&format=vhd"
+	format := "vhd"
 
 	exportFiles := make([]string, 0, 1) 
+	checksums := make(map[string]string)
+	// Sizes are strings, like the rest of the artifact's state, so that
+	// they survive being passed to post-processor plugins
+	sizes := make(map[string]string)
+	allocatedSizes := make(map[string]string)
+	virtualSizes := make(map[string]string)
+	parents := make(map[string]string)
+	compressionSuffix := compressionSuffixes[config.ExportCompression]
 
 	instance, err := client.GetVMByUuid(instance_uuid)
 	if err != nil {
@@ -107,21 +57,33 @@ func (self *StepExport) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionContinue
 
 	case "vhd":
+		if config.VHDExport == "http" {
+			files, err := exportDisks(state, instance, format, "", checksums, sizes, parents, func(i int, disk_uuid string) string {
+				return fmt.Sprintf("%s/%s.%d.vhd", config.OutputDir, config.VMName, i)
+			})
+			if err != nil {
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+			exportFiles = append(exportFiles, files...)
+			break
+		}
 
-		disks, err := instance.GetDisks()
+		// Copy the VHDs off the SR's NFS export, mounted by StepPrepareNfsExport
+		disks, err := client.GetVMDisks(instance)
 		if err != nil {
 			ui.Error(fmt.Sprintf("Could not get VM disks: %s", err.Error()))
 			return multistep.ActionHalt
 		}
 
 		for i, disk := range disks {
-			disk_uuid, err := disk.GetUuid()
+			disk_uuid, err := client.GetVdiUuid(disk)
 			if err != nil {
 				ui.Error(fmt.Sprintf("Could not get disk %d with UUID '%s': %s", i, disk_uuid, err.Error()))
 				return multistep.ActionHalt
 			}
 
-			export_filename := fmt.Sprintf("%s/%s.%d.vhd", config.OutputDir, config.VMName, i)
+			export_filename := fmt.Sprintf("%s/%s.%d.vhd%s", config.OutputDir, config.VMName, i, compressionSuffix)
 			source_filename := fmt.Sprintf("%s/nfs/%s/%s.vhd", config.OutputDir, state.Get("instance_sr_uuid").(string), disk_uuid)
 
 			ui.Say("Getting VHD " + source_filename)
@@ -139,13 +101,27 @@ func (self *StepExport) Run(state multistep.StateBag) multistep.StepAction {
 				ui.Error(fmt.Sprintf("Could not create destination VHD: %s", err.Error()))
 				return multistep.ActionHalt
 			}
-			if _, err := io.Copy(dst, src); err != nil {
+			sink, err := newFileSink(dst, config.ExportCompression, false)
+			if err != nil {
+				dst.Close()
+				ui.Error(fmt.Sprintf("Could not compress VHD: %s", err.Error()))
+				return multistep.ActionHalt
+			}
+			size, err := io.Copy(sink, src)
+			if err == nil {
+				err = sink.Close()
+			}
+			if err != nil {
 				dst.Close()
 				ui.Error(fmt.Sprintf("Error copying VHD: %s", err.Error()))
 				return multistep.ActionHalt
 			}
 
 			exportFiles = append(exportFiles , export_filename)
+			checksums[export_filename] = sink.checksum()
+			if compressionSuffix != "" {
+				sizes[export_filename] = strconv.FormatInt(size, 10)
+			}
 		
 			dst.Close()
 		}
@@ -153,110 +129,290 @@ func (self *StepExport) Run(state multistep.StateBag) multistep.StepAction {
 	case "xva":
 		// export the VM
 
-		export_url := fmt.Sprintf("https://%s/export?uuid=%s&session_id=%s",
-			client.Host,
-			instance_uuid,
-			client.Session.(string),
-		)
+		export_url := client.ExportURL(instance_uuid)
 
-		export_filename := fmt.Sprintf("%s/%s.xva", config.OutputDir, config.VMName)
+		export_filename := fmt.Sprintf("%s/%s.xva%s", config.OutputDir, config.VMName, compressionSuffix)
 
 		ui.Say("Getting XVA " + export_url)
-		err = downloadFile(export_url, export_filename, ui)
+		ctx, cancel := cancelOnInterrupt(state)
+		checksum, size, err := downloadFile(ctx, client.HTTPClient(), export_url, export_filename, config.ExportCompression, false, newExportProgress(ui, 1), 0)
+		cancel()
 		if err != nil {
 			ui.Error(fmt.Sprintf("Could not download XVA: %s", err.Error()))
 			return multistep.ActionHalt
 		}
 
 		exportFiles = append(exportFiles , export_filename)
+		checksums[export_filename] = checksum
+		if compressionSuffix != "" {
+			sizes[export_filename] = strconv.FormatInt(size, 10)
+		}
 
 	case "vdi_raw":
 		suffix = ".raw"
-		extrauri = ""
+		format = ""
 		fallthrough
 	case "vdi_vhd":
-		// export the disks
-
-		disks, err := instance.GetDisks()
+		// export the disks, named by their UUIDs
+		files, err := exportDisks(state, instance, format, "", checksums, sizes, parents, func(i int, disk_uuid string) string {
+			return fmt.Sprintf("%s/%s%s", config.OutputDir, disk_uuid, suffix)
+		})
 		if err != nil {
-			ui.Error(fmt.Sprintf("Could not get VM disks: %s", err.Error()))
+			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
-		for _, disk := range disks {
-			disk_uuid, err := disk.GetUuid()
-			if err != nil {
-				ui.Error(fmt.Sprintf("Could not get disk with UUID '%s': %s", disk_uuid, err.Error()))
-				return multistep.ActionHalt
-			}
+		exportFiles = append(exportFiles, files...)
 
-			// Work out XenServer version
-			hosts, err := client.GetHosts()
+		if format == "" && compressionSuffix == "" {
+			// Raw disks are sparse, so say how much space they really take
+			for _, file := range files {
+				info, err := os.Stat(file)
+				if err != nil {
+					ui.Error(fmt.Sprintf("Could not stat %s: %s", file, err.Error()))
+					return multistep.ActionHalt
+				}
+				allocated, err := allocatedSize(info)
+				if err != nil {
+					ui.Error(fmt.Sprintf("Could not get the allocated size of %s: %s", file, err.Error()))
+					return multistep.ActionHalt
+				}
 
-			if err != nil {
-				ui.Error(fmt.Sprintf("Could not retrieve hosts in the pool: %s", err.Error()))
-				return multistep.ActionHalt
+				ui.Message(fmt.Sprintf("%s: %d MB allocated of %d MB", file, allocated/(1024*1024), info.Size()/(1024*1024)))
+				allocatedSizes[file] = strconv.FormatInt(allocated, 10)
+				virtualSizes[file] = strconv.FormatInt(info.Size(), 10)
 			}
-			host := hosts[0]
-			host_software_versions, err := host.GetSoftwareVersion()
-			xs_version := host_software_versions["product_version"].(string)
+		}
 
-			if err != nil {
-				ui.Error(fmt.Sprintf("Could not get the software version: %s", err.Error()))
-				return multistep.ActionHalt
-			}
+	case "qcow2", "vmdk":
+		// export the raw disks, converting them as they arrive
+		files, err := exportDisks(state, instance, "", self.OutputFormat, checksums, sizes, parents, func(i int, disk_uuid string) string {
+			return fmt.Sprintf("%s/%s.%d.%s", config.OutputDir, config.VMName, i, self.OutputFormat)
+		})
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		exportFiles = append(exportFiles, files...)
+
+	case "ova":
+		// export the disks as VMDKs, then package them with a description
+		// of the VM
+		disk_files, err := exportDisks(state, instance, "", "vmdk-stream", checksums, sizes, parents, func(i int, disk_uuid string) string {
+			return fmt.Sprintf("%s/%s-disk%d.vmdk", config.OutputDir, config.VMName, i)
+		})
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
 
-			var disk_export_url string
+		ova_filename := fmt.Sprintf("%s/%s.ova", config.OutputDir, config.VMName)
+		ui.Say("Packaging " + ova_filename)
 
-			// @todo: check for 6.5 SP1
-			if xs_version <= "6.5.0" && config.Format == "vdi_vhd" {
-				// Export the VHD using a Transfer VM
+		vm, err := self.describeVM(state, instance, disk_files)
+		var checksum string
+		if err == nil {
+			checksum, err = writeOVA(ova_filename, vm, disk_files, checksums)
+		}
+		for _, disk_file := range disk_files {
+			os.Remove(disk_file)
+			delete(checksums, disk_file)
+		}
+		if err != nil {
+			ui.Error(fmt.Sprintf("Could not package the ova: %s", err.Error()))
+			return multistep.ActionHalt
+		}
 
-				disk_export_url, err = disk.Expose("vhd")
+		exportFiles = append(exportFiles, ova_filename)
+		checksums[ova_filename] = checksum
 
-				if err != nil {
-					ui.Error(fmt.Sprintf("Failed to expose disk %s: %s", disk_uuid, err.Error()))
-					return multistep.ActionHalt
-				}
+	default:
+		panic(fmt.Sprintf("Unknown export format '%s'", self.OutputFormat ))
+	}
 
-			} else {
+	state.Put("export_files", exportFiles)
+	state.Put("export_checksums", checksums)
+	state.Put("export_sizes", sizes)
+	state.Put("export_allocated_sizes", allocatedSizes)
+	state.Put("export_virtual_sizes", virtualSizes)
+	state.Put("export_parents", parents)
 
-				// Use the preferred direct export from XAPI
-				// Basic auth in URL request is required as session token is not
-				// accepted for some reason.
-				// @todo: raise with XAPI team.
-				disk_export_url = fmt.Sprintf("https://%s:%s@%s/export_raw_vdi?vdi=%s%s",
-					client.Username,
-					client.Password,
-					client.Host,
-					disk_uuid,
-					extrauri)
+	ui.Say("Download completed: " + config.OutputDir)
 
-			}
+	return multistep.ActionContinue
+}
+
+// exportDisks downloads the VM's disks over HTTP in the given format, ""
+// for raw, to the files named by filename. If container is set the raw
+// disks are converted to that image format on the way, otherwise they're
+// compressed as export_compression says, which adds its extension to the
+// names and records their uncompressed sizes. Uncompressed raw disks are
+// written as sparse files. If base_vdi_uuid is in the state the first disk
+// is exported as a differencing VHD against it, and parents records the
+// file's parent chain: that VDI's UUID followed by those of the VHDs beneath
+// it, comma separated. Up to export_concurrency disks
+// are downloaded at once, and they're all cancelled if one fails or the
+// build is interrupted. Only the downloads run concurrently, as the XAPI
+// client can't be shared between goroutines.
+func exportDisks(state multistep.StateBag, instance, format, container string, checksums map[string]string, sizes map[string]string, parents map[string]string, filename func(i int, disk_uuid string) string) ([]string, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	ui := state.Get("ui").(packer.Ui)
+	client := state.Get("client").(Hypervisor)
+
+	disks, err := client.GetVMDisks(instance)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get VM disks: %s", err.Error())
+	}
+
+	// Work out XenServer version
+	hosts, err := client.GetHosts()
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve hosts in the pool: %s", err.Error())
+	}
+	host_software_versions, err := client.GetHostSoftwareVersion(hosts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the software version: %s", err.Error())
+	}
+	xs_version := host_software_versions["product_version"].(string)
+
+	base_uuid := ""
+	var base_chain []string
+	if value, ok := state.GetOk("base_vdi_uuid"); ok && format == "vhd" {
+		base_uuid = value.(string)
+		if xs_version <= "6.5.0" {
+			return nil, fmt.Errorf("Exporting a differencing VHD needs a XenServer release later than 6.5")
+		}
+		base_chain, err = vdiParentChain(client, base_uuid)
+		if err != nil {
+			return nil, fmt.Errorf("Could not find the base VDI's parents: %s", err.Error())
+		}
+	}
 
+	// Call unexpose in case a TVM was used. The call is harmless
+	// if that is not the case.
+	defer func() {
+		for _, disk := range disks {
+			client.UnexposeVdi(disk)
+		}
+	}()
 
-			disk_export_filename := fmt.Sprintf("%s/%s%s", config.OutputDir, disk_uuid, suffix)
+	urls := make([]string, len(disks))
+	files := make([]string, len(disks))
+	for i, disk := range disks {
+		disk_uuid, err := client.GetVdiUuid(disk)
+		if err != nil {
+			return nil, fmt.Errorf("Could not get disk with UUID '%s': %s", disk_uuid, err.Error())
+		}
 
-			ui.Say("Getting VDI " + disk_export_url)
-			err = downloadFile(disk_export_url, disk_export_filename, ui)
+		// @todo: check for 6.5 SP1
+		if xs_version <= "6.5.0" && format == "vhd" {
+			// Export the VHD using a Transfer VM
+			urls[i], err = client.ExposeVdi(disk, "vhd")
 			if err != nil {
-				ui.Error(fmt.Sprintf("Could not download VDI: %s", err.Error()))
-				return multistep.ActionHalt
+				return nil, fmt.Errorf("Failed to expose disk %s: %s", disk_uuid, err.Error())
 			}
+		} else if i == 0 && base_uuid != "" {
+			// Only export the changes to the base image
+			urls[i] = client.ExportDifferencingVdiURL(disk_uuid, base_uuid)
+		} else {
+			// Use the preferred direct export from XAPI
+			urls[i] = client.ExportRawVdiURL(disk_uuid, format)
+		}
 
-			// Call unexpose in case a TVM was used. The call is harmless
-			// if that is not the case.
-			disk.Unexpose()
+		files[i] = filename(i, disk_uuid)
+		if container == "" {
+			files[i] += compressionSuffixes[config.ExportCompression]
 		}
+	}
 
-	default:
-		panic(fmt.Sprintf("Unknown export format '%s'", self.OutputFormat ))
+	ctx, cancel := cancelOnInterrupt(state)
+	defer cancel()
+
+	progress := newExportProgress(ui, len(disks))
+	sparse := format == "" && container == "" && compressionSuffixes[config.ExportCompression] == ""
+	sums := make([]string, len(disks))
+	rawSizes := make([]int64, len(disks))
+	slots := make(chan struct{}, config.ExportConcurrency)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for i := range disks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			ui.Say("Getting VDI " + files[i])
+			var sum string
+			var err error
+			if container == "" {
+				sum, rawSizes[i], err = downloadFile(ctx, client.HTTPClient(), urls[i], files[i], config.ExportCompression, sparse, progress, i)
+			} else {
+				sum, err = convertDownload(ctx, client.HTTPClient(), urls[i], files[i], container, progress, i)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("Could not download VDI %s: %s", files[i], err.Error())
+				}
+				mu.Unlock()
+				cancel()
+				return
+			}
+			sums[i] = sum
+		}(i)
 	}
+	wg.Wait()
 
-	state.Put("export_files", exportFiles)
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		return nil, InterruptedError{}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
 
-	ui.Say("Download completed: " + config.OutputDir)
+	for i, file := range files {
+		checksums[file] = sums[i]
+		if i == 0 && base_uuid != "" {
+			parents[file] = strings.Join(base_chain, ",")
+		}
+		if container == "" && compressionSuffixes[config.ExportCompression] != "" {
+			sizes[file] = strconv.FormatInt(rawSizes[i], 10)
+		}
+	}
+	return files, nil
+}
 
-	return multistep.ActionContinue
+// vdiParentChain returns the UUID of the VDI and of each VHD beneath it, as
+// sm_config's vhd-parent links them, nearest first.
+func vdiParentChain(client Hypervisor, uuid string) ([]string, error) {
+	var chain []string
+	seen := make(map[string]bool)
+	for uuid != "" && !seen[uuid] {
+		seen[uuid] = true
+		chain = append(chain, uuid)
+
+		vdi, err := client.GetVdiByUuid(uuid)
+		if err != nil {
+			return nil, err
+		}
+		smConfig, err := client.GetVdiSMConfig(vdi)
+		if err != nil {
+			return nil, err
+		}
+		uuid = smConfig["vhd-parent"]
+	}
+	return chain, nil
 }
 
 func (StepExport) Cleanup(state multistep.StateBag) {}
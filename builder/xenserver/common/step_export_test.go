@@ -0,0 +1,332 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+func TestStepExport_VHDOverHTTP(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	state.Put("commonconfig", CommonConfig{KeepVM: "never", OutputDir: dir, VMName: "packer-test", Format: "vhd", VHDExport: "http", ExportConcurrency: 2})
+
+	vm := server.Create("VM", map[string]interface{}{"name_label": "packer-test"})
+	state.Put("instance_uuid", server.Record(vm)["uuid"])
+
+	contents := [][]byte{[]byte("first disk"), []byte("second disk"), []byte("third disk")}
+	for i, content := range contents {
+		disk := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef})
+		server.SetContent(disk, content)
+		server.Create("VBD", map[string]interface{}{
+			"VM":         vm,
+			"VDI":        disk,
+			"userdevice": string('0' + byte(i)),
+			"type":       "Disk",
+		})
+	}
+
+	step := new(StepExport)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	files := state.Get("export_files").([]string)
+	checksums := state.Get("export_checksums").(map[string]string)
+	if len(files) != len(contents) {
+		t.Fatalf("expected %d files, got %v", len(contents), files)
+	}
+	for i, content := range contents {
+		filename := filepath.Join(dir, "packer-test."+string('0'+byte(i))+".vhd")
+		if files[i] != filename {
+			t.Fatalf("expected %s, got %s", filename, files[i])
+		}
+		written, err := ioutil.ReadFile(filename)
+		if err != nil || !bytes.Equal(written, content) {
+			t.Fatalf("bad export of disk %d: %q %v", i, written, err)
+		}
+		sum := sha256.Sum256(content)
+		if checksums[filename] != hex.EncodeToString(sum[:]) {
+			t.Fatalf("bad checksum for disk %d: %s", i, checksums[filename])
+		}
+	}
+}
+
+func TestStepExport_Differencing(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	state.Put("commonconfig", CommonConfig{KeepVM: "never", OutputDir: dir, VMName: "packer-test", Format: "vhd", VHDExport: "http", ExportConcurrency: 1})
+
+	vm := server.Create("VM", map[string]interface{}{"name_label": "packer-test"})
+	state.Put("instance_uuid", server.Record(vm)["uuid"])
+
+	// The base VDI sits on a coalesced base copy, and the copy on its own
+	// parent
+	root := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef, "name_label": "base copy"})
+	rootUuid := server.Record(root)["uuid"].(string)
+	copied := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef, "name_label": "base copy",
+		"sm_config": map[string]interface{}{"vhd-parent": rootUuid}})
+	copiedUuid := server.Record(copied)["uuid"].(string)
+	base := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef, "name_label": "golden",
+		"sm_config": map[string]interface{}{"vhd-parent": copiedUuid}})
+	server.SetContent(base, []byte("golden image"))
+	baseUuid := server.Record(base)["uuid"].(string)
+	state.Put("base_vdi_uuid", baseUuid)
+
+	// Only the system disk is exported against the base
+	contents := [][]byte{[]byte("golden IMAGE"), []byte("data disk")}
+	for i, content := range contents {
+		disk := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef})
+		server.SetContent(disk, content)
+		server.Create("VBD", map[string]interface{}{"VM": vm, "VDI": disk, "userdevice": string('0' + byte(i)), "type": "Disk"})
+	}
+
+	step := new(StepExport)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	expected := [][]byte{[]byte("\x00\x00\x00\x00\x00\x00\x00IMAGE"), contents[1]}
+	for i := range expected {
+		filename := filepath.Join(dir, "packer-test."+string('0'+byte(i))+".vhd")
+		written, err := ioutil.ReadFile(filename)
+		if err != nil || !bytes.Equal(written, expected[i]) {
+			t.Fatalf("bad export of disk %d: %q %v", i, written, err)
+		}
+	}
+
+	parents := state.Get("export_parents").(map[string]string)
+	chain := baseUuid + "," + copiedUuid + "," + rootUuid
+	if len(parents) != 1 || parents[filepath.Join(dir, "packer-test.0.vhd")] != chain {
+		t.Fatalf("bad parents: %v", parents)
+	}
+}
+
+func TestStepExport_SparseRaw(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	state.Put("commonconfig", CommonConfig{KeepVM: "never", OutputDir: dir, VMName: "packer-test", Format: "vdi_raw", ExportConcurrency: 1})
+
+	vm := server.Create("VM", map[string]interface{}{"name_label": "packer-test"})
+	state.Put("instance_uuid", server.Record(vm)["uuid"])
+
+	// Mostly zeros, including the end of the disk
+	content := make([]byte, 8*1024*1024)
+	copy(content, "boot sector")
+	copy(content[5*1024*1024-3:], "straddles two blocks")
+	disk := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef})
+	server.SetContent(disk, content)
+	server.Create("VBD", map[string]interface{}{"VM": vm, "VDI": disk, "userdevice": "0", "type": "Disk"})
+
+	step := new(StepExport)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	filename := filepath.Join(dir, server.Record(disk)["uuid"].(string)+".raw")
+	written, err := ioutil.ReadFile(filename)
+	if err != nil || !bytes.Equal(written, content) {
+		t.Fatalf("bad export: %d bytes, %v", len(written), err)
+	}
+	sum := sha256.Sum256(content)
+	if state.Get("export_checksums").(map[string]string)[filename] != hex.EncodeToString(sum[:]) {
+		t.Fatal("the checksum should be of the whole disk")
+	}
+
+	virtual := state.Get("export_virtual_sizes").(map[string]string)[filename]
+	if virtual != fmt.Sprintf("%d", len(content)) {
+		t.Fatalf("bad virtual size: %s", virtual)
+	}
+	allocated, _ := strconv.ParseInt(state.Get("export_allocated_sizes").(map[string]string)[filename], 10, 64)
+	if allocated <= 0 || allocated >= int64(len(content)) {
+		t.Fatalf("the export should be a sparse file, %d bytes are allocated", allocated)
+	}
+}
+
+func TestStepExport_Convert(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	state.Put("commonconfig", CommonConfig{KeepVM: "never", OutputDir: dir, VMName: "packer-test", Format: "qcow2", ExportConcurrency: 1})
+
+	vm := server.Create("VM", map[string]interface{}{"name_label": "packer-test"})
+	state.Put("instance_uuid", server.Record(vm)["uuid"])
+	disk := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef})
+	server.SetContent(disk, append(make([]byte, 1<<20), []byte("data after a gap")...))
+	server.Create("VBD", map[string]interface{}{"VM": vm, "VDI": disk, "userdevice": "0", "type": "Disk"})
+
+	step := new(StepExport)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	filename := filepath.Join(dir, "packer-test.0.qcow2")
+	if files := state.Get("export_files").([]string); len(files) != 1 || files[0] != filename {
+		t.Fatalf("bad export files: %v", files)
+	}
+	written, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.HasPrefix(written, []byte("QFI\xfb")) {
+		t.Fatalf("expected a qcow2 image")
+	}
+	// The header, one data cluster, an L2 table, the L1 table, a refcount
+	// block and the refcount table
+	if len(written) != 6*qcow2ClusterSize {
+		t.Fatalf("expected the empty clusters to be left out, got %d bytes", len(written))
+	}
+	sum := sha256.Sum256(written)
+	if checksum := state.Get("export_checksums").(map[string]string)[filename]; checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("the checksum should be of the qcow2 image, got %s", checksum)
+	}
+}
+
+func TestStepExport_OVA(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	state.Put("commonconfig", CommonConfig{KeepVM: "never", OutputDir: dir, VMName: "packer-test", Format: "ova", ExportConcurrency: 1})
+
+	vm := server.Create("VM", map[string]interface{}{
+		"name_label":        "packer-test",
+		"memory_static_max": "2147483648",
+		"VCPUs_max":         "2",
+	})
+	state.Put("instance_uuid", server.Record(vm)["uuid"])
+	disk := server.Create("VDI", map[string]interface{}{"SR": server.LocalSRRef, "name_label": "root & boot", "virtual_size": "10737418240"})
+	server.SetContent(disk, []byte("a very small disk"))
+	server.Create("VBD", map[string]interface{}{"VM": vm, "VDI": disk, "userdevice": "0", "type": "Disk"})
+	server.Create("VIF", map[string]interface{}{"VM": vm, "network": server.ManagementNetworkRef, "device": "0"})
+
+	// Memory comes from the builder's configuration, the rest from the VM
+	step := &StepExport{VMMemory: 1024}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	filename := filepath.Join(dir, "packer-test.ova")
+	if files := state.Get("export_files").([]string); len(files) != 1 || files[0] != filename {
+		t.Fatalf("bad export files: %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "packer-test-disk0.vmdk")); !os.IsNotExist(err) {
+		t.Fatal("the VMDK should only be left in the ova")
+	}
+
+	fh, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+
+	contents := make(map[string][]byte)
+	var names []string
+	tr := tar.NewReader(fh)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		names = append(names, header.Name)
+		contents[header.Name], _ = ioutil.ReadAll(tr)
+	}
+	if strings.Join(names, " ") != "packer-test.ovf packer-test.mf packer-test-disk0.vmdk" {
+		t.Fatalf("bad ova contents: %v", names)
+	}
+
+	ovf := contents["packer-test.ovf"]
+	if err := xml.Unmarshal(ovf, new(interface{})); err != nil {
+		t.Fatalf("the OVF descriptor isn't valid XML: %s", err)
+	}
+	for _, expected := range []string{
+		`ovf:capacity="10737418240"`,
+		`<rasd:VirtualQuantity>2</rasd:VirtualQuantity>`,
+		`<rasd:VirtualQuantity>1024</rasd:VirtualQuantity>`,
+		`<rasd:ElementName>root &amp; boot</rasd:ElementName>`,
+		`<rasd:Connection>Pool-wide network associated with eth0</rasd:Connection>`,
+	} {
+		if !strings.Contains(string(ovf), expected) {
+			t.Fatalf("expected %s in the OVF descriptor:\n%s", expected, ovf)
+		}
+	}
+
+	for name, data := range contents {
+		if name == "packer-test.mf" {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		line := fmt.Sprintf("SHA256(%s)= %s\n", name, hex.EncodeToString(sum[:]))
+		if !strings.Contains(string(contents["packer-test.mf"]), line) {
+			t.Fatalf("expected %q in the manifest:\n%s", line, contents["packer-test.mf"])
+		}
+	}
+}
+
+func TestOVAHeader(t *testing.T) {
+	for _, size := range []int64{17, 8<<30 - 1, 8 << 30, 100 << 30} {
+		var buf bytes.Buffer
+		if err := tar.NewWriter(&buf).WriteHeader(ovaHeader("disk.vmdk", size)); err != nil {
+			t.Fatalf("unable to write the header of a %d byte disk: %s", size, err)
+		}
+
+		header, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if header.Size != size {
+			t.Fatalf("expected a size of %d, got %d", size, header.Size)
+		}
+		if size < 8<<30 && header.Format != tar.FormatUSTAR {
+			t.Fatalf("expected a %d byte disk to be written as USTAR, got %v", size, header.Format)
+		}
+	}
+}
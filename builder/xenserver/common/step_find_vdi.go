@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type StepFindVdi struct {
@@ -15,7 +14,7 @@ type StepFindVdi struct {
 
 func (self *StepFindVdi) Run(state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 
 	// Ignore if VdiName is not specified
 	if self.VdiName == "" {
@@ -32,9 +31,7 @@ func (self *StepFindVdi) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
-	vdi := vdis[0]
-
-	vdiUuid, err := vdi.GetUuid()
+	vdiUuid, err := client.GetVdiUuid(vdis[0])
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get UUID of VDI '%s': %s", self.VdiName, err.Error()))
 		return multistep.ActionHalt
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+func TestStepFindVdi(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	step := &StepFindVdi{
+		VdiName:    "xs-tools.iso",
+		VdiUuidKey: "tools_vdi_uuid",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	uuid := state.Get("tools_vdi_uuid").(string)
+	if ref := server.FindByUuid("VDI", uuid); ref != server.ToolsVDIRef {
+		t.Fatalf("found the wrong VDI: %s", ref)
+	}
+}
+
+func TestStepFindVdi_Missing(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	step := &StepFindVdi{
+		VdiName:    "missing.iso",
+		VdiUuidKey: "tools_vdi_uuid",
+	}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("tools_vdi_uuid"); ok {
+		t.Fatal("should not have set a VDI UUID")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
+	"net"
 )
 
 type StepForwardPortOverSSH struct {
@@ -14,6 +15,12 @@ type StepForwardPortOverSSH struct {
 	HostPortMax uint
 
 	ResultKey string
+
+	// SkipInDirectMode marks the communicator forward, which isn't needed
+	// when ssh_connect_mode is "direct".
+	SkipInDirectMode bool
+
+	listener net.Listener
 }
 
 func (self *StepForwardPortOverSSH) Run(state multistep.StateBag) multistep.StepAction {
@@ -21,6 +28,11 @@ func (self *StepForwardPortOverSSH) Run(state multistep.StateBag) multistep.Step
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
 
+	if self.SkipInDirectMode && config.SSHConnectMode == "direct" {
+		ui.Say("Skipping the port forward over SSH, connecting to the instance directly")
+		return multistep.ActionContinue
+	}
+
 	// Find a free local port:
 
 	l, sshHostPort := FindPort(self.HostPortMin, self.HostPortMax)
@@ -35,7 +47,9 @@ func (self *StepForwardPortOverSSH) Run(state multistep.StateBag) multistep.Step
 	remotePort, _ := self.RemotePort(state)
 	remoteDest, _ := self.RemoteDest(state)
 
-	go ssh_port_forward(l, remotePort, remoteDest, config.HostIp, config.Username, config.Password)
+	// Tunnels share the one connection to the host, see HostSSHClient
+	self.listener = l
+	go ssh_port_forward(l, remotePort, remoteDest, state.Get("host_ssh").(*HostSSHClient))
 	ui.Say(fmt.Sprintf("Port forward setup. %d ---> %s:%d on %s", sshHostPort, remoteDest, remotePort, config.HostIp))
 
 	// Provide the local port to future steps.
@@ -44,4 +58,11 @@ func (self *StepForwardPortOverSSH) Run(state multistep.StateBag) multistep.Step
 	return multistep.ActionContinue
 }
 
-func (self *StepForwardPortOverSSH) Cleanup(state multistep.StateBag) {}
+func (self *StepForwardPortOverSSH) Cleanup(state multistep.StateBag) {
+	// Closing the listener ends ssh_port_forward; any tunnels still open
+	// are closed along with the host connection by StepConnectHostSSH.
+	if self.listener != nil {
+		self.listener.Close()
+		self.listener = nil
+	}
+}
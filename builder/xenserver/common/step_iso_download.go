@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type StepIsoDownload struct {
@@ -19,7 +17,7 @@ type StepIsoDownload struct {
 func (self *StepIsoDownload) Run(state multistep.StateBag) multistep.StepAction {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 
 	ui.Say("Downloading ISO " + self.IsoName)
 	// first step is to find out if the ISO already exists in the SR
@@ -21,8 +21,8 @@ func (self *StepPrepareNfsExport) Run(state multistep.StateBag) multistep.StepAc
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
 	
-	if config.Format == "vhd" {
-		// only do this if we're exporting a VHD
+	if config.Format == "vhd" && config.VHDExport == "nfs" {
+		// only do this if we're exporting a VHD off the NFS SR
 		ui.Say("Step: Mounting NFS export")
 
 		NfsMountPoint := config.OutputDir + "/nfs"
@@ -58,8 +58,8 @@ func (StepPrepareNfsExport) Cleanup(state multistep.StateBag) {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
 
-	if config.Format == "vhd" {
-		// only do this if we're exporting a VHD
+	if config.Format == "vhd" && config.VHDExport == "nfs" {
+		// only do this if we're exporting a VHD off the NFS SR
 		ui.Say("Deleting mount point ...")
 		NfsMountPoint := config.OutputDir + "/nfs"
 
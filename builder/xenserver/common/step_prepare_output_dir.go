@@ -5,8 +5,10 @@ package common
 import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -38,9 +40,16 @@ func (self *StepPrepareOutputDir) Cleanup(state multistep.StateBag) {
 	if cancelled || halted {
 		ui := state.Get("ui").(packer.Ui)
 
-		ui.Say("Deleting output directory...")
+		remove := os.RemoveAll
+		if self.hasScreenshots() {
+			// They're kept to show what went wrong
+			ui.Say("Deleting output directory, apart from its screenshots and recordings...")
+			remove = removeAllBut(screenshotDir, recordingDir)
+		} else {
+			ui.Say("Deleting output directory...")
+		}
 		for i := 0; i < 5; i++ {
-			err := os.RemoveAll(self.Path)
+			err := remove(self.Path)
 			if err == nil {
 				break
 			}
@@ -50,3 +59,37 @@ func (self *StepPrepareOutputDir) Cleanup(state multistep.StateBag) {
 		}
 	}
 }
+
+// hasScreenshots reports whether there are screenshots or recordings of the
+// console.
+func (self *StepPrepareOutputDir) hasScreenshots() bool {
+	for _, dir := range []string{screenshotDir, recordingDir} {
+		if files, err := ioutil.ReadDir(filepath.Join(self.Path, dir)); err == nil && len(files) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// removeAllBut returns a function that removes everything in a directory
+// apart from keep.
+func removeAllBut(keep ...string) func(string) error {
+	return func(path string) error {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+	Files:
+		for _, file := range files {
+			for _, name := range keep {
+				if file.Name() == name {
+					continue Files
+				}
+			}
+			if err := os.RemoveAll(filepath.Join(path, file.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -1,10 +1,11 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
+	"log"
 	"time"
 )
 
@@ -13,7 +14,7 @@ type StepShutdown struct{}
 func (StepShutdown) Run(state multistep.StateBag) multistep.StepAction {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	instance_uuid := state.Get("instance_uuid").(string)
 
 	instance, err := client.GetVMByUuid(instance_uuid)
@@ -29,8 +30,21 @@ func (StepShutdown) Run(state multistep.StateBag) multistep.StepAction {
 		if config.ShutdownCommand != "" {
 			ui.Message("Executing shutdown command...")
 
-			_, err := ExecuteGuestSSHCmd(state, config.ShutdownCommand)
-			if err != nil {
+			// Run the command through whichever communicator StepConnect set up,
+			// so WinRM builds shut down the same way as SSH ones.
+			comm, ok := state.Get("communicator").(packer.Communicator)
+			if !ok {
+				ui.Error("Shutdown command failed: no communicator is available")
+				return false
+			}
+
+			var stdout, stderr bytes.Buffer
+			cmd := &packer.RemoteCmd{
+				Command: config.ShutdownCommand,
+				Stdout:  &stdout,
+				Stderr:  &stderr,
+			}
+			if err := comm.Start(cmd); err != nil {
 				ui.Error(fmt.Sprintf("Shutdown command failed: %s", err.Error()))
 				return false
 			}
@@ -39,13 +53,16 @@ func (StepShutdown) Run(state multistep.StateBag) multistep.StepAction {
 
 			err = InterruptibleWait{
 				Predicate: func() (bool, error) {
-					power_state, err := instance.GetPowerState()
+					power_state, err := client.GetVMPowerState(instance)
 					return power_state == "Halted", err
 				},
 				PredicateInterval: 5 * time.Second,
 				Timeout:           300 * time.Second,
 			}.Wait(state)
 
+			log.Printf("Shutdown stdout: %s", stdout.String())
+			log.Printf("Shutdown stderr: %s", stderr.String())
+
 			if err != nil {
 				ui.Error(fmt.Sprintf("Error waiting for VM to halt: %s", err.Error()))
 				return false
@@ -54,7 +71,7 @@ func (StepShutdown) Run(state multistep.StateBag) multistep.StepAction {
 		} else {
 			ui.Message("Attempting to cleanly shutdown the VM...")
 
-			err = instance.CleanShutdown()
+			err = client.CleanShutdownVM(instance)
 			if err != nil {
 				ui.Error(fmt.Sprintf("Could not shut down VM: %s", err.Error()))
 				return false
@@ -66,7 +83,7 @@ func (StepShutdown) Run(state multistep.StateBag) multistep.StepAction {
 
 	if !success {
 		ui.Say("WARNING: Forcing hard shutdown of the VM...")
-		err = instance.HardShutdown()
+		err = client.HardShutdownVM(instance)
 		if err != nil {
 			ui.Error(fmt.Sprintf("Could not hard shut down VM -- giving up: %s", err.Error()))
 			return multistep.ActionHalt
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
 	"log"
 	"time"
 )
@@ -25,7 +24,7 @@ type StepStartOnHIMN struct{
 func (self *StepStartOnHIMN) Run(state multistep.StateBag) multistep.StepAction {
 
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 
 	ui.Say("Step: Start VM on the Host Internal Mangement Network")
 
@@ -47,14 +46,14 @@ func (self *StepStartOnHIMN) Run(state multistep.StateBag) multistep.StepAction
 	himn := networks[0]
 
 	// Create a VIF for the HIMN
-	himn_vif, err := instance.ConnectNetwork(himn, "0")
+	himn_vif, err := client.ConnectNetwork(instance, himn, "0")
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error creating HIMN VIF : %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
 	// Start the VM
-	err = instance.Start(false, false)
+	err = StartVMOnChosenHost(state, instance, false)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to start VM with UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
@@ -73,15 +72,15 @@ func (self *StepStartOnHIMN) Run(state multistep.StateBag) multistep.StepAction
 		// Obtain the allocated IP
 		err = InterruptibleWait{
 			Predicate: func() (found bool, err error) {
-				ips, err := himn.GetAssignedIPs()
+				ips, err := client.GetNetworkAssignedIPs(himn)
 				if err != nil {
 					return false, fmt.Errorf("Can't get assigned IPs: %s", err.Error())
 				}
 				log.Printf("IPs: %s", ips)
-				log.Printf("Ref: %s", instance.Ref)
+				log.Printf("Ref: %s", instance)
 
 				//Check for instance.Ref in map
-				if vm_ip, ok := ips[himn_vif.Ref]; ok && vm_ip != "" {
+				if vm_ip, ok := ips[himn_vif]; ok && vm_ip != "" {
 					ui.Say("Found the VM's IP: " + vm_ip)
 					himn_iface_ip = vm_ip
 					return true, nil
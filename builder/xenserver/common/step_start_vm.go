@@ -5,14 +5,13 @@ import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	"log"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type StepStartVm struct{}
 
 func (self *StepStartVm) Run(state multistep.StateBag) multistep.StepAction {
 
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	ui := state.Get("ui").(packer.Ui)
 
 	ui.Say("Step: Start VM")
@@ -24,7 +23,7 @@ func (self *StepStartVm) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
-	err = instance.Start(false, false)
+	err = StartVMOnChosenHost(state, instance, false)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to start VM with UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
@@ -41,7 +40,7 @@ func (self *StepStartVm) Run(state multistep.StateBag) multistep.StepAction {
 
 func (self *StepStartVm) Cleanup(state multistep.StateBag) {
 	config := state.Get("commonconfig").(CommonConfig)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 
 	if config.ShouldKeepVM(state) {
 		return
@@ -54,7 +53,7 @@ func (self *StepStartVm) Cleanup(state multistep.StateBag) {
 		return
 	}
 
-	err = instance.HardShutdown()
+	err = client.HardShutdownVM(instance)
 	if err != nil {
 		log.Printf(fmt.Sprintf("Unable to force shutdown VM '%s': %s", uuid, err.Error()))
 	}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
 	"log"
 )
 
@@ -12,7 +11,7 @@ type StepStartVmPaused struct{}
 
 func (self *StepStartVmPaused) Run(state multistep.StateBag) multistep.StepAction {
 
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	ui := state.Get("ui").(packer.Ui)
 
 	ui.Say("Step: Start VM Paused")
@@ -25,13 +24,13 @@ func (self *StepStartVmPaused) Run(state multistep.StateBag) multistep.StepActio
 	}
 
 	// note that here "cd" means boot from hard drive ('c') first, then CDROM ('d')
-	err = instance.SetHVMBoot("BIOS order", "cd")
+	err = client.SetVMHVMBoot(instance, "BIOS order", "cd")
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to set HVM boot params: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = instance.Start(true, false)
+	err = StartVMOnChosenHost(state, instance, true)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to start VM with UUID '%s': %s", uuid, err.Error()))
 		return multistep.ActionHalt
@@ -48,7 +47,7 @@ func (self *StepStartVmPaused) Run(state multistep.StateBag) multistep.StepActio
 
 func (self *StepStartVmPaused) Cleanup(state multistep.StateBag) {
 	config := state.Get("commonconfig").(CommonConfig)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 
 	if config.ShouldKeepVM(state) {
 		return
@@ -61,7 +60,7 @@ func (self *StepStartVmPaused) Cleanup(state multistep.StateBag) {
 		return
 	}
 
-	err = instance.HardShutdown()
+	err = client.HardShutdownVM(instance)
 	if err != nil {
 		log.Printf(fmt.Sprintf("Unable to force shutdown VM '%s': %s", uuid, err.Error()))
 	}
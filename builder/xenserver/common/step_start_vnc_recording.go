@@ -0,0 +1,45 @@
+package common
+
+import (
+	"fmt"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"log"
+	"path/filepath"
+)
+
+// StepStartVNCRecording starts recording the VM's console, when vnc_record
+// is set, for StepStopVNCRecording to stop. If the build fails first, the
+// recording is stopped in Cleanup, before the VM's destroyed.
+type StepStartVNCRecording struct{}
+
+func (self *StepStartVNCRecording) Run(state multistep.StateBag) multistep.StepAction {
+	config := state.Get("commonconfig").(CommonConfig)
+	ui := state.Get("ui").(packer.Ui)
+
+	if !config.VNCRecord {
+		return multistep.ActionContinue
+	}
+
+	vnc_port := state.Get("local_vnc_port").(uint)
+	dir := filepath.Join(config.OutputDir, recordingDir)
+
+	recorder, err := startVNCRecorder(fmt.Sprintf("127.0.0.1:%d", vnc_port), dir, config.VNCRecordInterval)
+	if err != nil {
+		err := fmt.Errorf("Error starting the VNC recording: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	state.Put("vnc_recorder", recorder)
+
+	ui.Say(fmt.Sprintf("Recording the VM's console to '%s'", dir))
+	return multistep.ActionContinue
+}
+
+func (self *StepStartVNCRecording) Cleanup(state multistep.StateBag) {
+	if recorder, ok := state.GetOk("vnc_recorder"); ok {
+		frames := recorder.(*vncRecorder).Stop()
+		log.Printf("VNC recording stopped with %d frames", frames)
+	}
+}
@@ -0,0 +1,22 @@
+package common
+
+import (
+	"fmt"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// StepStopVNCRecording stops the recording StepStartVNCRecording started.
+type StepStopVNCRecording struct{}
+
+func (self *StepStopVNCRecording) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	if recorder, ok := state.GetOk("vnc_recorder"); ok {
+		frames := recorder.(*vncRecorder).Stop()
+		ui.Say(fmt.Sprintf("Stopped recording the VM's console, after %d frames", frames))
+	}
+	return multistep.ActionContinue
+}
+
+func (self *StepStopVNCRecording) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+// testState returns a state bag wired up to a fake XAPI server, the way
+// the builders set it up before running their steps.
+func testState(t *testing.T, server *xapitest.Server) multistep.StateBag {
+	client := NewXenAPIHypervisor(server.Host(), server.Username, server.Password, "", server.TLSConfig())
+	if err := client.Login(); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("client", client)
+	state.Put("commonconfig", CommonConfig{KeepVM: "never", UploadTimeout: time.Hour})
+	state.Put("ui", &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	})
+	return state
+}
@@ -4,19 +4,23 @@ package common
 
 import (
 	"fmt"
-	"github.com/xenserverarmy/go-vnc"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
 	"log"
-	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
-	"unicode"
-	"unicode/utf8"
 )
 
-const KeyLeftShift uint = 0xFFE1
+// Screenshots of the console are saved in this directory under the output
+// directory, which is kept when the build fails.
+const screenshotDir = "screenshots"
+
+// screenSettleTime is how long the screen has to stay the same after a
+// change for <waitForScreenChange> to finish.
+const screenSettleTime = 2 * time.Second
 
 type bootCommandTemplateData struct {
 	Name     string
@@ -43,22 +47,9 @@ func (self *StepTypeBootCommand) Run(state multistep.StateBag) multistep.StepAct
 	ui.Say("Connecting to the VM over VNC")
 	ui.Message(fmt.Sprintf("Using local port: %d", vnc_port))
 
-	net_conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", vnc_port))
-
-	if err != nil {
-		err := fmt.Errorf("Error connecting to VNC: %s", err)
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return multistep.ActionHalt
-	}
-
-	defer net_conn.Close()
-
-	c, err := vnc.Client(net_conn, &vnc.ClientConfig{Exclusive: true})
-
+	// Leave the console to the recording, if there is one
+	c, err := dialVNCConsole(fmt.Sprintf("127.0.0.1:%d", vnc_port), !config.VNCRecord)
 	if err != nil {
-
-		err := fmt.Errorf("Error establishing VNC session: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
@@ -66,7 +57,7 @@ func (self *StepTypeBootCommand) Run(state multistep.StateBag) multistep.StepAct
 
 	defer c.Close()
 
-	ui.Message(fmt.Sprintf("Connected to the VNC console: %s", c.DesktopName))
+	ui.Message(fmt.Sprintf("Connected to the VNC console: %s", c.DesktopName()))
 
 	// find local ip
 	envVar, err := ExecuteHostSSHCmd(state, "echo $SSH_CLIENT")
@@ -87,6 +78,21 @@ func (self *StepTypeBootCommand) Run(state multistep.StateBag) multistep.StepAct
 		http_port,
 	}
 
+	layout, err := newKeyboardLayout(config.BootKeyboardLayout)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error preparing boot command: %s", err))
+		return multistep.ActionHalt
+	}
+	typer := newBootCommandTyper(&stepConsole{vncConsole: c, state: state}, layout, config.BootKeyInterval, config.BootKeyGroupInterval, func(d time.Duration) error {
+		if _, ok := state.GetOk(multistep.StateCancelled); ok {
+			return InterruptedError{}
+		}
+		if d <= 0 {
+			return nil
+		}
+		return InterruptibleWait{Timeout: d}.Wait(state)
+	})
+
 	ui.Say("Typing boot commands over VNC...")
 	for _, command := range config.BootCommand {
 
@@ -103,7 +109,15 @@ func (self *StepTypeBootCommand) Run(state multistep.StateBag) multistep.StepAct
 			return multistep.ActionHalt
 		}
 
-		vncSendString(c, command)
+		if err := typer.Type(command); err != nil {
+			if _, ok := err.(InterruptedError); ok {
+				return multistep.ActionHalt
+			}
+			err := fmt.Errorf("Error typing boot command: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
 	}
 
 	ui.Say("Finished typing.")
@@ -111,99 +125,79 @@ func (self *StepTypeBootCommand) Run(state multistep.StateBag) multistep.StepAct
 	return multistep.ActionContinue
 }
 
-func (self *StepTypeBootCommand) Cleanup(multistep.StateBag) {}
-
-// Taken from qemu's builder plugin - not an exported function.
-func vncSendString(c *vnc.ClientConn, original string) {
-	// Scancodes reference: https://github.com/qemu/qemu/blob/master/ui/vnc_keysym.h
-	special := make(map[string]uint32)
-	special["<bs>"] = 0xFF08
-	special["<del>"] = 0xFFFF
-	special["<enter>"] = 0xFF0D
-	special["<esc>"] = 0xFF1B
-	special["<f1>"] = 0xFFBE
-	special["<f2>"] = 0xFFBF
-	special["<f3>"] = 0xFFC0
-	special["<f4>"] = 0xFFC1
-	special["<f5>"] = 0xFFC2
-	special["<f6>"] = 0xFFC3
-	special["<f7>"] = 0xFFC4
-	special["<f8>"] = 0xFFC5
-	special["<f9>"] = 0xFFC6
-	special["<f10>"] = 0xFFC7
-	special["<f11>"] = 0xFFC8
-	special["<f12>"] = 0xFFC9
-	special["<return>"] = 0xFF0D
-	special["<tab>"] = 0xFF09
-	special["<up>"] = 0xFF52
-	special["<down>"] = 0xFF54
-	special["<left>"] = 0xFF51
-	special["<right>"] = 0xFF53
-	special["<spacebar>"] = 0x020
-	special["<insert>"] = 0xFF63
-	special["<home>"] = 0xFF50
-	special["<end>"] = 0xFF57
-	special["<pageUp>"] = 0xFF55
-	special["<pageDown>"] = 0xFF56
-
-	shiftedChars := "~!@#$%^&*()_+{}|:\"<>?"
-
-	// TODO(mitchellh): Ripe for optimizations of some point, perhaps.
-	for len(original) > 0 {
-		var keyCode uint32
-		keyShift := false
-
-		if strings.HasPrefix(original, "<wait>") {
-			log.Printf("Special code '<wait>' found, sleeping one second")
-			time.Sleep(1 * time.Second)
-			original = original[len("<wait>"):]
-			continue
-		}
-
-		if strings.HasPrefix(original, "<wait5>") {
-			log.Printf("Special code '<wait5>' found, sleeping 5 seconds")
-			time.Sleep(5 * time.Second)
-			original = original[len("<wait5>"):]
-			continue
-		}
-
-		if strings.HasPrefix(original, "<wait10>") {
-			log.Printf("Special code '<wait10>' found, sleeping 10 seconds")
-			time.Sleep(10 * time.Second)
-			original = original[len("<wait10>"):]
-			continue
-		}
+// Cleanup saves a screenshot of the console if the build failed, at this
+// step or any after it, to show what the VM was up to.
+func (self *StepTypeBootCommand) Cleanup(state multistep.StateBag) {
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if cancelled || !halted {
+		return
+	}
+	vnc_port, ok := state.GetOk("local_vnc_port")
+	if !ok {
+		return
+	}
 
-		for specialCode, specialValue := range special {
-			if strings.HasPrefix(original, specialCode) {
-				log.Printf("Special code '%s' found, replacing with: %d", specialCode, specialValue)
-				keyCode = specialValue
-				original = original[len(specialCode):]
-				break
-			}
-		}
+	c, err := dialVNCConsole(fmt.Sprintf("127.0.0.1:%d", vnc_port.(uint)), false)
+	if err != nil {
+		log.Printf("Unable to take a screenshot of the failed build: %s", err)
+		return
+	}
+	defer c.Close()
 
-		if keyCode == 0 {
-			r, size := utf8.DecodeRuneInString(original)
-			original = original[size:]
-			keyCode = uint32(r)
-			keyShift = unicode.IsUpper(r) || strings.ContainsRune(shiftedChars, r)
+	// Give the console a moment to send the whole screen
+	InterruptibleWait{
+		Predicate: func() (bool, error) {
+			_, err := c.Screen()
+			return err == nil, nil
+		},
+		PredicateInterval: frameInterval,
+		Timeout:           10 * time.Second,
+	}.Wait(state)
+
+	if err := saveScreenshot(state, c, "failure.png"); err != nil {
+		log.Printf("Unable to take a screenshot of the failed build: %s", err)
+	}
+}
 
-			log.Printf("Sending char '%c', code %d, shift %v", r, keyCode, keyShift)
-		}
+// stepConsole is the VNC console as the boot command step types on it.
+type stepConsole struct {
+	*vncConsole
+	state       multistep.StateBag
+	screenshots int
+}
 
-		if keyShift {
-			c.KeyEvent(uint32(KeyLeftShift), true)
-		}
+func (self *stepConsole) Screenshot() error {
+	self.screenshots++
+	return saveScreenshot(self.state, self.vncConsole, fmt.Sprintf("boot-%d.png", self.screenshots))
+}
 
-		c.KeyEvent(keyCode, true)
-		c.KeyEvent(keyCode, false)
+func (self *stepConsole) WaitForScreenChange(timeout time.Duration) error {
+	err := InterruptibleWait{
+		Predicate:         self.settled(screenSettleTime),
+		PredicateInterval: frameInterval,
+		Timeout:           timeout,
+	}.Wait(self.state)
+	if _, ok := err.(TimeoutError); ok {
+		return fmt.Errorf("the screen didn't change and settle within %s", timeout)
+	}
+	return err
+}
 
-		if keyShift {
-			c.KeyEvent(uint32(KeyLeftShift), false)
-		}
+// saveScreenshot saves the console's screen as name in the screenshot
+// directory.
+func saveScreenshot(state multistep.StateBag, c *vncConsole, name string) error {
+	config := state.Get("commonconfig").(CommonConfig)
+	ui := state.Get("ui").(packer.Ui)
 
-		// no matter what, wait a small period
-		time.Sleep(50 * time.Millisecond)
+	dir := filepath.Join(config.OutputDir, screenshotDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if err := c.SaveScreenshot(path); err != nil {
+		return err
 	}
+	ui.Message(fmt.Sprintf("Saved a screenshot of the console to '%s'", path))
+	return nil
 }
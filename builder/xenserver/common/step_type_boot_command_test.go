@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// A failed build leaves a screenshot of the console behind, and the rest of
+// the output directory is deleted.
+func TestStepTypeBootCommand_FailureScreenshot(t *testing.T) {
+	server := newFakeVNCServer(t, 4, 3, blue)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "packer-screenshot")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+
+	state := new(multistep.BasicStateBag)
+	state.Put("commonconfig", CommonConfig{OutputDir: output})
+	state.Put("ui", &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	})
+	state.Put("local_vnc_port", server.Port())
+
+	prepare := &StepPrepareOutputDir{Path: output}
+	if action := prepare.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("unexpected action %v", action)
+	}
+	if err := ioutil.WriteFile(filepath.Join(output, "disk.vhd"), []byte("partial"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state.Put(multistep.StateHalted, true)
+	new(StepTypeBootCommand).Cleanup(state)
+	prepare.Cleanup(state)
+
+	fh, err := os.Open(filepath.Join(output, screenshotDir, "failure.png"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer fh.Close()
+	screenshot, err := png.Decode(fh)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if r, g, b, _ := screenshot.At(3, 2).RGBA(); screenshot.Bounds().Dx() != 4 || r>>8 != 0x10 || g>>8 != 0x20 || b>>8 != 0xF0 {
+		t.Fatalf("unexpected screenshot %v", screenshot)
+	}
+
+	if _, err := os.Stat(filepath.Join(output, "disk.vhd")); !os.IsNotExist(err) {
+		t.Fatalf("the rest of the output directory should be deleted: %v", err)
+	}
+}
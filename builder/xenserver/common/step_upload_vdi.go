@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
 	"log"
 	"os"
 	"time"
@@ -19,7 +18,7 @@ type StepUploadVdi struct {
 func (self *StepUploadVdi) Run(state multistep.StateBag) multistep.StepAction {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 
 	imagePath := self.ImagePathFunc()
 	vdiName := self.VdiNameFunc()
@@ -53,24 +52,20 @@ func (self *StepUploadVdi) Run(state multistep.StateBag) multistep.StepAction {
 	fileLength := fstat.Size()
 
 	// Create the VDI
-	vdi, err := sr.CreateVdi(vdiName, fileLength)
+	vdi, err := client.CreateVdi(sr, vdiName, fileLength)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to create VDI '%s': %s", vdiName, err.Error()))
 		return multistep.ActionHalt
 	}
 
-	vdiUuid, err := vdi.GetUuid()
+	vdiUuid, err := client.GetVdiUuid(vdi)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get UUID of VDI '%s': %s", vdiName, err.Error()))
 		return multistep.ActionHalt
 	}
 	state.Put(self.VdiUuidKey, vdiUuid)
 
-	_, err = HTTPUpload(fmt.Sprintf("https://%s/import_raw_vdi?vdi=%s&session_id=%s",
-		client.Host,
-		vdi.Ref,
-		client.Session.(string),
-	), fh, state)
+	_, err = HTTPUpload(client.ImportRawVdiURL(vdi), fh, state)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to upload VDI: %s", err.Error()))
 		return multistep.ActionHalt
@@ -82,7 +77,7 @@ func (self *StepUploadVdi) Run(state multistep.StateBag) multistep.StepAction {
 func (self *StepUploadVdi) Cleanup(state multistep.StateBag) {
 	config := state.Get("commonconfig").(CommonConfig)
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	vdiName := self.VdiNameFunc()
 
 	if config.ShouldKeepVM(state) {
@@ -111,7 +106,7 @@ func (self *StepUploadVdi) Cleanup(state multistep.StateBag) {
 	// so try several times
 	for i := 0; i < 3; i++ {
 		log.Printf("Trying to destroy VDI...")
-		err = vdi.Destroy()
+		err = client.DestroyVdi(vdi)
 		if err == nil {
 			break
 		}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+func TestStepUploadVdi(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testState(t, server)
+
+	image, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(image.Name())
+	image.WriteString("floppy contents")
+	image.Close()
+
+	step := &StepUploadVdi{
+		VdiNameFunc:   func() string { return "Packer-floppy-disk" },
+		ImagePathFunc: func() string { return image.Name() },
+		VdiUuidKey:    "floppy_vdi_uuid",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vdi := server.FindByUuid("VDI", state.Get("floppy_vdi_uuid").(string))
+	if vdi == "" {
+		t.Fatal("the VDI wasn't created")
+	}
+	if got := string(server.Content(vdi)); got != "floppy contents" {
+		t.Fatalf("bad VDI content: %q", got)
+	}
+
+	step.Cleanup(state)
+	if server.Record(vdi) != nil {
+		t.Fatal("cleanup should have destroyed the VDI")
+	}
+	if uuid := state.Get("floppy_vdi_uuid").(string); uuid != "" {
+		t.Fatalf("cleanup should have cleared the VDI UUID, got %s", uuid)
+	}
+}
+
+func TestStepUploadVdi_Retry(t *testing.T) {
+	defer func(delay time.Duration) { uploadRetryDelay = delay }(uploadRetryDelay)
+	uploadRetryDelay = 0
+
+	server := xapitest.NewServer()
+	defer server.Close()
+	server.FailImports = 1
+	state := testState(t, server)
+
+	image, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(image.Name())
+	image.WriteString("floppy contents")
+	image.Close()
+
+	step := &StepUploadVdi{
+		VdiNameFunc:   func() string { return "Packer-floppy-disk" },
+		ImagePathFunc: func() string { return image.Name() },
+		VdiUuidKey:    "floppy_vdi_uuid",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+
+	// The whole file is sent again after the failed attempt
+	vdi := server.FindByUuid("VDI", state.Get("floppy_vdi_uuid").(string))
+	if got := string(server.Content(vdi)); got != "floppy contents" {
+		t.Fatalf("bad VDI content: %q", got)
+	}
+
+	cancelled := 0
+	for _, call := range server.Calls() {
+		if call == "task.cancel" {
+			cancelled++
+		}
+	}
+	if cancelled != 1 {
+		t.Fatalf("the failed attempt's task should have been cancelled once, got %d", cancelled)
+	}
+}
@@ -6,8 +6,6 @@ import (
 
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"github.com/nilshell/xmlrpc"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type StepWaitForIP struct {
@@ -17,7 +15,7 @@ type StepWaitForIP struct {
 
 func (self *StepWaitForIP) Run(state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	config := state.Get("commonconfig").(CommonConfig)
 	ui.Say("Step: Wait for VM's IP to become known to us.")
 
@@ -49,18 +47,13 @@ func (self *StepWaitForIP) Run(state multistep.StateBag) multistep.StepAction {
 			if config.IPGetter == "auto" || config.IPGetter == "tools" {
 
 				// Look for PV IP
-				metrics, err := instance.GetGuestMetrics()
+				networks, err := client.GetVMGuestNetworks(instance)
 				if err != nil {
 					return false, err
 				}
-				if metrics != nil {
-					networks := metrics["networks"].(xmlrpc.Struct)
-					if ipRaw, ok := networks["0/ip"]; ok {
-						if ip = ipRaw.(string); ip != "" {
-							ui.Message(fmt.Sprintf("Got IP '%s' from XenServer tools", ip))
-							return true, nil
-						}
-					}
+				if ip = networks["0/ip"]; ip != "" {
+					ui.Message(fmt.Sprintf("Got IP '%s' from XenServer tools", ip))
+					return true, nil
 				}
 
 			}
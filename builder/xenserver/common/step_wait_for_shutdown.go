@@ -5,7 +5,6 @@ import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	"time"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type StepWaitForShutdown struct{}
@@ -16,7 +15,7 @@ func (StepWaitForShutdown) Run(state multistep.StateBag) multistep.StepAction {
 
 	ui.Say("Step: Waiting for installer to shutdown VM.")
 
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(Hypervisor)
 	instance_uuid := state.Get("instance_uuid").(string)
 
 	instance, err := client.GetVMByUuid(instance_uuid)
@@ -28,7 +27,7 @@ func (StepWaitForShutdown) Run(state multistep.StateBag) multistep.StepAction {
 	func() {
 		err = InterruptibleWait{
 			Predicate: func() (bool, error) {
-				power_state, err := instance.GetPowerState()
+				power_state, err := client.GetVMPowerState(instance)
 				return power_state == "Halted", err
 			},
 			PredicateInterval: 20 * time.Second,
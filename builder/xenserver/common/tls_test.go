@@ -0,0 +1,106 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+func testLogin(t *testing.T, server *xapitest.Server, config CommonConfig) error {
+	tlsConfig, err := config.TLSConfig()
+	if err != nil {
+		t.Fatalf("TLSConfig failed: %s", err)
+	}
+	client := NewXenAPIHypervisor(server.Host(), server.Username, server.Password, "", tlsConfig)
+	return client.Login()
+}
+
+func testFingerprint(server *xapitest.Server) string {
+	return tlsFingerprint(server.Certificate().Raw)
+}
+
+func TestTLSConfig_Default(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// Unverified, as before the TLS options, but the fingerprint is logged
+	if err := testLogin(t, server, CommonConfig{}); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+	if !strings.Contains(buf.String(), "remote_tls_fingerprint to "+testFingerprint(server)) {
+		t.Fatalf("expected the host's fingerprint to be logged, got %q", buf.String())
+	}
+}
+
+func TestTLSConfig_CAFile(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(tf.Name())
+	tf.Write(server.CertificatePEM())
+	tf.Close()
+
+	if err := testLogin(t, server, CommonConfig{RemoteCAFile: tf.Name()}); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+
+	// The CA and the pin are both checked
+	config := CommonConfig{RemoteCAFile: tf.Name(), RemoteTLSFingerprint: strings.Repeat("00", sha256.Size)}
+	if err := testLogin(t, server, config); err == nil {
+		t.Fatal("expected a mismatched fingerprint to be rejected")
+	}
+}
+
+func TestTLSConfig_Fingerprint(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	if err := testLogin(t, server, CommonConfig{RemoteTLSFingerprint: testFingerprint(server)}); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+
+	config := CommonConfig{RemoteTLSFingerprint: strings.Repeat("ab", sha256.Size)}
+	if err := testLogin(t, server, config); err == nil {
+		t.Fatal("expected a mismatched fingerprint to be rejected")
+	}
+}
+
+func TestTLSConfig_InsecureSkipVerify(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	if err := testLogin(t, server, CommonConfig{RemoteInsecureSkipVerify: true}); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+}
+
+func TestCommonConfig_PrepareTLS(t *testing.T) {
+	c := CommonConfig{RemoteTLSFingerprint: "not-a-fingerprint"}
+	if errs := c.prepareTLS(); len(errs) != 1 {
+		t.Fatalf("expected one error for a bad fingerprint, got %v", errs)
+	}
+
+	c = CommonConfig{RemoteCAFile: "/nonexistent/ca.pem"}
+	if errs := c.prepareTLS(); len(errs) != 1 {
+		t.Fatalf("expected one error for a missing CA file, got %v", errs)
+	}
+
+	c = CommonConfig{RemoteInsecureSkipVerify: true, RemoteTLSFingerprint: strings.Repeat("ab", sha256.Size)}
+	if errs := c.prepareTLS(); len(errs) != 1 {
+		t.Fatalf("expected one error for conflicting options, got %v", errs)
+	}
+}
@@ -0,0 +1,316 @@
+package common
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+/*
+ * vmdkWriter writes a monolithicSparse VMDK with 64K grains: the header,
+ * the embedded descriptor, then the grains in disk order. Each grain table
+ * is appended once the grains it maps have been written, and Close adds
+ * the empty grain tables and the grain directory.
+ *
+ * With stream set it writes a streamOptimized VMDK, as OVF packages use,
+ * instead. The layout is the same, but grains are deflated and each grain
+ * and table is preceded by a marker, and a footer and end-of-stream marker
+ * follow the grain directory.
+ */
+
+const (
+	vmdkSectorSize        = 512
+	vmdkGrainSectors      = 128
+	vmdkGrainSize         = vmdkGrainSectors * vmdkSectorSize
+	vmdkGTEntries         = 512
+	vmdkGTSectors         = vmdkGTEntries * 4 / vmdkSectorSize
+	vmdkDescriptorSectors = 20
+	vmdkMagic             = 0x564d444b
+	vmdkGDAtEnd           = 0xffffffffffffffff
+
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+type vmdkHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+// vmdkMarker precedes metadata in a streamOptimized VMDK, filling a sector.
+type vmdkMarker struct {
+	NumSectors uint64
+	Size       uint32
+	Type       uint32
+	Pad        [496]byte
+}
+
+type vmdkWriter struct {
+	sparseWriter
+	fh     *os.File
+	name   string // the extent's file name, as the descriptor refers to it
+	stream bool
+
+	next    int64            // next free sector
+	gd      map[int64]uint32 // grain table sectors by directory index
+	gtIndex int64
+	gt      []uint32 // the grain table being filled
+}
+
+func newVMDKWriter(fh *os.File, name string, stream bool) *vmdkWriter {
+	w := &vmdkWriter{fh: fh, name: name, stream: stream}
+	w.sparseWriter = sparseWriter{buf: make([]byte, vmdkGrainSize), block: w.writeGrain}
+	w.start()
+	return w
+}
+
+func (self *vmdkWriter) start() {
+	self.reset()
+	// The first grain follows the header and descriptor, grain aligned
+	self.next = vmdkGrainSectors
+	self.gd = make(map[int64]uint32)
+	self.gtIndex = 0
+	self.gt = make([]uint32, vmdkGTEntries)
+}
+
+func (self *vmdkWriter) Reset() error {
+	self.start()
+	return truncate(self.fh)
+}
+
+// allocate reserves sectors, which a sparse extent addresses with 32 bits.
+func (self *vmdkWriter) allocate(sectors int64) (uint32, error) {
+	sector := self.next
+	if sector+sectors > 1<<32 {
+		return 0, fmt.Errorf("the disk is too large for a sparse VMDK")
+	}
+	self.next += sectors
+	return uint32(sector), nil
+}
+
+func (self *vmdkWriter) writeGrain(index int64, data []byte) error {
+	if index/vmdkGTEntries != self.gtIndex {
+		if err := self.flushGT(); err != nil {
+			return err
+		}
+		self.gtIndex = index / vmdkGTEntries
+	}
+
+	if self.stream {
+		// A grain marker is the grain's LBA and compressed size
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, uint64(index*vmdkGrainSectors))
+		binary.Write(&buf, binary.LittleEndian, uint32(0))
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+		binary.LittleEndian.PutUint32(data[8:], uint32(len(data)-12))
+	}
+
+	sector, err := self.allocate((int64(len(data)) + vmdkSectorSize - 1) / vmdkSectorSize)
+	if err != nil {
+		return err
+	}
+	if _, err := self.fh.WriteAt(data, int64(sector)*vmdkSectorSize); err != nil {
+		return err
+	}
+	self.gt[index%vmdkGTEntries] = sector
+	return nil
+}
+
+// writeMarker writes a metadata marker in stream mode.
+func (self *vmdkWriter) writeMarker(markerType uint32, sectors int64) error {
+	if !self.stream {
+		return nil
+	}
+	sector, err := self.allocate(1)
+	if err != nil {
+		return err
+	}
+	marker := vmdkMarker{NumSectors: uint64(sectors), Type: markerType}
+	return writeLittleEndian(self.fh, int64(sector)*vmdkSectorSize, marker)
+}
+
+// flushGT writes out the current grain table if it maps anything.
+func (self *vmdkWriter) flushGT() error {
+	used := false
+	for _, entry := range self.gt {
+		if entry != 0 {
+			used = true
+			break
+		}
+	}
+	if !used {
+		return nil
+	}
+
+	if err := self.writeGT(self.gtIndex, self.gt); err != nil {
+		return err
+	}
+	self.gt = make([]uint32, vmdkGTEntries)
+	return nil
+}
+
+func (self *vmdkWriter) writeGT(index int64, gt []uint32) error {
+	if err := self.writeMarker(vmdkMarkerGT, vmdkGTSectors); err != nil {
+		return err
+	}
+	sector, err := self.allocate(vmdkGTSectors)
+	if err != nil {
+		return err
+	}
+	if err := writeLittleEndian(self.fh, int64(sector)*vmdkSectorSize, gt); err != nil {
+		return err
+	}
+	self.gd[index] = sector
+	return nil
+}
+
+func (self *vmdkWriter) Close() error {
+	if err := self.flush(); err != nil {
+		return err
+	}
+	if err := self.flushGT(); err != nil {
+		return err
+	}
+
+	capacity := (self.size + vmdkSectorSize - 1) / vmdkSectorSize
+	gtCoverage := int64(vmdkGTEntries * vmdkGrainSectors)
+	gd := make([]uint32, (capacity+gtCoverage-1)/gtCoverage)
+
+	// Every grain table is allocated, even if all its grains are sparse
+	empty := make([]uint32, vmdkGTEntries)
+	for i := range gd {
+		if _, ok := self.gd[int64(i)]; !ok {
+			if err := self.writeGT(int64(i), empty); err != nil {
+				return err
+			}
+		}
+		gd[i] = self.gd[int64(i)]
+	}
+
+	gdSectors := (int64(len(gd))*4 + vmdkSectorSize - 1) / vmdkSectorSize
+	if err := self.writeMarker(vmdkMarkerGD, gdSectors); err != nil {
+		return err
+	}
+	gdSector, err := self.allocate(gdSectors)
+	if err != nil {
+		return err
+	}
+	if err := writeLittleEndian(self.fh, int64(gdSector)*vmdkSectorSize, gd); err != nil {
+		return err
+	}
+
+	descriptor := vmdkDescriptor(self.name, capacity, self.stream)
+	if len(descriptor) > vmdkDescriptorSectors*vmdkSectorSize {
+		return fmt.Errorf("the VMDK descriptor is too long")
+	}
+	if _, err := self.fh.WriteAt([]byte(descriptor), vmdkSectorSize); err != nil {
+		return err
+	}
+
+	header := vmdkHeader{
+		MagicNumber:        vmdkMagic,
+		Version:            1,
+		Flags:              1, // valid newline detection
+		Capacity:           uint64(capacity),
+		GrainSize:          vmdkGrainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     vmdkDescriptorSectors,
+		NumGTEsPerGT:       vmdkGTEntries,
+		GdOffset:           uint64(gdSector),
+		OverHead:           vmdkGrainSectors,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+	if !self.stream {
+		return writeLittleEndian(self.fh, 0, header)
+	}
+
+	// The footer has the real grain directory offset, and the header
+	// points readers at it
+	header.Version = 3
+	header.Flags |= 1<<16 | 1<<17 // compressed grains, markers
+	header.CompressAlgorithm = 1  // deflate
+	if err := self.writeMarker(vmdkMarkerFooter, 1); err != nil {
+		return err
+	}
+	footer, err := self.allocate(1)
+	if err != nil {
+		return err
+	}
+	if err := writeLittleEndian(self.fh, int64(footer)*vmdkSectorSize, header); err != nil {
+		return err
+	}
+	if err := self.writeMarker(vmdkMarkerEOS, 0); err != nil {
+		return err
+	}
+
+	header.GdOffset = vmdkGDAtEnd
+	return writeLittleEndian(self.fh, 0, header)
+}
+
+func vmdkDescriptor(name string, capacity int64, stream bool) string {
+	createType := "monolithicSparse"
+	if stream {
+		createType = "streamOptimized"
+	}
+
+	cylinders := capacity / (16 * 63)
+	if cylinders > 16383 {
+		cylinders = 16383
+	}
+
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="%s"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "lsilogic"
+`, createType, capacity, name, cylinders)
+}
+
+func writeLittleEndian(fh *os.File, offset int64, data interface{}) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+		return err
+	}
+	_, err := fh.WriteAt(buf.Bytes(), offset)
+	return err
+}
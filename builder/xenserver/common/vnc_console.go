@@ -0,0 +1,368 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xenserverarmy/go-vnc"
+)
+
+/*
+ * vncConsole is a connection to a VM's VNC console that keeps a copy of its
+ * screen, for screenshots and for noticing when it changes. go-vnc leaves
+ * the screen to its user and its raw decoder is broken, so the console
+ * reads framebuffer updates itself. It asks for 32 bit true colour pixels in
+ * the raw encoding, and for DesktopSize updates so it follows the guest
+ * changing resolution, then asks for another incremental update each time
+ * one arrives, at most every frameInterval. It also asks again every
+ * updateTimeout, in case an update went astray, which is how it notices the
+ * connection's gone: go-vnc closes it quietly. go-vnc's writes to the
+ * connection don't take turns, so every write goes through the console.
+ */
+
+const frameInterval = 100 * time.Millisecond
+
+var updateTimeout = 5 * time.Second
+
+const (
+	rawEncoding         int32 = 0
+	desktopSizeEncoding int32 = -223
+)
+
+var consolePixelFormat = vnc.PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	TrueColor:  true,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   16,
+	GreenShift: 8,
+	BlueShift:  0,
+}
+
+// consoleEncoding advertises an encoding to the server. The console decodes
+// them itself, in framebufferUpdate.
+type consoleEncoding int32
+
+func (self consoleEncoding) Type() int32 {
+	return int32(self)
+}
+
+func (self consoleEncoding) Read(*vnc.ClientConn, *vnc.Rectangle, io.Reader) (vnc.Encoding, error) {
+	return nil, fmt.Errorf("encoding %d is decoded by the console", int32(self))
+}
+
+type vncConsole struct {
+	conn    *vnc.ClientConn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	screen  *image.RGBA
+	resized bool
+	changes int
+	changed time.Time
+	err     error
+
+	updateTimeout time.Duration
+	requests      chan struct{}
+	dropped       chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// dialVNCConsole connects to the VNC console at address and starts keeping
+// a copy of its screen. An exclusive connection disconnects anyone else
+// connected to the console.
+func dialVNCConsole(address string, exclusive bool) (*vncConsole, error) {
+	netConn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to VNC: %s", err)
+	}
+
+	self := &vncConsole{
+		updateTimeout: updateTimeout,
+		requests:      make(chan struct{}, 1),
+		dropped:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	self.conn, err = vnc.Client(netConn, &vnc.ClientConfig{
+		Exclusive:      exclusive,
+		ServerMessages: []vnc.ServerMessage{&framebufferUpdate{self}},
+	})
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("Error establishing VNC session: %s", err)
+	}
+
+	err = self.write(func() error {
+		if err := self.conn.SetPixelFormat(&consolePixelFormat); err != nil {
+			return err
+		}
+		encodings := []vnc.Encoding{consoleEncoding(rawEncoding), consoleEncoding(desktopSizeEncoding)}
+		if err := self.conn.SetEncodings(encodings); err != nil {
+			return err
+		}
+		return self.conn.FramebufferUpdateRequest(false, 0, 0, self.conn.FrameBufferWidth, self.conn.FrameBufferHeight)
+	})
+	if err != nil {
+		self.Close()
+		return nil, fmt.Errorf("Error requesting the VNC console's screen: %s", err)
+	}
+
+	go self.requestUpdates()
+	return self, nil
+}
+
+func (self *vncConsole) DesktopName() string {
+	return self.conn.DesktopName
+}
+
+func (self *vncConsole) write(f func() error) error {
+	self.writeMu.Lock()
+	defer self.writeMu.Unlock()
+	return f()
+}
+
+func (self *vncConsole) KeyEvent(keysym uint32, down bool) error {
+	return self.write(func() error {
+		return self.conn.KeyEvent(keysym, down)
+	})
+}
+
+func (self *vncConsole) Close() error {
+	var err error
+	self.closeOnce.Do(func() {
+		close(self.done)
+		err = self.conn.Close()
+	})
+	return err
+}
+
+// Dropped is closed if the connection's lost, after which Err says why.
+func (self *vncConsole) Dropped() <-chan struct{} {
+	return self.dropped
+}
+
+func (self *vncConsole) Err() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.err
+}
+
+// requestUpdates asks for the next update once the last one has arrived.
+func (self *vncConsole) requestUpdates() {
+	for {
+		select {
+		case <-self.requests:
+			select {
+			case <-time.After(frameInterval):
+			case <-self.done:
+				return
+			}
+		case <-time.After(self.updateTimeout):
+		case <-self.done:
+			return
+		}
+
+		self.mu.Lock()
+		bounds := image.Rect(0, 0, int(self.conn.FrameBufferWidth), int(self.conn.FrameBufferHeight))
+		if self.screen != nil {
+			bounds = self.screen.Bounds()
+		}
+		incremental := !self.resized
+		self.resized = false
+		self.mu.Unlock()
+
+		err := self.write(func() error {
+			return self.conn.FramebufferUpdateRequest(incremental, 0, 0, uint16(bounds.Dx()), uint16(bounds.Dy()))
+		})
+		if err != nil {
+			select {
+			case <-self.done:
+				return
+			default:
+			}
+			log.Printf("Error requesting a VNC framebuffer update: %s", err)
+			self.mu.Lock()
+			self.err = err
+			self.mu.Unlock()
+			close(self.dropped)
+			return
+		}
+	}
+}
+
+// Screen returns a copy of the screen.
+func (self *vncConsole) Screen() (*image.RGBA, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.screen == nil {
+		return nil, errors.New("the VNC console hasn't sent its screen yet")
+	}
+	return self.copyScreen(), nil
+}
+
+// changedScreen returns a copy of the screen if it's changed since it had
+// been changed the given number of times, along with how many times it has
+// been, or nil if it hasn't.
+func (self *vncConsole) changedScreen(changes int) (*image.RGBA, int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.screen == nil || self.changes == changes {
+		return nil, self.changes
+	}
+	return self.copyScreen(), self.changes
+}
+
+func (self *vncConsole) copyScreen() *image.RGBA {
+	screen := image.NewRGBA(self.screen.Bounds())
+	copy(screen.Pix, self.screen.Pix)
+	return screen
+}
+
+// SaveScreenshot writes the screen to path as a PNG.
+func (self *vncConsole) SaveScreenshot(path string) error {
+	screen, err := self.Screen()
+	if err != nil {
+		return err
+	}
+	return writePNG(path, screen)
+}
+
+func writePNG(path string, img image.Image) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(fh, img); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// settled returns a predicate for InterruptibleWait that's true once the
+// screen has changed since settled was called and then stayed the same for
+// quiet.
+func (self *vncConsole) settled(quiet time.Duration) func() (bool, error) {
+	self.mu.Lock()
+	start := self.changes
+	self.mu.Unlock()
+
+	return func() (bool, error) {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		return self.changes > start && time.Since(self.changed) >= quiet, nil
+	}
+}
+
+// paint copies raw pixels in consolePixelFormat into the screen, returning
+// whether anything changed.
+func (self *vncConsole) paint(c *vnc.ClientConn, x0, y0, width, height int, pixels []byte) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.screen == nil {
+		self.screen = image.NewRGBA(image.Rect(0, 0, int(c.FrameBufferWidth), int(c.FrameBufferHeight)))
+	}
+	bounds := self.screen.Bounds()
+
+	changed := false
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !image.Pt(x0+x, y0+y).In(bounds) {
+				continue
+			}
+			src := pixels[(y*width+x)*4:]
+			dst := self.screen.Pix[self.screen.PixOffset(x0+x, y0+y):]
+			if dst[0] != src[2] || dst[1] != src[1] || dst[2] != src[0] || dst[3] != 0xFF {
+				dst[0], dst[1], dst[2], dst[3] = src[2], src[1], src[0], 0xFF
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// resize starts a new, black, screen of the given size.
+func (self *vncConsole) resize(width, height int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.screen = image.NewRGBA(image.Rect(0, 0, width, height))
+	self.resized = true
+}
+
+// updated records an update, and asks for the next.
+func (self *vncConsole) updated(changed bool) {
+	self.mu.Lock()
+	if changed {
+		self.changes++
+		self.changed = time.Now()
+	}
+	self.mu.Unlock()
+
+	select {
+	case self.requests <- struct{}{}:
+	default:
+	}
+}
+
+// framebufferUpdate reads framebuffer updates into a console, in place of
+// go-vnc's FramebufferUpdateMessage.
+type framebufferUpdate struct {
+	console *vncConsole
+}
+
+func (*framebufferUpdate) Type() uint8 {
+	return 0
+}
+
+func (self *framebufferUpdate) Read(c *vnc.ClientConn, r io.Reader) (vnc.ServerMessage, error) {
+	var header struct {
+		Padding    uint8
+		Rectangles uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	for i := 0; i < int(header.Rectangles); i++ {
+		var rect struct {
+			X, Y, Width, Height uint16
+			Encoding            int32
+		}
+		if err := binary.Read(r, binary.BigEndian, &rect); err != nil {
+			return nil, err
+		}
+
+		switch rect.Encoding {
+		case rawEncoding:
+			pixels := make([]byte, int(rect.Width)*int(rect.Height)*4)
+			if _, err := io.ReadFull(r, pixels); err != nil {
+				return nil, err
+			}
+			if self.console.paint(c, int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height), pixels) {
+				changed = true
+			}
+		case desktopSizeEncoding:
+			self.console.resize(int(rect.Width), int(rect.Height))
+			changed = true
+		default:
+			return nil, fmt.Errorf("unsupported encoding type: %d", rect.Encoding)
+		}
+	}
+
+	self.console.updated(changed)
+	return &vnc.FramebufferUpdateMessage{}, nil
+}
@@ -0,0 +1,294 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVNCServer is an RFB 3.8 server, without authentication, showing a
+// screen of one colour. It sends the screen in 32 bit raw pixels, as the
+// console asks for them, whenever it's asked for all of it or it's been
+// changed, and records the keys it's sent.
+type fakeVNCServer struct {
+	listener net.Listener
+
+	mu            sync.Mutex
+	width, height int
+	colour        color.RGBA
+	changed       bool
+	resized       bool
+	waiting       net.Conn
+	conns         []net.Conn
+	keys          []string
+}
+
+func newFakeVNCServer(t *testing.T, width, height int, colour color.RGBA) *fakeVNCServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	s := &fakeVNCServer{listener: listener, width: width, height: height, colour: colour}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeVNCServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeVNCServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeVNCServer) Port() uint {
+	return uint(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Paint changes the screen, which may also change size.
+func (s *fakeVNCServer) Paint(width, height int, colour color.RGBA) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resized = s.resized || width != s.width || height != s.height
+	s.width, s.height, s.colour = width, height, colour
+	s.changed = true
+	if s.waiting != nil {
+		s.sendScreen(s.waiting)
+		s.waiting = nil
+	}
+}
+
+// Drop disconnects everyone connected to the server.
+func (s *fakeVNCServer) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns, s.waiting = nil, nil
+}
+
+func (s *fakeVNCServer) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+func (s *fakeVNCServer) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	reply := make([]byte, 12)
+	io.WriteString(conn, "RFB 003.008\n")
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	conn.Write([]byte{1, 1})
+	if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+		return
+	}
+	binary.Write(conn, binary.BigEndian, uint32(0))
+	if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	binary.Write(conn, binary.BigEndian, []uint16{uint16(s.width), uint16(s.height)})
+	s.mu.Unlock()
+	conn.Write(make([]byte, 16))
+	binary.Write(conn, binary.BigEndian, uint32(len("fake")))
+	io.WriteString(conn, "fake")
+
+	for {
+		var messageType uint8
+		if err := binary.Read(conn, binary.BigEndian, &messageType); err != nil {
+			return
+		}
+		switch messageType {
+		case 0: // SetPixelFormat
+			if _, err := io.ReadFull(conn, make([]byte, 19)); err != nil {
+				return
+			}
+		case 2: // SetEncodings
+			var header struct {
+				Padding   uint8
+				Encodings uint16
+			}
+			if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, 4*int(header.Encodings))); err != nil {
+				return
+			}
+		case 3: // FramebufferUpdateRequest
+			var request struct {
+				Incremental         uint8
+				X, Y, Width, Height uint16
+			}
+			if err := binary.Read(conn, binary.BigEndian, &request); err != nil {
+				return
+			}
+			s.mu.Lock()
+			if request.Incremental == 0 || s.changed {
+				s.sendScreen(conn)
+			} else {
+				s.waiting = conn
+			}
+			s.mu.Unlock()
+		case 4: // KeyEvent
+			var event struct {
+				Down    uint8
+				Padding uint16
+				Keysym  uint32
+			}
+			if err := binary.Read(conn, binary.BigEndian, &event); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.keys = append(s.keys, fmt.Sprintf("%#x %v", event.Keysym, event.Down == 1))
+			s.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+// sendScreen sends the whole screen, preceded by its new size if it's
+// been resized.
+func (s *fakeVNCServer) sendScreen(conn net.Conn) {
+	rectangles := uint16(1)
+	if s.resized {
+		rectangles = 2
+	}
+	binary.Write(conn, binary.BigEndian, []uint8{0, 0})
+	binary.Write(conn, binary.BigEndian, rectangles)
+	if s.resized {
+		binary.Write(conn, binary.BigEndian, []uint16{0, 0, uint16(s.width), uint16(s.height)})
+		binary.Write(conn, binary.BigEndian, desktopSizeEncoding)
+	}
+	binary.Write(conn, binary.BigEndian, []uint16{0, 0, uint16(s.width), uint16(s.height)})
+	binary.Write(conn, binary.BigEndian, rawEncoding)
+	pixels := make([]byte, 0, s.width*s.height*4)
+	for i := 0; i < s.width*s.height; i++ {
+		pixels = append(pixels, s.colour.B, s.colour.G, s.colour.R, 0)
+	}
+	conn.Write(pixels)
+	s.changed, s.resized = false, false
+}
+
+// waitForScreen waits for the console's screen to be the given size and
+// colour.
+func waitForScreen(t *testing.T, c *vncConsole, width, height int, colour color.RGBA) *image.RGBA {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		screen, err := c.Screen()
+		if err == nil && screen.Bounds() == image.Rect(0, 0, width, height) &&
+			screen.RGBAAt(0, 0) == colour && screen.RGBAAt(width-1, height-1) == colour {
+			return screen
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a %dx%d %v screen, got %v (%v)", width, height, colour, screen, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var (
+	red   = color.RGBA{0xFF, 0, 0, 0xFF}
+	green = color.RGBA{0, 0x80, 0, 0xFF}
+	blue  = color.RGBA{0x10, 0x20, 0xF0, 0xFF}
+)
+
+func TestVNCConsole(t *testing.T) {
+	server := newFakeVNCServer(t, 4, 3, red)
+	defer server.Close()
+
+	c, err := dialVNCConsole(server.Address(), true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+
+	if c.DesktopName() != "fake" {
+		t.Fatalf("unexpected desktop name %q", c.DesktopName())
+	}
+	waitForScreen(t, c, 4, 3, red)
+
+	// The screen has to change, and then stay the same, to settle
+	settled := c.settled(200 * time.Millisecond)
+	if done, _ := settled(); done {
+		t.Fatal("the screen hasn't changed yet")
+	}
+	server.Paint(4, 3, blue)
+	waitForScreen(t, c, 4, 3, blue)
+	if done, _ := settled(); done {
+		t.Fatal("the screen has only just changed")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if done, _ := settled(); !done {
+		t.Fatal("the screen should have settled")
+	}
+
+	// Changes of resolution are followed
+	server.Paint(6, 5, green)
+	waitForScreen(t, c, 6, 5, green)
+
+	if err := c.KeyEvent('a', true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := c.KeyEvent('a', false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Keys()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keys := server.Keys(); len(keys) != 2 || keys[0] != "0x61 true" || keys[1] != "0x61 false" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestFramebufferUpdate_Partial(t *testing.T) {
+	c := &vncConsole{requests: make(chan struct{}, 1)}
+	c.resize(2, 2)
+
+	// A 2x1 rectangle at (1, 1), hanging off the right of the screen
+	var message []byte
+	message = append(message, 0, 0, 1)
+	message = append(message, 0, 1, 0, 1, 0, 2, 0, 1, 0, 0, 0, 0)
+	message = append(message, blue.B, blue.G, blue.R, 0, red.B, red.G, red.R, 0)
+	if _, err := (&framebufferUpdate{c}).Read(nil, bytes.NewReader(message)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	screen, _ := c.Screen()
+	if screen.RGBAAt(1, 1) != blue || screen.RGBAAt(0, 1) != (color.RGBA{}) || screen.RGBAAt(0, 0) != (color.RGBA{}) {
+		t.Fatalf("unexpected screen %v", screen.Pix)
+	}
+	if c.changes != 1 {
+		t.Fatalf("expected a change, got %d", c.changes)
+	}
+
+	// An encoding the console didn't ask for
+	message = []byte{0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 5}
+	if _, err := (&framebufferUpdate{c}).Read(nil, bytes.NewReader(message)); err == nil {
+		t.Fatal("an unknown encoding should be an error")
+	}
+}
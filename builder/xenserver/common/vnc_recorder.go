@@ -0,0 +1,149 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+ * vncRecorder watches a VM's console over a shared VNC connection, so it
+ * doesn't get in the way of typing boot commands, and saves what it sees:
+ * a PNG frame every interval in which the screen changed, and a log of
+ * when each frame was taken and of the connection coming and going. The
+ * console goes away while the VM reboots, so the recorder keeps trying to
+ * reconnect until it's stopped.
+ */
+
+// Console recordings are saved in this directory under the output
+// directory, which is kept when the build fails.
+const recordingDir = "vnc-recording"
+
+const recordingLog = "recording.log"
+
+type vncRecorder struct {
+	address  string
+	dir      string
+	interval time.Duration
+
+	log    *os.File
+	start  time.Time
+	frames int
+
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// startVNCRecorder starts recording the console at address into dir.
+func startVNCRecorder(address, dir string, interval time.Duration) (*vncRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	logFile, err := os.Create(filepath.Join(dir, recordingLog))
+	if err != nil {
+		return nil, err
+	}
+
+	self := &vncRecorder{
+		address:  address,
+		dir:      dir,
+		interval: interval,
+		log:      logFile,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go self.record()
+	return self, nil
+}
+
+// Stop stops the recording, once it's saved its last frame, and returns
+// how many frames it saved.
+func (self *vncRecorder) Stop() int {
+	self.stopOnce.Do(func() {
+		close(self.stop)
+		<-self.stopped
+		self.note("Stopped recording")
+		self.log.Close()
+	})
+	return self.frames
+}
+
+func (self *vncRecorder) record() {
+	defer close(self.stopped)
+
+	var console *vncConsole
+	defer func() {
+		if console != nil {
+			console.Close()
+		}
+	}()
+
+	changes := 0
+	var lastErr string
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+
+	for {
+		var dropped <-chan struct{}
+		if console == nil {
+			c, err := dialVNCConsole(self.address, false)
+			if err == nil {
+				console, changes, lastErr = c, 0, ""
+				self.note(fmt.Sprintf("Connected to the console: %s", c.DesktopName()))
+			} else if err.Error() != lastErr {
+				// Only noted once, while the VM's console is away
+				lastErr = err.Error()
+				self.note(fmt.Sprintf("Unable to connect to the console: %s", err))
+			}
+		}
+		if console != nil {
+			dropped = console.Dropped()
+		}
+
+		select {
+		case <-self.stop:
+			if console != nil {
+				self.frame(console, &changes)
+			}
+			return
+		case <-dropped:
+			self.note(fmt.Sprintf("Lost the console: %s", console.Err()))
+			console.Close()
+			console = nil
+		case <-ticker.C:
+			if console != nil {
+				self.frame(console, &changes)
+			}
+		}
+	}
+}
+
+// frame saves the screen if it's changed since the last frame.
+func (self *vncRecorder) frame(console *vncConsole, changes *int) {
+	screen, latest := console.changedScreen(*changes)
+	if screen == nil {
+		return
+	}
+	*changes = latest
+
+	name := fmt.Sprintf("frame-%05d.png", self.frames+1)
+	if err := writePNG(filepath.Join(self.dir, name), screen); err != nil {
+		log.Printf("Error saving VNC recording frame: %s", err)
+		return
+	}
+	self.frames++
+	self.note(name)
+}
+
+// note adds a line to the log, with the time since the recording started.
+func (self *vncRecorder) note(message string) {
+	elapsed := time.Since(self.start).Round(100 * time.Millisecond)
+	if _, err := fmt.Fprintf(self.log, "%10s %s\n", elapsed, message); err != nil {
+		log.Printf("Error writing VNC recording log: %s", err)
+	}
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForLog waits for the recording log to say something.
+func waitForLog(t *testing.T, dir, text string, count int) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, recordingLog))
+		if strings.Count(string(contents), text) >= count {
+			return string(contents)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d of %q in the log, got:\n%s", count, text, contents)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVNCRecorder(t *testing.T) {
+	defer func(timeout time.Duration) { updateTimeout = timeout }(updateTimeout)
+	updateTimeout = 100 * time.Millisecond
+
+	server := newFakeVNCServer(t, 4, 3, red)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "packer-recording")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder, err := startVNCRecorder(server.Address(), dir, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer recorder.Stop()
+
+	waitForLog(t, dir, "Connected to the console: fake", 1)
+	waitForLog(t, dir, "frame-00001.png", 1)
+
+	// Frames are only saved when the screen changes
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "frame-00002.png")); !os.IsNotExist(err) {
+		t.Fatalf("the screen hasn't changed: %v", err)
+	}
+	server.Paint(4, 3, blue)
+	waitForLog(t, dir, "frame-00002.png", 1)
+
+	// The recording carries on after the connection's lost
+	server.Drop()
+	waitForLog(t, dir, "Lost the console", 1)
+	waitForLog(t, dir, "Connected to the console: fake", 2)
+	waitForLog(t, dir, "frame-00003.png", 1)
+
+	if frames := recorder.Stop(); frames != 3 {
+		t.Fatalf("expected 3 frames, got %d", frames)
+	}
+	waitForLog(t, dir, "Stopped recording", 1)
+	for _, name := range []string{"frame-00001.png", "frame-00002.png", "frame-00003.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
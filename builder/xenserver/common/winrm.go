@@ -0,0 +1,19 @@
+package common
+
+import (
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/helper/communicator"
+)
+
+func InstanceWinRMPort(state multistep.StateBag) (uint, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	return uint(config.Comm.WinRMPort), nil
+}
+
+func WinRMConfigFunc(state multistep.StateBag) (*communicator.WinRMConfig, error) {
+	config := state.Get("commonconfig").(CommonConfig)
+	return &communicator.WinRMConfig{
+		Username: config.Comm.WinRMUser,
+		Password: config.Comm.WinRMPassword,
+	}, nil
+}
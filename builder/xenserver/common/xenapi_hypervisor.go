@@ -0,0 +1,666 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/nilshell/xmlrpc"
+	xsclient "github.com/xenserver/go-xenserver-client"
+)
+
+// XenAPIHypervisor implements Hypervisor on top of go-xenserver-client.
+type XenAPIHypervisor struct {
+	client    *xsclient.XenAPIClient
+	protocol  string
+	transport *http.Transport
+}
+
+var _ Hypervisor = (*XenAPIHypervisor)(nil)
+
+// NewXenAPIHypervisor creates a client for the given host. protocol is
+// "xmlrpc" or "jsonrpc"; an empty protocol means XML-RPC. XAPI calls and
+// HTTP transfers all go over HTTPS using tlsConfig, see
+// CommonConfig.TLSConfig.
+func NewXenAPIHypervisor(host, username, password, protocol string, tlsConfig *tls.Config) *XenAPIHypervisor {
+	if protocol == "" {
+		protocol = "xmlrpc"
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+
+	client := xsclient.NewXenAPIClient(host, username, password)
+	client.Url = "https://" + host
+	client.RPC, _ = xmlrpc.NewClient(client.Url, transport)
+
+	return &XenAPIHypervisor{client: &client, protocol: protocol, transport: transport}
+}
+
+// Login establishes a session. If JSON-RPC was asked for but the host
+// doesn't offer it, we fall back to XML-RPC.
+func (self *XenAPIHypervisor) Login() error {
+	if self.protocol != "jsonrpc" {
+		return self.client.Login()
+	}
+
+	xmlrpcClient := self.client.RPC
+	self.client.RPC = newJSONRPCClient(self.client.Url, self.transport)
+
+	err := self.client.Login()
+	if _, ok := err.(errJSONRPCUnavailable); ok {
+		log.Printf("%s; falling back to XML-RPC", err.Error())
+		self.client.RPC.Close()
+		self.client.RPC = xmlrpcClient
+		self.protocol = "xmlrpc"
+		return self.client.Login()
+	}
+	return err
+}
+
+// Protocol returns the protocol in use, once Login has chosen one.
+func (self *XenAPIHypervisor) Protocol() string {
+	return self.protocol
+}
+
+// HTTPClient returns a client for the transfer URLs that verifies the host
+// the same way the XAPI connection does.
+func (self *XenAPIHypervisor) HTTPClient() *http.Client {
+	return &http.Client{Transport: self.transport}
+}
+
+func (self *XenAPIHypervisor) vm(ref string) *xsclient.VM {
+	return &xsclient.VM{Ref: ref, Client: self.client}
+}
+
+func (self *XenAPIHypervisor) vdi(ref string) *xsclient.VDI {
+	return &xsclient.VDI{Ref: ref, Client: self.client}
+}
+
+func (self *XenAPIHypervisor) sr(ref string) *xsclient.SR {
+	return &xsclient.SR{Ref: ref, Client: self.client}
+}
+
+func (self *XenAPIHypervisor) network(ref string) *xsclient.Network {
+	return &xsclient.Network{Ref: ref, Client: self.client}
+}
+
+func (self *XenAPIHypervisor) host(ref string) *xsclient.Host {
+	return &xsclient.Host{Ref: ref, Client: self.client}
+}
+
+func (self *XenAPIHypervisor) task(ref string) *xsclient.Task {
+	return &xsclient.Task{Ref: ref, Client: self.client}
+}
+
+func (self *XenAPIHypervisor) vif(ref string) *xsclient.VIF {
+	return &xsclient.VIF{Ref: ref, Client: self.client}
+}
+
+// call makes a XAPI call the vendored client has no wrapper for.
+func (self *XenAPIHypervisor) call(method string, params ...interface{}) (interface{}, error) {
+	result := xsclient.APIResult{}
+	if err := self.client.APICall(&result, method, params...); err != nil {
+		return nil, err
+	}
+	return result.Value, nil
+}
+
+func (self *XenAPIHypervisor) callUint64(method string, params ...interface{}) (uint64, error) {
+	value, err := self.call(method, params...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(fmt.Sprintf("%v", value), 10, 64)
+}
+
+func vdiType(vdiType VDIType) xsclient.VDIType {
+	switch vdiType {
+	case CD:
+		return xsclient.CD
+	case Floppy:
+		return xsclient.Floppy
+	}
+	return xsclient.Disk
+}
+
+// Hosts
+
+func (self *XenAPIHypervisor) GetHosts() ([]string, error) {
+	hosts, err := self.client.GetHosts()
+	refs := make([]string, len(hosts))
+	for i, host := range hosts {
+		refs[i] = host.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) GetHostAddress(host string) (string, error) {
+	return self.host(host).GetAddress()
+}
+
+func (self *XenAPIHypervisor) GetHostSoftwareVersion(host string) (map[string]interface{}, error) {
+	return self.host(host).GetSoftwareVersion()
+}
+
+func (self *XenAPIHypervisor) GetHostByUuid(uuid string) (string, error) {
+	host, err := self.client.GetHostByUuid(uuid)
+	if err != nil {
+		return "", err
+	}
+	return host.Ref, nil
+}
+
+func (self *XenAPIHypervisor) GetHostByNameLabel(name string) ([]string, error) {
+	hosts, err := self.client.GetHostByNameLabel(name)
+	refs := make([]string, len(hosts))
+	for i, host := range hosts {
+		refs[i] = host.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) GetHostNameLabel(host string) (string, error) {
+	value, err := self.call("host.get_name_label", host)
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (self *XenAPIHypervisor) GetHostEnabled(host string) (bool, error) {
+	value, err := self.call("host.get_enabled", host)
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+// GetHostLive and GetHostMemoryFree read the host's metrics object, which
+// xapi refreshes every few seconds.
+func (self *XenAPIHypervisor) GetHostLive(host string) (bool, error) {
+	metrics, err := self.call("host.get_metrics", host)
+	if err != nil {
+		return false, err
+	}
+	value, err := self.call("host_metrics.get_live", metrics)
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+func (self *XenAPIHypervisor) GetHostMemoryFree(host string) (uint64, error) {
+	metrics, err := self.call("host.get_metrics", host)
+	if err != nil {
+		return 0, err
+	}
+	return self.callUint64("host_metrics.get_memory_free", metrics)
+}
+
+// VM lookup and lifecycle
+
+func (self *XenAPIHypervisor) GetVMByUuid(uuid string) (string, error) {
+	vm, err := self.client.GetVMByUuid(uuid)
+	if err != nil {
+		return "", err
+	}
+	return vm.Ref, nil
+}
+
+func (self *XenAPIHypervisor) GetVMByNameLabel(name string) ([]string, error) {
+	vms, err := self.client.GetVMByNameLabel(name)
+	refs := make([]string, len(vms))
+	for i, vm := range vms {
+		refs[i] = vm.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) GetVMUuid(vm string) (string, error) {
+	return self.vm(vm).GetUuid()
+}
+
+func (self *XenAPIHypervisor) CloneVM(vm, name string) (string, error) {
+	clone, err := self.vm(vm).Clone(name)
+	if err != nil {
+		return "", err
+	}
+	return clone.Ref, nil
+}
+
+func (self *XenAPIHypervisor) CopyVM(vm, name, sr string) (string, error) {
+	copy, err := self.vm(vm).Copy(name, self.sr(sr))
+	if err != nil {
+		return "", err
+	}
+	return copy.Ref, nil
+}
+
+func (self *XenAPIHypervisor) SnapshotVM(vm, name string) (string, error) {
+	snapshot, err := self.vm(vm).Snapshot(name)
+	if err != nil {
+		return "", err
+	}
+	return snapshot.Ref, nil
+}
+
+func (self *XenAPIHypervisor) DestroyVM(vm string) error {
+	return self.vm(vm).Destroy()
+}
+
+func (self *XenAPIHypervisor) StartVM(vm string, paused, force bool) error {
+	return self.vm(vm).Start(paused, force)
+}
+
+func (self *XenAPIHypervisor) StartVMOn(vm, host string, paused, force bool) error {
+	return self.vm(vm).StartOn(self.host(host), paused, force)
+}
+
+func (self *XenAPIHypervisor) CleanShutdownVM(vm string) error {
+	return self.vm(vm).CleanShutdown()
+}
+
+func (self *XenAPIHypervisor) HardShutdownVM(vm string) error {
+	return self.vm(vm).HardShutdown()
+}
+
+func (self *XenAPIHypervisor) UnpauseVM(vm string) error {
+	return self.vm(vm).Unpause()
+}
+
+func (self *XenAPIHypervisor) ResumeVM(vm string, paused, force bool) error {
+	return self.vm(vm).Resume(paused, force)
+}
+
+// VM properties
+
+func (self *XenAPIHypervisor) GetVMPowerState(vm string) (string, error) {
+	return self.vm(vm).GetPowerState()
+}
+
+func (self *XenAPIHypervisor) GetVMDomainId(vm string) (string, error) {
+	return self.vm(vm).GetDomainId()
+}
+
+func (self *XenAPIHypervisor) GetVMResidentOn(vm string) (string, error) {
+	host, err := self.vm(vm).GetResidentOn()
+	if err != nil {
+		return "", err
+	}
+	return host.Ref, nil
+}
+
+func (self *XenAPIHypervisor) GetVMMemoryStaticMax(vm string) (uint64, error) {
+	return self.callUint64("VM.get_memory_static_max", vm)
+}
+
+func (self *XenAPIHypervisor) GetVMPossibleHosts(vm string) ([]string, error) {
+	value, err := self.call("VM.get_possible_hosts", vm)
+	if err != nil {
+		return nil, err
+	}
+	hosts, _ := value.([]interface{})
+	refs := make([]string, len(hosts))
+	for i, host := range hosts {
+		refs[i] = fmt.Sprintf("%v", host)
+	}
+	return refs, nil
+}
+
+func (self *XenAPIHypervisor) GetVMVCpuMax(vm string) (uint, error) {
+	vcpus, err := self.callUint64("VM.get_VCPUs_max", vm)
+	return uint(vcpus), err
+}
+
+func (self *XenAPIHypervisor) GetVMHVMBootPolicy(vm string) (string, error) {
+	return self.vm(vm).GetHVMBootPolicy()
+}
+
+// GetVMGuestNetworks returns the networks reported by the guest tools, e.g.
+// "0/ip", or nil if the tools aren't running.
+func (self *XenAPIHypervisor) GetVMGuestNetworks(vm string) (map[string]string, error) {
+	metrics, err := self.vm(vm).GetGuestMetrics()
+	if err != nil || metrics == nil {
+		return nil, err
+	}
+
+	networks := make(map[string]string)
+	if raw, ok := metrics["networks"].(xmlrpc.Struct); ok {
+		for k, v := range raw {
+			networks[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	return networks, nil
+}
+
+func (self *XenAPIHypervisor) SetVMIsATemplate(vm string, isATemplate bool) error {
+	return self.vm(vm).SetIsATemplate(isATemplate)
+}
+
+func (self *XenAPIHypervisor) SetVMStaticMemoryRange(vm string, min, max uint64) error {
+	return self.vm(vm).SetStaticMemoryRange(min, max)
+}
+
+func (self *XenAPIHypervisor) SetVMPlatform(vm string, params map[string]string) error {
+	return self.vm(vm).SetPlatform(params)
+}
+
+func (self *XenAPIHypervisor) SetVMVCpuMax(vm string, vcpus uint) error {
+	return self.vm(vm).SetVCpuMax(vcpus)
+}
+
+func (self *XenAPIHypervisor) SetVMVCpuAtStartup(vm string, vcpus uint) error {
+	return self.vm(vm).SetVCpuAtStartup(vcpus)
+}
+
+func (self *XenAPIHypervisor) SetVMDescription(vm, description string) error {
+	return self.vm(vm).SetDescription(description)
+}
+
+func (self *XenAPIHypervisor) SetVMHVMBoot(vm, policy, bootOrder string) error {
+	return self.vm(vm).SetHVMBoot(policy, bootOrder)
+}
+
+// VM devices
+
+func (self *XenAPIHypervisor) GetVMDisks(vm string) ([]string, error) {
+	vdis, err := self.vm(vm).GetDisks()
+	refs := make([]string, len(vdis))
+	for i, vdi := range vdis {
+		refs[i] = vdi.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) GetVMVIFs(vm string) ([]string, error) {
+	vifs, err := self.vm(vm).GetVIFs()
+	refs := make([]string, len(vifs))
+	for i, vif := range vifs {
+		refs[i] = vif.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) ConnectVdi(vm, vdi string, t VDIType, userdevice string) error {
+	return self.vm(vm).ConnectVdi(self.vdi(vdi), vdiType(t), userdevice)
+}
+
+func (self *XenAPIHypervisor) DisconnectVdi(vm, vdi string) error {
+	return self.vm(vm).DisconnectVdi(self.vdi(vdi))
+}
+
+func (self *XenAPIHypervisor) ConnectNetwork(vm, network, device string) (string, error) {
+	vif, err := self.vm(vm).ConnectNetwork(self.network(network), device)
+	if err != nil {
+		return "", err
+	}
+	return vif.Ref, nil
+}
+
+func (self *XenAPIHypervisor) GetVIFNetwork(vif string) (string, error) {
+	network, err := self.vif(vif).GetNetwork()
+	if err != nil {
+		return "", err
+	}
+	return network.Ref, nil
+}
+
+func (self *XenAPIHypervisor) DestroyVIF(vif string) error {
+	return self.vif(vif).Destroy()
+}
+
+// Storage
+
+func (self *XenAPIHypervisor) GetDefaultSR() (string, error) {
+	sr, err := self.client.GetDefaultSR()
+	if err != nil {
+		return "", err
+	}
+	return sr.Ref, nil
+}
+
+func (self *XenAPIHypervisor) GetSRByNameLabel(name string) ([]string, error) {
+	srs, err := self.client.GetSRByNameLabel(name)
+	refs := make([]string, len(srs))
+	for i, sr := range srs {
+		refs[i] = sr.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) GetSRUuid(sr string) (string, error) {
+	return self.sr(sr).GetUuid()
+}
+
+func (self *XenAPIHypervisor) CreateVdi(sr, name string, size int64) (string, error) {
+	vdi, err := self.sr(sr).CreateVdi(name, size)
+	if err != nil {
+		return "", err
+	}
+	return vdi.Ref, nil
+}
+
+func (self *XenAPIHypervisor) GetVdiByUuid(uuid string) (string, error) {
+	vdi, err := self.client.GetVdiByUuid(uuid)
+	if err != nil {
+		return "", err
+	}
+	return vdi.Ref, nil
+}
+
+func (self *XenAPIHypervisor) GetVdiByNameLabel(name string) ([]string, error) {
+	vdis, err := self.client.GetVdiByNameLabel(name)
+	refs := make([]string, len(vdis))
+	for i, vdi := range vdis {
+		refs[i] = vdi.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) GetVdiUuid(vdi string) (string, error) {
+	return self.vdi(vdi).GetUuid()
+}
+
+func (self *XenAPIHypervisor) GetVdiVirtualSize(vdi string) (string, error) {
+	return self.vdi(vdi).GetVirtualSize()
+}
+
+func (self *XenAPIHypervisor) GetVdiNameLabel(vdi string) (string, error) {
+	value, err := self.call("VDI.get_name_label", vdi)
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (self *XenAPIHypervisor) GetVdiSMConfig(vdi string) (map[string]string, error) {
+	value, err := self.call("VDI.get_sm_config", vdi)
+	if err != nil {
+		return nil, err
+	}
+	smConfig := make(map[string]string)
+	if raw, ok := value.(xmlrpc.Struct); ok {
+		for k, v := range raw {
+			smConfig[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	return smConfig, nil
+}
+
+func (self *XenAPIHypervisor) DestroyVdi(vdi string) error {
+	return self.vdi(vdi).Destroy()
+}
+
+func (self *XenAPIHypervisor) ExposeVdi(vdi, format string) (string, error) {
+	return self.vdi(vdi).Expose(format)
+}
+
+func (self *XenAPIHypervisor) UnexposeVdi(vdi string) error {
+	return self.vdi(vdi).Unexpose()
+}
+
+// Networks
+
+// GetManagementNetwork returns the network of the management PIF.
+func (self *XenAPIHypervisor) GetManagementNetwork() (string, error) {
+	pifs, err := self.client.GetPIFs()
+	if err != nil {
+		return "", fmt.Errorf("Error getting PIFs: %s", err.Error())
+	}
+
+	for _, pif := range pifs {
+		pif_rec, err := pif.GetRecord()
+		if err != nil {
+			return "", fmt.Errorf("Error getting PIF record: %s", err.Error())
+		}
+
+		if pif_rec["management"].(bool) {
+			return pif_rec["network"].(string), nil
+		}
+	}
+
+	return "", errors.New("couldn't find management network")
+}
+
+func (self *XenAPIHypervisor) GetNetworkNameLabel(network string) (string, error) {
+	value, err := self.call("network.get_name_label", network)
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+func (self *XenAPIHypervisor) GetNetworkByNameLabel(name string) ([]string, error) {
+	networks, err := self.client.GetNetworkByNameLabel(name)
+	refs := make([]string, len(networks))
+	for i, network := range networks {
+		refs[i] = network.Ref
+	}
+	return refs, err
+}
+
+func (self *XenAPIHypervisor) GetNetworkAssignedIPs(network string) (map[string]string, error) {
+	return self.network(network).GetAssignedIPs()
+}
+
+func (self *XenAPIHypervisor) CreateNetwork(name, description, bridge string) (string, error) {
+	network, err := self.client.CreateNetwork(name, description, bridge)
+	if err != nil {
+		return "", err
+	}
+	return network.Ref, nil
+}
+
+func (self *XenAPIHypervisor) DestroyNetwork(network string) error {
+	return self.network(network).Destroy()
+}
+
+// Tasks
+
+func (self *XenAPIHypervisor) CreateTask() (string, error) {
+	task, err := self.client.CreateTask()
+	if err != nil {
+		return "", err
+	}
+	return task.Ref, nil
+}
+
+func (self *XenAPIHypervisor) DestroyTask(task string) error {
+	return self.task(task).Destroy()
+}
+
+func (self *XenAPIHypervisor) CancelTask(task string) error {
+	_, err := self.call("task.cancel", task)
+	return err
+}
+
+func (self *XenAPIHypervisor) GetTaskStatus(task string) (TaskStatus, error) {
+	status, err := self.task(task).GetStatus()
+	if err != nil {
+		return 0, err
+	}
+
+	switch status {
+	case xsclient.Pending:
+		return TaskPending, nil
+	case xsclient.Success:
+		return TaskSuccess, nil
+	case xsclient.Failure:
+		return TaskFailure, nil
+	case xsclient.Cancelling:
+		return TaskCancelling, nil
+	case xsclient.Cancelled:
+		return TaskCancelled, nil
+	}
+	return 0, fmt.Errorf("Unknown task status %v", status)
+}
+
+func (self *XenAPIHypervisor) GetTaskProgress(task string) (float64, error) {
+	return self.task(task).GetProgress()
+}
+
+func (self *XenAPIHypervisor) GetTaskErrorInfo(task string) ([]string, error) {
+	return self.task(task).GetErrorInfo()
+}
+
+// GetTaskResult returns the reference the task produced, or "" if it
+// produced none.
+func (self *XenAPIHypervisor) GetTaskResult(task string) (string, error) {
+	result, err := self.task(task).GetResult()
+	if err != nil || result == nil {
+		return "", err
+	}
+	return result.Ref, nil
+}
+
+// HTTP transfers
+
+func (self *XenAPIHypervisor) ImportURL(sr string) string {
+	return fmt.Sprintf("https://%s/import?session_id=%s&sr_id=%s",
+		self.client.Host,
+		self.client.Session.(string),
+		sr,
+	)
+}
+
+func (self *XenAPIHypervisor) ImportRawVdiURL(vdi string) string {
+	return fmt.Sprintf("https://%s/import_raw_vdi?vdi=%s&session_id=%s",
+		self.client.Host,
+		vdi,
+		self.client.Session.(string),
+	)
+}
+
+func (self *XenAPIHypervisor) ExportURL(vmUuid string) string {
+	return fmt.Sprintf("https://%s/export?uuid=%s&session_id=%s",
+		self.client.Host,
+		vmUuid,
+		self.client.Session.(string),
+	)
+}
+
+// ExportRawVdiURL uses basic auth, as XAPI doesn't accept a session token
+// for export_raw_vdi. An empty format exports the raw disk.
+func (self *XenAPIHypervisor) ExportRawVdiURL(vdiUuid, format string) string {
+	url := fmt.Sprintf("https://%s:%s@%s/export_raw_vdi?vdi=%s",
+		self.client.Username,
+		self.client.Password,
+		self.client.Host,
+		vdiUuid,
+	)
+	if format != "" {
+		url += "&format=" + format
+	}
+	return url
+}
+
+// ExportDifferencingVdiURL exports only what's changed since baseUuid, as a
+// differencing VHD.
+func (self *XenAPIHypervisor) ExportDifferencingVdiURL(vdiUuid, baseUuid string) string {
+	return self.ExportRawVdiURL(vdiUuid, "vhd") + "&base=" + baseUuid
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+func TestXenAPIHypervisor_JSONRPC(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	client := NewXenAPIHypervisor(server.Host(), server.Username, server.Password, "jsonrpc", server.TLSConfig())
+	if err := client.Login(); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+	if client.Protocol() != "jsonrpc" {
+		t.Fatalf("expected to be using jsonrpc, got %s", client.Protocol())
+	}
+
+	vms, err := client.GetVMByNameLabel("Other install media")
+	if err != nil || len(vms) != 1 {
+		t.Fatalf("bad template lookup: %v %s", vms, err)
+	}
+	instance, err := client.CloneVM(vms[0], "packer-test")
+	if err != nil {
+		t.Fatalf("CloneVM failed: %s", err)
+	}
+	if err := client.SetVMIsATemplate(instance, false); err != nil {
+		t.Fatalf("SetVMIsATemplate failed: %s", err)
+	}
+	if err := client.StartVM(instance, false, false); err != nil {
+		t.Fatalf("StartVM failed: %s", err)
+	}
+	if state, _ := client.GetVMPowerState(instance); state != "Running" {
+		t.Fatalf("expected the VM to be Running, got %s", state)
+	}
+
+	// XAPI failures come back as errors, just as over XML-RPC
+	if err := client.StartVM(instance, false, false); err == nil {
+		t.Fatal("expected starting a running VM to fail")
+	}
+
+	task, err := client.CreateTask()
+	if err != nil {
+		t.Fatalf("CreateTask failed: %s", err)
+	}
+	if progress, err := client.GetTaskProgress(task); err != nil || progress != 0 {
+		t.Fatalf("bad task progress: %v %s", progress, err)
+	}
+
+	for _, call := range server.Calls() {
+		if call == "VM.start" {
+			return
+		}
+	}
+	t.Fatal("the server didn't see the VM.start call")
+}
+
+func TestXenAPIHypervisor_JSONRPCFallback(t *testing.T) {
+	server := xapitest.NewServer()
+	server.JSONRPC = false
+	defer server.Close()
+
+	client := NewXenAPIHypervisor(server.Host(), server.Username, server.Password, "jsonrpc", server.TLSConfig())
+	if err := client.Login(); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+	if client.Protocol() != "xmlrpc" {
+		t.Fatalf("expected to fall back to xmlrpc, got %s", client.Protocol())
+	}
+	if _, err := client.GetDefaultSR(); err != nil {
+		t.Fatalf("GetDefaultSR failed: %s", err)
+	}
+}
+
+func TestXenAPIHypervisor_JSONRPCBadCredentials(t *testing.T) {
+	server := xapitest.NewServer()
+	defer server.Close()
+
+	client := NewXenAPIHypervisor(server.Host(), server.Username, "wrong", "jsonrpc", server.TLSConfig())
+	if err := client.Login(); err == nil {
+		t.Fatal("expected login with a bad password to fail")
+	}
+	if client.Protocol() != "jsonrpc" {
+		t.Fatalf("a failed login shouldn't fall back, got %s", client.Protocol())
+	}
+}
@@ -13,7 +13,6 @@ import (
 	hconfig "github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
-	xsclient "github.com/xenserver/go-xenserver-client"
 	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
 )
 
@@ -146,6 +145,11 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
 		}
 	}
 
+	if self.config.Format == "vhd" && self.config.VHDExport == "nfs" && self.config.NfsMount == "" {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("You must specify nfs_mount when vhd_export is 'nfs'"))
+	}
+
 	if len(errs.Errors) > 0 {
 		retErr = errors.New(errs.Error())
 	}
@@ -156,13 +160,17 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
 
 func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
 	//Setup XAPI client
-	client := xsclient.NewXenAPIClient(self.config.HostIp, self.config.Username, self.config.Password)
+	tlsConfig, err := self.config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := xscommon.NewXenAPIHypervisor(self.config.HostIp, self.config.Username, self.config.Password, self.config.XAPIProtocol, tlsConfig)
 
-	err := client.Login()
+	err = client.Login()
 	if err != nil {
 		return nil, err.(error)
 	}
-	ui.Say("XAPI client session established")
+	ui.Say(fmt.Sprintf("XAPI client session established over %s", client.Protocol()))
 
 	client.GetHosts()
 
@@ -179,6 +187,7 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 
 	//Build the steps
 	steps := []multistep.Step{
+		new(xscommon.StepConnectHostSSH),
 		&xscommon.StepPrepareOutputDir{
 			Force: self.config.PackerForce,
 			Path:  self.config.OutputDir,
@@ -221,11 +230,11 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 		new(stepCreateInstance),
 		&xscommon.StepAttachVdi{
 			VdiUuidKey: "floppy_vdi_uuid",
-			VdiType:    xsclient.Floppy,
+			VdiType:    xscommon.Floppy,
 		},
 		&xscommon.StepAttachVdi{
 			VdiUuidKey: "iso_vdi_uuid",
-			VdiType:    xsclient.CD,
+			VdiType:    xscommon.CD,
 		},
 		new(xscommon.StepStartVmPaused),
 		new(xscommon.StepGetVNCPort),
@@ -236,17 +245,19 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			HostPortMax: self.config.HostPortMax,
 			ResultKey:   "local_vnc_port",
 		},
+		new(xscommon.StepStartVNCRecording),
 		new(xscommon.StepBootWait),
 		&xscommon.StepTypeBootCommand{
 			Ctx: self.config.ctx,
 		},
 		new(xscommon.StepWaitForShutdown),
+		new(xscommon.StepStopVNCRecording),
 		&xscommon.StepDetachVdi{
 			VdiUuidKey: "iso_vdi_uuid",
 		},
 		&xscommon.StepAttachVdi{
 			VdiUuidKey: "tools_vdi_uuid",
-			VdiType:    xsclient.CD,
+			VdiType:    xscommon.CD,
 		},
 		new(xscommon.StepStartVmPaused),
 		new(xscommon.StepBootWait),
@@ -255,17 +266,20 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			Timeout: self.config.InstallTimeout, // @todo change this
 		},
 		&xscommon.StepForwardPortOverSSH{
-			RemotePort:  xscommon.InstanceSSHPort,
+			RemotePort:  xscommon.InstanceCommPort,
 			RemoteDest:  xscommon.InstanceSSHIP,
 			HostPortMin: self.config.HostPortMin,
 			HostPortMax: self.config.HostPortMax,
-			ResultKey:   "local_ssh_port",
+			ResultKey:   "local_comm_port",
+
+			SkipInDirectMode: true,
 		},
 		&communicator.StepConnect{
-			Config:    &self.config.SSHConfig.Comm,
-			Host:      xscommon.CommHost,
-			SSHConfig: xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
-			SSHPort:   xscommon.SSHPort,
+			Config:      &self.config.SSHConfig.Comm,
+			Host:        xscommon.CommHost,
+			SSHConfig:   xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
+			SSHPort:     xscommon.CommPort,
+			WinRMConfig: xscommon.WinRMConfigFunc,
 		},
 		new(xscommon.StepShutdown),
 		&xscommon.StepDetachVdi{
@@ -278,22 +292,25 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			Timeout: self.config.InstallTimeout, // @todo change this
 		},
 		&xscommon.StepForwardPortOverSSH{
-			RemotePort:  xscommon.InstanceSSHPort,
+			RemotePort:  xscommon.InstanceCommPort,
 			RemoteDest:  xscommon.InstanceSSHIP,
 			HostPortMin: self.config.HostPortMin,
 			HostPortMax: self.config.HostPortMax,
-			ResultKey:   "local_ssh_port",
+			ResultKey:   "local_comm_port",
+
+			SkipInDirectMode: true,
 		},
 		/*&common.StepConnectSSH{
 			SSHAddress:     xscommon.SSHLocalAddress,
 			SSHConfig:      xscommon.SSHConfig,
 			SSHWaitTimeout: self.config.SSHWaitTimeout,
 		},*/
-		&communicator.StepConnectSSH{
-			Config:    &self.config.SSHConfig.Comm,
-			Host:      xscommon.CommHost,
-			SSHConfig: xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
-			SSHPort:   xscommon.SSHPort,
+		&communicator.StepConnect{
+			Config:      &self.config.SSHConfig.Comm,
+			Host:        xscommon.CommHost,
+			SSHConfig:   xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
+			SSHPort:     xscommon.CommPort,
+			WinRMConfig: xscommon.WinRMConfigFunc,
 		},
 		new(common.StepProvision),
 		new(xscommon.StepShutdown),
@@ -302,6 +319,9 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 		},
 		&xscommon.StepExport{
 			OutputFormat: self.config.Format,
+			VMMemory:     self.config.VMMemory,
+			VMVCpus:      self.config.VMVCpus,
+			VMDisks:      self.config.VMDisks,
 		},
 	}
 
@@ -333,6 +353,21 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 	artifactState["ramSize"] = fmt.Sprintf("%d", self.config.VMMemory)
 	artifactState["vm_name"] = self.config.VMName
 
+	artifactState["format"] = self.config.Format
+	if checksums, ok := state.GetOk("export_checksums"); ok {
+		artifactState["checksums"] = checksums
+	}
+	artifactState["compression"] = self.config.ExportCompression
+	if sizes, ok := state.GetOk("export_sizes"); ok {
+		artifactState["sizes"] = sizes
+	}
+	if sizes, ok := state.GetOk("export_allocated_sizes"); ok {
+		artifactState["allocated_sizes"] = sizes
+	}
+	if sizes, ok := state.GetOk("export_virtual_sizes"); ok {
+		artifactState["virtual_sizes"] = sizes
+	}
+
 	artifact, _ := xscommon.NewArtifact(self.config.OutputDir, artifactState, state.Get("export_files").([]string))
 
 	return artifact, nil
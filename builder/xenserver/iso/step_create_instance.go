@@ -6,17 +6,17 @@ import (
 
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
+	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
 )
 
 type stepCreateInstance struct {
-	instance *xsclient.VM
-	vdi      []*xsclient.VDI
+	instance string
+	vdi      []string
 }
 
 func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepAction {
 
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(xscommon.Hypervisor)
 	config := state.Get("config").(config)
 	ui := state.Get("ui").(packer.Ui)
 
@@ -38,44 +38,44 @@ func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepActi
 	template := vms[0]
 
 	// Clone that VM template
-	instance, err := template.Clone(config.VMName)
+	instance, err := client.CloneVM(template, config.VMName)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error cloning VM: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 	self.instance = instance
 
-	err = instance.SetIsATemplate(false)
+	err = client.SetVMIsATemplate(instance, false)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting is_a_template=false: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	err = instance.SetStaticMemoryRange(uint64(config.VMMemory*1024*1024), uint64(config.VMMemory*1024*1024))
+	err = client.SetVMStaticMemoryRange(instance, uint64(config.VMMemory*1024*1024), uint64(config.VMMemory*1024*1024))
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting VM memory=%d: %s", config.VMMemory*1024*1024, err.Error()))
 		return multistep.ActionHalt
 	}
 
-	instance.SetPlatform(config.PlatformArgs)
+	err = client.SetVMPlatform(instance, config.PlatformArgs)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting VM platform: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	instance.SetVCpuMax(config.VMVCpus)
+	err = client.SetVMVCpuMax(instance, config.VMVCpus)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting maximum vcpus: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	instance.SetVCpuAtStartup(config.VMVCpus)
+	err = client.SetVMVCpuAtStartup(instance, config.VMVCpus)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting startup vcpus: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	instance.SetDescription(config.VMDescription)
+	err = client.SetVMDescription(instance, config.VMDescription)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting VM description: %s", err.Error()))
 		return multistep.ActionHalt
@@ -94,14 +94,14 @@ func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepActi
 		diskname := values[0]
 		disksize, _ := strconv.Atoi(values[1])
 		ui.Say(fmt.Sprintf("Creating disk %s: %dMB", diskname, disksize))
-		vdi, err := sr.CreateVdi(diskname, int64(disksize*1024*1024))
+		vdi, err := client.CreateVdi(sr, diskname, int64(disksize*1024*1024))
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to create packer disk VDI: %s", err.Error()))
 			return multistep.ActionHalt
 		}
 		self.vdi = append(self.vdi, vdi)
 
-		err = instance.ConnectVdi(vdi, xsclient.Disk, "")
+		err = client.ConnectVdi(instance, vdi, xscommon.Disk, "")
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to connect packer disk VDI: %s", err.Error()))
 			return multistep.ActionHalt
@@ -109,37 +109,14 @@ func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepActi
 	}
 	// Connect Network
 
-	var network *xsclient.Network
+	var network string
 
 	if config.NetworkName == "" {
 		// No network has be specified. Use the management interface
-		network = new(xsclient.Network)
-		network.Ref = ""
-		network.Client = &client
-
-		pifs, err := client.GetPIFs()
+		network, err = client.GetManagementNetwork()
 
 		if err != nil {
-			ui.Error(fmt.Sprintf("Error getting PIFs: %s", err.Error()))
-			return multistep.ActionHalt
-		}
-
-		for _, pif := range pifs {
-			pif_rec, err := pif.GetRecord()
-
-			if err != nil {
-				ui.Error(fmt.Sprintf("Error getting PIF record: %s", err.Error()))
-				return multistep.ActionHalt
-			}
-
-			if pif_rec["management"].(bool) {
-				network.Ref = pif_rec["network"].(string)
-			}
-
-		}
-
-		if network.Ref == "" {
-			ui.Error("Error: couldn't find management network. Aborting.")
+			ui.Error(fmt.Sprintf("Error: %s. Aborting.", err.Error()))
 			return multistep.ActionHalt
 		}
 
@@ -168,13 +145,13 @@ func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepActi
 	if err != nil {
 		ui.Say(err.Error())
 	}
-	_, err = instance.ConnectNetwork(network, "0")
+	_, err = client.ConnectNetwork(instance, network, "0")
 
 	if err != nil {
 		ui.Say(err.Error())
 	}
 
-	instanceId, err := instance.GetUuid()
+	instanceId, err := client.GetVMUuid(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
 		return multistep.ActionHalt
@@ -183,7 +160,7 @@ func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepActi
 	state.Put("instance_uuid", instanceId)
 	ui.Say(fmt.Sprintf("Created instance '%s'", instanceId))
 
-	bootPolicy, err := instance.GetHVMBootPolicy()
+	bootPolicy, err := client.GetVMHVMBootPolicy(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to determine if VM is HVM or PV: %s", err.Error()))
 		return multistep.ActionHalt
@@ -192,7 +169,7 @@ func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepActi
 	state.Put("virtualization_type", bootPolicy)
 
 	for index, vdis := range self.vdi {
-		vdiId, err := vdis.GetUuid()
+		vdiId, err := client.GetVdiUuid(vdis)
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to get VM VDI UUID: %s", err.Error()))
 			return multistep.ActionHalt
@@ -202,7 +179,7 @@ func (self *stepCreateInstance) Run(state multistep.StateBag) multistep.StepActi
 		ui.Say(fmt.Sprintf("Attached vdi '%s'", vdiId))
 	}
 
-	srId, err := sr.GetUuid()
+	srId, err := client.GetSRUuid(sr)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VDI SR UUID: %s", err.Error()))
 		return multistep.ActionHalt
@@ -221,11 +198,12 @@ func (self *stepCreateInstance) Cleanup(state multistep.StateBag) {
 	}
 
 	ui := state.Get("ui").(packer.Ui)
+	client := state.Get("client").(xscommon.Hypervisor)
 
-	if self.instance != nil {
+	if self.instance != "" {
 		ui.Say("Destroying VM")
-		_ = self.instance.HardShutdown() // redundant, just in case
-		err := self.instance.Destroy()
+		_ = client.HardShutdownVM(self.instance) // redundant, just in case
+		err := client.DestroyVM(self.instance)
 		if err != nil {
 			ui.Error(err.Error())
 		}
@@ -235,7 +213,7 @@ func (self *stepCreateInstance) Cleanup(state multistep.StateBag) {
 	if self.vdi != nil {
 		ui.Say("Destroying VDI's")
 		for _, vdis := range self.vdi {
-			err := vdis.Destroy()
+			err := client.DestroyVdi(vdis)
 			if err != nil {
 				ui.Error(err.Error())
 			}
@@ -13,7 +13,6 @@ import (
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
 	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type config struct {
@@ -22,6 +21,7 @@ type config struct {
 
 	SourceVm 	string  `mapstructure:"source_vm"`
 	NfsMount	string	 `mapstructure:"nfs_mount"`
+	BaseVdiName	string	 `mapstructure:"base_vdi_name"`
 
 	ScriptUrl       string   `mapstructure:"script_url"`
 
@@ -72,6 +72,16 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
        
 	self.config.TemporaryVm = self.config.VMName + "_packer_snap"
 
+	if self.config.Format == "vhd" && self.config.VHDExport == "nfs" && self.config.NfsMount == "" {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("You must specify nfs_mount when vhd_export is 'nfs'"))
+	}
+
+	if self.config.BaseVdiName != "" && ((self.config.Format != "vhd" && self.config.Format != "vdi_vhd") || self.config.VHDExport != "http") {
+		errs = packer.MultiErrorAppend(
+			errs, errors.New("base_vdi_name can only be used with the 'vhd' and 'vdi_vhd' formats, exported over http"))
+	}
+
 	if len(errs.Errors) > 0 {
 		retErr = errors.New(errs.Error())
 	}
@@ -82,14 +92,18 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
 
 func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
 	//Setup XAPI client
-	client := xsclient.NewXenAPIClient(self.config.HostIp, self.config.Username, self.config.Password)
+	tlsConfig, err := self.config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := xscommon.NewXenAPIHypervisor(self.config.HostIp, self.config.Username, self.config.Password, self.config.XAPIProtocol, tlsConfig)
 	artifactState := make(map[string]interface{})
 
-	err := client.Login()
+	err = client.Login()
 	if err != nil {
 		return nil, err.(error)
 	}
-	ui.Say("XAPI client session established")
+	ui.Say(fmt.Sprintf("XAPI client session established over %s", client.Protocol()))
 
 	client.GetHosts()
 
@@ -107,6 +121,7 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 
 	//Build the steps
 	steps := []multistep.Step{
+		new(xscommon.StepConnectHostSSH),
 		&xscommon.StepPrepareOutputDir{
 			Force: self.config.PackerForce,
 			Path:  self.config.OutputDir,
@@ -114,6 +129,10 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 		&xscommon.StepPrepareNfsExport{
 			NfsMount: self.config.NfsMount,
 		},
+		&xscommon.StepFindVdi{
+			VdiName:    self.config.BaseVdiName,
+			VdiUuidKey: "base_vdi_uuid",
+		},
 		&xscommon.StepHTTPServer{
 			Chan: httpReqChan,
 		},
@@ -129,6 +148,7 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			HostPortMax: self.config.HostPortMax,
 			ResultKey:   "local_vnc_port",
 		},
+		new(xscommon.StepStartVNCRecording),
 		&stepCopyCleanScript{
 			ScriptUrl: self.config.ScriptUrl,
 		},
@@ -137,6 +157,7 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			Ctx: self.config.ctx,
 		},
 		new(xscommon.StepWaitForShutdown),
+		new(xscommon.StepStopVNCRecording),
 		new(stepRestoreNetwork),
 		new(xscommon.StepStartVm),
 		&xscommon.StepWaitForIP{
@@ -144,17 +165,20 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			Timeout: self.config.BootTimeout, // @todo change this
 		},
 		&xscommon.StepForwardPortOverSSH{ // do this again as could have new host and IP
-			RemotePort:  xscommon.InstanceSSHPort,
+			RemotePort:  xscommon.InstanceCommPort,
 			RemoteDest:  xscommon.InstanceSSHIP,
 			HostPortMin: self.config.HostPortMin,
 			HostPortMax: self.config.HostPortMax,
-			ResultKey:   "local_ssh_port",
+			ResultKey:   "local_comm_port",
+
+			SkipInDirectMode: true,
 		},
-		&communicator.StepConnectSSH{
-			Config:    &self.config.SSHConfig.Comm,
-			Host:      xscommon.CommHost,
-			SSHConfig: xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
-			SSHPort:   xscommon.SSHPort,
+		&communicator.StepConnect{
+			Config:      &self.config.SSHConfig.Comm,
+			Host:        xscommon.CommHost,
+			SSHConfig:   xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
+			SSHPort:     xscommon.CommPort,
+			WinRMConfig: xscommon.WinRMConfigFunc,
 		},
 		new(common.StepProvision),
 		new(xscommon.StepShutdown),
@@ -197,6 +221,25 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 
 	artifactState["vm_name"] = self.config.VMName
 
+	artifactState["format"] = self.config.Format
+	if checksums, ok := state.GetOk("export_checksums"); ok {
+		artifactState["checksums"] = checksums
+	}
+	artifactState["compression"] = self.config.ExportCompression
+	if sizes, ok := state.GetOk("export_sizes"); ok {
+		artifactState["sizes"] = sizes
+	}
+	if sizes, ok := state.GetOk("export_allocated_sizes"); ok {
+		artifactState["allocated_sizes"] = sizes
+	}
+	if sizes, ok := state.GetOk("export_virtual_sizes"); ok {
+		artifactState["virtual_sizes"] = sizes
+	}
+	if parents, ok := state.GetOk("export_parents"); ok {
+		artifactState["parent_vdis"] = parents
+	}
+	artifactState["base_vdi_name"] = self.config.BaseVdiName
+
 	artifact, _ := xscommon.NewArtifact(self.config.OutputDir, artifactState, state.Get("export_files").([]string))
 
 	return artifact, nil
@@ -5,7 +5,7 @@ import (
 
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
+	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
 )
 
 type stepRestoreNetwork struct {
@@ -14,7 +14,7 @@ type stepRestoreNetwork struct {
 
 func (self *stepRestoreNetwork) Run(state multistep.StateBag) multistep.StepAction {
 
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(xscommon.Hypervisor)
 	ui := state.Get("ui").(packer.Ui)
 
 	ui.Say("Step: Restoring network mapping")
@@ -27,11 +27,11 @@ func (self *stepRestoreNetwork) Run(state multistep.StateBag) multistep.StepActi
 		return multistep.ActionHalt
 	}
 
-	networks := state.Get("original_networks").([]*xsclient.Network)
+	networks := state.Get("original_networks").([]string)
 
 	ui.Message(fmt.Sprintf("Found %d networks to restore", len(networks)))
 
-	vifs, err := instance.GetVIFs ()
+	vifs, err := client.GetVMVIFs(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to obtain the list of VIFs: %s", err.Error()))
 		return multistep.ActionHalt
@@ -41,18 +41,18 @@ func (self *stepRestoreNetwork) Run(state multistep.StateBag) multistep.StepActi
 	for i := 0; i < len(networks); i++ {
 		network := networks[i]
 
-		if network == nil {
-			ui.Message (fmt.Sprintf ("Skipping restore of network %d due to nil pointer", i))
+		if network == "" {
+			ui.Message (fmt.Sprintf ("Skipping restore of network %d as it wasn't saved", i))
 			continue
 		}
 
-		err = vifs[i].Destroy()
+		err = client.DestroyVIF(vifs[i])
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to remove interface %d from VM: %s", i, err.Error()))
 			return multistep.ActionHalt
 		}
 
-		_, err = instance.ConnectNetwork(network, fmt.Sprintf("%d", i))
+		_, err = client.ConnectNetwork(instance, network, fmt.Sprintf("%d", i))
 
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to restore interface %d: %s", i, err.Error()))
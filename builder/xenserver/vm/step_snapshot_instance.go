@@ -6,19 +6,19 @@ import (
 
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	xsclient "github.com/xenserver/go-xenserver-client"
+	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
 )
 
 type stepSnapshotInstance struct {
-	instance 		*xsclient.VM
-	snapshot_instance 	*xsclient.VM
-	clone_instance 	*xsclient.VM
-	temp_network 		*xsclient.Network
+	instance 		string
+	snapshot_instance 	string
+	clone_instance 	string
+	temp_network 		string
 }
 
 func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAction {
 
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(xscommon.Hypervisor)
 	config := state.Get("config").(config)
 	ui := state.Get("ui").(packer.Ui)
 
@@ -39,7 +39,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 
 	vm := vms[0]
 
-	runningInstanceId, err := vm.GetUuid()
+	runningInstanceId, err := client.GetVMUuid(vm)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
 		return multistep.ActionHalt
@@ -48,7 +48,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 	ui.Message(fmt.Sprintf("Performing snapshot of source VM '%s'", runningInstanceId))
 
 	// Create a running VM snapshot so we have something to work from
-	snapshot, err := vm.Snapshot(config.TemporaryVm)
+	snapshot, err := client.SnapshotVM(vm, config.TemporaryVm)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error performing snapshot of source VM: %s", err.Error()))
 		return multistep.ActionHalt
@@ -58,7 +58,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 
 	ui.Message("Creating template from snapshot")
 
-	clone, err := snapshot.Clone("packer-clone-" + config.SourceVm)
+	clone, err := client.CloneVM(snapshot, "packer-clone-" + config.SourceVm)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error creating a clone to templatize: %s", err.Error()))
 		return multistep.ActionHalt
@@ -74,7 +74,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 
 	ui.Message("Cloning template onto target storage")
 
-	instance, err := clone.Copy(config.VMName, sr)
+	instance, err := client.CopyVM(clone, config.VMName, sr)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error performing clone of template VM: %s", err.Error()))
 		return multistep.ActionHalt
@@ -83,7 +83,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 	self.instance = instance
 
 	// no longer want this to be a template
-	err = instance.SetIsATemplate(false)
+	err = client.SetVMIsATemplate(instance, false)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting is_a_template=false: %s", err.Error()))
 		return multistep.ActionHalt
@@ -92,25 +92,25 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 
 	ui.Message("Removing source template")
 
-	err = self.removeInstance ( self.clone_instance, ui )
+	err = self.removeInstance ( client, self.clone_instance, ui )
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error removing source template: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	self.clone_instance = nil
+	self.clone_instance = ""
 
 	ui.Message("Removing source snapshot")
-	err = self.removeInstance ( self.snapshot_instance, ui )
+	err = self.removeInstance ( client, self.snapshot_instance, ui )
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error removing snapshot: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	self.snapshot_instance = nil
+	self.snapshot_instance = ""
 
 	// now that we have a cleansed instance, lets make certain there is only one disk
-	vdis, err := instance.GetDisks()
+	vdis, err := client.GetVMDisks(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error getting list of disks: %s", err.Error()))
 		return multistep.ActionHalt
@@ -121,7 +121,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 		return multistep.ActionHalt
 	}
 
-	diskSizeString, err := vdis[0].GetVirtualSize()
+	diskSizeString, err := client.GetVdiVirtualSize(vdis[0])
 
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error determining disk size: %s", err.Error()))
@@ -146,20 +146,20 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 	}
 	self.temp_network = network 
 
-	vifs, err := instance.GetVIFs ()
+	vifs, err := client.GetVMVIFs(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to obtain the list of VIFs: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	networks := make([]*xsclient.Network, len(vifs))
+	networks := make([]string, len(vifs))
 
 	ui.Message(fmt.Sprintf("Saving %d networks", len(vifs)))
 
 	// save existing networks for later reinstall
 	for i := 0; i < len(vifs); i++ {
 
-		network, err := vifs[i].GetNetwork()
+		network, err := client.GetVIFNetwork(vifs[i])
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to locate network from vif %d: %s", i, err.Error()))
 			return multistep.ActionHalt
@@ -170,7 +170,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 
 
 	for i := 0; i < len(vifs); i++ {
-		err = vifs[i].Destroy()
+		err = client.DestroyVIF(vifs[i])
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to remove interface %d from VM: %s", i, err.Error()))
 			return multistep.ActionHalt
@@ -184,7 +184,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 			continue
 		}
 
-		_, err = instance.ConnectNetwork(self.temp_network, fmt.Sprintf("%d", i))
+		_, err = client.ConnectNetwork(instance, self.temp_network, fmt.Sprintf("%d", i))
 
 		if err != nil {
 			ui.Error(fmt.Sprintf("Unable to connect interface %d the temporary network: %s", i, err.Error()))
@@ -192,13 +192,13 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 		}
 	}
 
-	instanceId, err := instance.GetUuid()
+	instanceId, err := client.GetVMUuid(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 
-	bootOrder, err := instance.GetHVMBootPolicy()
+	bootOrder, err := client.GetVMHVMBootPolicy(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to determine if VM is HVM or PV: %s", err.Error()))
 		return multistep.ActionHalt
@@ -210,7 +210,7 @@ func (self *stepSnapshotInstance) Run(state multistep.StateBag) multistep.StepAc
 
 	ui.Say(fmt.Sprintf("Created instance '%s'", instanceId))
 
-	srId, err := sr.GetUuid()
+	srId, err := client.GetSRUuid(sr)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VDI SR UUID: %s", err.Error()))
 		return multistep.ActionHalt
@@ -229,25 +229,26 @@ func (self *stepSnapshotInstance) Cleanup(state multistep.StateBag) {
 	}
 
 	ui := state.Get("ui").(packer.Ui)
+	client := state.Get("client").(xscommon.Hypervisor)
 
-	err := self.removeInstance ( self.clone_instance, ui )
+	err := self.removeInstance ( client, self.clone_instance, ui )
 	if err != nil {
 		ui.Error(err.Error())
 	}
 
-	err = self.removeInstance ( self.snapshot_instance, ui )
+	err = self.removeInstance ( client, self.snapshot_instance, ui )
 	if err != nil {
 		ui.Error(err.Error())
 	}
 
-	err = self.removeInstance ( self.instance, ui )
+	err = self.removeInstance ( client, self.instance, ui )
 	if err != nil {
 		ui.Error(err.Error())
 	}
 
-	if self.temp_network != nil {
+	if self.temp_network != "" {
 		ui.Say("Destroying temporary network")
-		err := self.temp_network.Destroy()
+		err := client.DestroyNetwork(self.temp_network)
 		if err != nil {
 			ui.Error(err.Error())
 		}
@@ -255,30 +256,30 @@ func (self *stepSnapshotInstance) Cleanup(state multistep.StateBag) {
 
 }
 
-func (self *stepSnapshotInstance) removeInstance(instance *xsclient.VM, ui packer.Ui) (err error) {
+func (self *stepSnapshotInstance) removeInstance(client xscommon.Hypervisor, instance string, ui packer.Ui) (err error) {
 
-	if instance != nil {
-		uuid, _ := instance.GetUuid()
+	if instance != "" {
+		uuid, _ := client.GetVMUuid(instance)
 		ui.Message(fmt.Sprintf("Removing instance '%s'", uuid))
-		_ = instance.HardShutdown() // redundant, just in case
+		_ = client.HardShutdownVM(instance) // redundant, just in case
 
-		vdis, err := instance.GetDisks()
+		vdis, err := client.GetVMDisks(instance)
 		if err != nil {
 			return err
 		}		
 
 		for _, vdi := range vdis {
-			vdi_uuid, _ := vdi.GetUuid()
+			vdi_uuid, _ := client.GetVdiUuid(vdi)
 
 			ui.Message(fmt.Sprintf("Destroying vdi '%s'", vdi_uuid))		
-			err = vdi.Destroy()
+			err = client.DestroyVdi(vdi)
 			if err != nil {
 				return err
 			}
 		}
 
 		ui.Message(fmt.Sprintf("Destroying instance '%s'", uuid))
-		err = instance.Destroy()
+		err = client.DestroyVM(instance)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,91 @@
+package xapitest
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type jsonrpcCall struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     interface{}   `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int      `json:"code"`
+	Message string   `json:"message"`
+	Data    []string `json:"data"`
+}
+
+func (s *Server) serveJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if !s.JSONRPC {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var call jsonrpcCall
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&call); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := make([]interface{}, len(call.Params))
+	for i, p := range call.Params {
+		params[i] = fromJSON(p)
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, call.Method)
+	value, err := s.dispatch(call.Method, params)
+	s.mu.Unlock()
+
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": call.ID, "result": value}
+	if err != nil {
+		log.Printf("xapitest: %s failed: %s", call.Method, err)
+		failure, ok := err.(Failure)
+		if !ok {
+			failure = Failure{"INTERNAL_ERROR", err.Error()}
+		}
+		response = map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      call.ID,
+			"error":   jsonrpcError{Code: 1, Message: failure[0], Data: failure[1:]},
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// fromJSON turns decoded JSON into the same types decodeCall produces.
+func fromJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if !strings.ContainsAny(t.String(), ".eE") {
+			if i, err := t.Int64(); err == nil {
+				return i
+			}
+		}
+		f, _ := t.Float64()
+		return f
+	case []interface{}:
+		for i, elem := range t {
+			t[i] = fromJSON(elem)
+		}
+		return t
+	case map[string]interface{}:
+		for k, elem := range t {
+			t[k] = fromJSON(elem)
+		}
+		return t
+	}
+	return v
+}
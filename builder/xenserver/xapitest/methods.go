@@ -0,0 +1,400 @@
+package xapitest
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type handler struct {
+	args int
+	fn   func(params []interface{}) (interface{}, error)
+}
+
+// registerHandlers sets up the messages that need more than the generic
+// get_/set_/create/destroy treatment.
+func (s *Server) registerHandlers() {
+	s.handlers = map[string]handler{
+		"VM.clone":             {2, s.vmClone},
+		"VM.copy":              {3, s.vmCopy},
+		"VM.snapshot":          {2, s.vmSnapshot},
+		"VM.provision":         {1, s.vmNoop},
+		"VM.start":             {3, s.vmStart},
+		"VM.start_on":          {4, s.vmStartOn},
+		"VM.clean_shutdown":    {1, s.vmShutdown},
+		"VM.hard_shutdown":     {1, s.vmShutdown},
+		"VM.clean_reboot":      {1, s.vmReboot},
+		"VM.hard_reboot":       {1, s.vmReboot},
+		"VM.pause":             {1, s.vmPause},
+		"VM.unpause":           {1, s.vmUnpause},
+		"VM.suspend":           {1, s.vmSuspend},
+		"VM.resume":            {3, s.vmResume},
+		"VM.set_memory_limits": {5, s.vmSetMemoryLimits},
+		"VM.set_suspend_SR":    {2, s.vmSetSuspendSR},
+
+		"VM.get_allowed_VBD_devices": {1, s.vmAllowedDevices("VBDs", "userdevice")},
+		"VM.get_allowed_VIF_devices": {1, s.vmAllowedDevices("VIFs", "device")},
+		"VM.get_possible_hosts":      {1, s.vmPossibleHosts},
+
+		"VBD.plug":   {1, s.vbdSetAttached(true)},
+		"VBD.unplug": {1, s.vbdSetAttached(false)},
+		"VBD.eject":  {1, s.vbdEject},
+
+		"VDI.forget": {1, s.vdiForget},
+
+		"host.call_plugin": {4, s.hostCallPlugin},
+
+		"task.create": {2, s.taskCreate},
+		"task.cancel": {1, s.taskCancel},
+	}
+}
+
+func (s *Server) vm(ref interface{}) (*object, error) {
+	return s.lookup("VM", ref)
+}
+
+func badPowerState(ref interface{}, expected string, obj *object) error {
+	return Failure{"VM_BAD_POWER_STATE", fmt.Sprintf("%v", ref), expected, obj.record["power_state"].(string)}
+}
+
+// cloneVM copies a VM along with its devices. Disks are duplicated into sr
+// (or the source disk's own SR if sr is empty); CDs and floppies share the
+// original VDI.
+func (s *Server) cloneVM(src *object, name, sr string, snapshot bool) string {
+	rec := copyRecord(src.record)
+	delete(rec, "uuid")
+	rec["name_label"] = name
+	rec["power_state"] = "Halted"
+	rec["domid"] = "-1"
+	rec["resident_on"] = nullRef
+	rec["guest_metrics"] = nullRef
+	rec["VBDs"] = []string{}
+	rec["VIFs"] = []string{}
+	if snapshot {
+		rec["is_a_snapshot"] = true
+		rec["is_a_template"] = true
+	}
+	ref := s.create("VM", rec)
+
+	for _, vbdRef := range src.record["VBDs"].([]string) {
+		vbd := copyRecord(s.objects[vbdRef].record)
+		delete(vbd, "uuid")
+		vbd["VM"] = ref
+		vbd["currently_attached"] = false
+
+		if vdi, ok := s.objects[vbd["VDI"].(string)]; ok && vbd["type"] == "Disk" {
+			disk := copyRecord(vdi.record)
+			delete(disk, "uuid")
+			disk["VBDs"] = []string{}
+			if sr != "" {
+				disk["SR"] = sr
+			}
+			diskRef := s.create("VDI", disk)
+			if content, ok := s.contents[vbd["VDI"].(string)]; ok {
+				s.contents[diskRef] = append([]byte{}, content...)
+			}
+			vbd["VDI"] = diskRef
+		}
+		s.create("VBD", vbd)
+	}
+
+	for _, vifRef := range src.record["VIFs"].([]string) {
+		vif := copyRecord(s.objects[vifRef].record)
+		delete(vif, "uuid")
+		vif["VM"] = ref
+		s.create("VIF", vif)
+	}
+
+	return ref
+}
+
+func (s *Server) vmClone(params []interface{}) (interface{}, error) {
+	src, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	return s.cloneVM(src, fmt.Sprintf("%v", params[1]), "", false), nil
+}
+
+func (s *Server) vmCopy(params []interface{}) (interface{}, error) {
+	src, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.lookup("SR", params[2]); err != nil {
+		return nil, err
+	}
+	return s.cloneVM(src, fmt.Sprintf("%v", params[1]), params[2].(string), false), nil
+}
+
+func (s *Server) vmSnapshot(params []interface{}) (interface{}, error) {
+	src, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	ref := s.cloneVM(src, fmt.Sprintf("%v", params[1]), "", true)
+	s.objects[ref].record["snapshot_of"] = params[0].(string)
+	return ref, nil
+}
+
+func (s *Server) vmNoop(params []interface{}) (interface{}, error) {
+	_, err := s.vm(params[0])
+	return "", err
+}
+
+func (s *Server) boot(obj *object, host string, paused bool) {
+	s.nextDomid++
+	obj.record["domid"] = strconv.Itoa(s.nextDomid)
+	obj.record["resident_on"] = host
+	if paused {
+		obj.record["power_state"] = "Paused"
+	} else {
+		obj.record["power_state"] = "Running"
+	}
+}
+
+func (s *Server) vmStart(params []interface{}) (interface{}, error) {
+	return s.vmStartOn([]interface{}{params[0], s.HostRef, params[1], params[2]})
+}
+
+func (s *Server) vmStartOn(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.lookup("host", params[1]); err != nil {
+		return nil, err
+	}
+	if obj.record["is_a_template"] == true {
+		return nil, Failure{"VM_IS_TEMPLATE", params[0].(string)}
+	}
+	if obj.record["power_state"] != "Halted" {
+		return nil, badPowerState(params[0], "Halted", obj)
+	}
+	paused, _ := params[2].(bool)
+	s.boot(obj, params[1].(string), paused)
+	return "", nil
+}
+
+func (s *Server) vmShutdown(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if obj.record["power_state"] == "Halted" {
+		return nil, badPowerState(params[0], "Running", obj)
+	}
+	obj.record["power_state"] = "Halted"
+	obj.record["domid"] = "-1"
+	obj.record["resident_on"] = nullRef
+	return "", nil
+}
+
+func (s *Server) vmReboot(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if obj.record["power_state"] != "Running" {
+		return nil, badPowerState(params[0], "Running", obj)
+	}
+	s.boot(obj, obj.record["resident_on"].(string), false)
+	return "", nil
+}
+
+func (s *Server) vmPause(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if obj.record["power_state"] != "Running" {
+		return nil, badPowerState(params[0], "Running", obj)
+	}
+	obj.record["power_state"] = "Paused"
+	return "", nil
+}
+
+func (s *Server) vmUnpause(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if obj.record["power_state"] != "Paused" {
+		return nil, badPowerState(params[0], "Paused", obj)
+	}
+	obj.record["power_state"] = "Running"
+	return "", nil
+}
+
+func (s *Server) vmSuspend(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if obj.record["power_state"] != "Running" {
+		return nil, badPowerState(params[0], "Running", obj)
+	}
+	obj.record["power_state"] = "Suspended"
+	obj.record["domid"] = "-1"
+	return "", nil
+}
+
+func (s *Server) vmResume(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if obj.record["power_state"] != "Suspended" {
+		return nil, badPowerState(params[0], "Suspended", obj)
+	}
+	paused, _ := params[1].(bool)
+	s.boot(obj, obj.record["resident_on"].(string), paused)
+	return "", nil
+}
+
+func (s *Server) vmSetMemoryLimits(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range []string{"memory_static_min", "memory_static_max", "memory_dynamic_min", "memory_dynamic_max"} {
+		obj.record[field] = fmt.Sprintf("%v", params[i+1])
+	}
+	return "", nil
+}
+
+func (s *Server) vmSetSuspendSR(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+	obj.record["suspend_SR"] = fmt.Sprintf("%v", params[1])
+	return "", nil
+}
+
+func (s *Server) vmAllowedDevices(field, deviceField string) func([]interface{}) (interface{}, error) {
+	return func(params []interface{}) (interface{}, error) {
+		obj, err := s.vm(params[0])
+		if err != nil {
+			return nil, err
+		}
+		used := make(map[string]bool)
+		for _, ref := range obj.record[field].([]string) {
+			used[s.objects[ref].record[deviceField].(string)] = true
+		}
+		devices := make([]string, 0)
+		for i := 0; i < 16; i++ {
+			if d := strconv.Itoa(i); !used[d] {
+				devices = append(devices, d)
+			}
+		}
+		return devices, nil
+	}
+}
+
+// vmPossibleHosts returns the hosts that can see every SR the VM has a disk
+// in. An SR with no PBDs is taken to be shared by the whole pool, as the
+// seeded SRs are.
+func (s *Server) vmPossibleHosts(params []interface{}) (interface{}, error) {
+	obj, err := s.vm(params[0])
+	if err != nil {
+		return nil, err
+	}
+
+	possible := make(map[string]bool)
+	for ref, host := range s.objects {
+		if host.class == "host" {
+			possible[ref] = true
+		}
+	}
+	for _, vbd := range obj.record["VBDs"].([]string) {
+		vdi, ok := s.objects[s.objects[vbd].record["VDI"].(string)]
+		if !ok {
+			continue
+		}
+		sr, ok := s.objects[vdi.record["SR"].(string)]
+		if !ok || len(sr.record["PBDs"].([]string)) == 0 {
+			continue
+		}
+		attached := make(map[string]bool)
+		for _, pbd := range sr.record["PBDs"].([]string) {
+			if s.objects[pbd].record["currently_attached"] == true {
+				attached[s.objects[pbd].record["host"].(string)] = true
+			}
+		}
+		for host := range possible {
+			if !attached[host] {
+				delete(possible, host)
+			}
+		}
+	}
+
+	hosts := make([]string, 0, len(possible))
+	for host := range possible {
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func (s *Server) vbdSetAttached(attached bool) func([]interface{}) (interface{}, error) {
+	return func(params []interface{}) (interface{}, error) {
+		obj, err := s.lookup("VBD", params[0])
+		if err != nil {
+			return nil, err
+		}
+		if obj.record["currently_attached"] == attached {
+			if attached {
+				return nil, Failure{"DEVICE_ALREADY_ATTACHED", params[0].(string)}
+			}
+			return nil, Failure{"DEVICE_ALREADY_DETACHED", params[0].(string)}
+		}
+		obj.record["currently_attached"] = attached
+		return "", nil
+	}
+}
+
+func (s *Server) vbdEject(params []interface{}) (interface{}, error) {
+	obj, err := s.lookup("VBD", params[0])
+	if err != nil {
+		return nil, err
+	}
+	if obj.record["type"] != "CD" {
+		return nil, Failure{"VBD_NOT_REMOVABLE_MEDIA", params[0].(string)}
+	}
+	obj.record["empty"] = true
+	obj.record["VDI"] = nullRef
+	return "", nil
+}
+
+func (s *Server) vdiForget(params []interface{}) (interface{}, error) {
+	if _, err := s.lookup("VDI", params[0]); err != nil {
+		return nil, err
+	}
+	s.destroy(params[0].(string))
+	return "", nil
+}
+
+func (s *Server) hostCallPlugin(params []interface{}) (interface{}, error) {
+	if _, err := s.lookup("host", params[0]); err != nil {
+		return nil, err
+	}
+	return nil, Failure{"XENAPI_MISSING_PLUGIN", fmt.Sprintf("%v", params[1])}
+}
+
+func (s *Server) taskCreate(params []interface{}) (interface{}, error) {
+	return s.create("task", map[string]interface{}{
+		"name_label":       params[0],
+		"name_description": params[1],
+	}), nil
+}
+
+func (s *Server) taskCancel(params []interface{}) (interface{}, error) {
+	task, err := s.lookup("task", params[0])
+	if err != nil {
+		return nil, err
+	}
+	if task.record["status"] != "pending" {
+		return nil, Failure{"OPERATION_NOT_ALLOWED", "the task has already finished"}
+	}
+	task.record["status"] = "cancelled"
+	return "", nil
+}
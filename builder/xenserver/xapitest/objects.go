@@ -0,0 +1,386 @@
+package xapitest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const nullRef = "OpaqueRef:NULL"
+
+// Failure is a XAPI error description, e.g. ["HANDLE_INVALID", "VM", ref].
+type Failure []string
+
+func (f Failure) Error() string {
+	return strings.Join(f, " ")
+}
+
+type object struct {
+	class  string
+	record map[string]interface{}
+}
+
+// defaults holds the fields every new object of a class starts with, so the
+// generic getters have something to return.
+func defaults(class string) map[string]interface{} {
+	switch class {
+	case "VM":
+		return map[string]interface{}{
+			"name_label":          "",
+			"name_description":    "",
+			"power_state":         "Halted",
+			"is_a_template":       false,
+			"is_a_snapshot":       false,
+			"domid":               "-1",
+			"resident_on":         nullRef,
+			"VBDs":                []string{},
+			"VIFs":                []string{},
+			"HVM_boot_policy":     "",
+			"HVM_boot_params":     map[string]interface{}{},
+			"PV_bootloader":       "",
+			"PV_bootloader_args":  "",
+			"platform":            map[string]interface{}{},
+			"other_config":        map[string]interface{}{},
+			"memory_static_min":   "0",
+			"memory_static_max":   "0",
+			"memory_dynamic_min":  "0",
+			"memory_dynamic_max":  "0",
+			"VCPUs_max":           "1",
+			"VCPUs_at_startup":    "1",
+			"guest_metrics":       nullRef,
+			"suspend_SR":          nullRef,
+			"ha_always_run":       false,
+			"snapshot_of":         nullRef,
+			"affinity":            nullRef,
+			"allowed_operations":  []string{},
+			"current_operations":  map[string]interface{}{},
+			"blocked_operations":  map[string]interface{}{},
+			"user_version":        "1",
+			"is_control_domain":   false,
+			"ha_restart_priority": "",
+		}
+	case "VDI":
+		return map[string]interface{}{
+			"name_label":       "",
+			"name_description": "",
+			"SR":               nullRef,
+			"VBDs":             []string{},
+			"virtual_size":     "0",
+			"type":             "user",
+			"sharable":         false,
+			"read_only":        false,
+			"sm_config":        map[string]interface{}{},
+			"other_config":     map[string]interface{}{},
+		}
+	case "SR":
+		return map[string]interface{}{
+			"name_label":       "",
+			"name_description": "",
+			"type":             "ext",
+			"content_type":     "user",
+			"VDIs":             []string{},
+			"PBDs":             []string{},
+			"other_config":     map[string]interface{}{},
+		}
+	case "PBD":
+		return map[string]interface{}{
+			"SR":                 nullRef,
+			"host":               nullRef,
+			"device_config":      map[string]interface{}{},
+			"currently_attached": true,
+			"other_config":       map[string]interface{}{},
+		}
+	case "VBD":
+		return map[string]interface{}{
+			"VM":                   nullRef,
+			"VDI":                  nullRef,
+			"userdevice":           "",
+			"type":                 "Disk",
+			"mode":                 "RW",
+			"bootable":             false,
+			"unpluggable":          true,
+			"empty":                false,
+			"currently_attached":   false,
+			"other_config":         map[string]interface{}{},
+			"qos_algorithm_type":   "",
+			"qos_algorithm_params": map[string]interface{}{},
+		}
+	case "VIF":
+		return map[string]interface{}{
+			"VM":                   nullRef,
+			"network":              nullRef,
+			"device":               "",
+			"MAC":                  "",
+			"MTU":                  "1500",
+			"MAC_autogenerated":    true,
+			"locking_mode":         "network_default",
+			"other_config":         map[string]interface{}{},
+			"qos_algorithm_type":   "",
+			"qos_algorithm_params": map[string]interface{}{},
+		}
+	case "network":
+		return map[string]interface{}{
+			"name_label":       "",
+			"name_description": "",
+			"bridge":           "",
+			"VIFs":             []string{},
+			"PIFs":             []string{},
+			"other_config":     map[string]interface{}{},
+			"assigned_ips":     map[string]interface{}{},
+		}
+	case "PIF":
+		return map[string]interface{}{
+			"device":     "eth0",
+			"network":    nullRef,
+			"host":       nullRef,
+			"management": false,
+		}
+	case "host":
+		return map[string]interface{}{
+			"name_label":       "",
+			"name_description": "",
+			"address":          "",
+			"software_version": map[string]interface{}{},
+			"resident_VMs":     []string{},
+			"PIFs":             []string{},
+			"PBDs":             []string{},
+			"enabled":          true,
+			"metrics":          nullRef,
+			"other_config":     map[string]interface{}{},
+		}
+	case "host_metrics":
+		return map[string]interface{}{
+			"live":         true,
+			"memory_total": "0",
+			"memory_free":  "0",
+			"other_config": map[string]interface{}{},
+		}
+	case "pool":
+		return map[string]interface{}{
+			"name_label":   "",
+			"master":       nullRef,
+			"default_SR":   nullRef,
+			"other_config": map[string]interface{}{},
+		}
+	case "task":
+		return map[string]interface{}{
+			"name_label":       "",
+			"name_description": "",
+			"status":           "pending",
+			"progress":         0.0,
+			"result":           "",
+			"error_info":       []string{},
+		}
+	case "VM_guest_metrics":
+		return map[string]interface{}{
+			"networks":     map[string]interface{}{},
+			"os_version":   map[string]interface{}{},
+			"other_config": map[string]interface{}{},
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// links describes the reference fields that have an inverse set on the
+// referenced object, e.g. VBD.VM <-> VM.VBDs.
+var links = map[string]map[string]string{
+	"VBD": {"VM": "VBDs", "VDI": "VBDs"},
+	"VIF": {"VM": "VIFs", "network": "VIFs"},
+	"VDI": {"SR": "VDIs"},
+	"PIF": {"network": "PIFs", "host": "PIFs"},
+	"PBD": {"SR": "PBDs", "host": "PBDs"},
+}
+
+// create adds an object of the given class, filling in any fields missing
+// from rec with the class defaults. The caller must hold s.mu.
+func (s *Server) create(class string, rec map[string]interface{}) string {
+	s.nextRef++
+	ref := fmt.Sprintf("OpaqueRef:%s-%d", strings.ToLower(class), s.nextRef)
+
+	record := defaults(class)
+	for k, v := range rec {
+		record[k] = normalise(v)
+	}
+	if _, ok := rec["uuid"]; !ok {
+		record["uuid"] = fmt.Sprintf("%08x-0000-4000-8000-%012x", s.nextRef, s.nextRef)
+	}
+
+	s.objects[ref] = &object{class: class, record: record}
+
+	for field, inverse := range links[class] {
+		if target, ok := s.objects[record[field].(string)]; ok {
+			target.record[inverse] = append(target.record[inverse].([]string), ref)
+		}
+	}
+
+	return ref
+}
+
+// destroy removes an object and unlinks it from anything that refers to it.
+// The caller must hold s.mu.
+func (s *Server) destroy(ref string) {
+	obj := s.objects[ref]
+	for field, inverse := range links[obj.class] {
+		if target, ok := s.objects[obj.record[field].(string)]; ok {
+			target.record[inverse] = without(target.record[inverse].([]string), ref)
+		}
+	}
+
+	// A VM takes its VBDs and VIFs with it, but not the VDIs behind them
+	if obj.class == "VM" {
+		for _, field := range []string{"VBDs", "VIFs"} {
+			for _, child := range obj.record[field].([]string) {
+				if _, ok := s.objects[child]; ok {
+					s.destroy(child)
+				}
+			}
+		}
+	}
+
+	delete(s.objects, ref)
+	delete(s.contents, ref)
+}
+
+// normalise turns decoded XML-RPC values into the types the object model
+// stores: arrays of references become []string.
+func normalise(v interface{}) interface{} {
+	if a, ok := v.([]interface{}); ok {
+		refs := make([]string, 0, len(a))
+		for _, elem := range a {
+			str, ok := elem.(string)
+			if !ok {
+				return v
+			}
+			refs = append(refs, str)
+		}
+		return refs
+	}
+	return v
+}
+
+func without(refs []string, ref string) []string {
+	out := make([]string, 0, len(refs))
+	for _, r := range refs {
+		if r != ref {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func copyRecord(rec map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(rec))
+	for k, v := range rec {
+		switch t := v.(type) {
+		case []string:
+			out[k] = append([]string{}, t...)
+		case map[string]interface{}:
+			out[k] = copyRecord(t)
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// lookup returns the object behind ref, checking it is of the expected class.
+func (s *Server) lookup(class string, ref interface{}) (*object, error) {
+	str, _ := ref.(string)
+	obj, ok := s.objects[str]
+	if !ok || obj.class != class {
+		return nil, Failure{"HANDLE_INVALID", class, str}
+	}
+	return obj, nil
+}
+
+// call dispatches a XAPI method. The session has already been validated and
+// stripped from params. The caller must hold s.mu.
+func (s *Server) call(method string, params []interface{}) (interface{}, error) {
+	dot := strings.Index(method, ".")
+	if dot < 0 {
+		return nil, Failure{"MESSAGE_METHOD_UNKNOWN", method}
+	}
+	class, name := method[:dot], method[dot+1:]
+
+	if handler, ok := s.handlers[method]; ok {
+		if len(params) < handler.args {
+			return nil, Failure{"MESSAGE_PARAMETER_COUNT_MISMATCH", method, strconv.Itoa(handler.args), strconv.Itoa(len(params))}
+		}
+		return handler.fn(params)
+	}
+
+	// Everything else is one of the generic per-class messages
+	switch {
+	case name == "get_all":
+		refs := make([]string, 0)
+		for ref, obj := range s.objects {
+			if obj.class == class {
+				refs = append(refs, ref)
+			}
+		}
+		return refs, nil
+
+	case name == "get_by_uuid" && len(params) == 1:
+		for ref, obj := range s.objects {
+			if obj.class == class && obj.record["uuid"] == params[0] {
+				return ref, nil
+			}
+		}
+		return nil, Failure{"UUID_INVALID", class, fmt.Sprintf("%v", params[0])}
+
+	case name == "get_by_name_label" && len(params) == 1:
+		refs := make([]string, 0)
+		for ref, obj := range s.objects {
+			if obj.class == class && obj.record["name_label"] == params[0] {
+				refs = append(refs, ref)
+			}
+		}
+		return refs, nil
+
+	case name == "create" && len(params) == 1:
+		rec, ok := params[0].(map[string]interface{})
+		if !ok {
+			return nil, Failure{"FIELD_TYPE_ERROR", "args"}
+		}
+		return s.create(class, rec), nil
+
+	case name == "destroy" && len(params) == 1:
+		if _, err := s.lookup(class, params[0]); err != nil {
+			return nil, err
+		}
+		s.destroy(params[0].(string))
+		return "", nil
+
+	case name == "get_record" && len(params) == 1:
+		obj, err := s.lookup(class, params[0])
+		if err != nil {
+			return nil, err
+		}
+		return copyRecord(obj.record), nil
+
+	case strings.HasPrefix(name, "get_") && len(params) == 1:
+		obj, err := s.lookup(class, params[0])
+		if err != nil {
+			return nil, err
+		}
+		value, ok := obj.record[name[len("get_"):]]
+		if !ok {
+			return nil, Failure{"MESSAGE_METHOD_UNKNOWN", method}
+		}
+		return value, nil
+
+	case strings.HasPrefix(name, "set_") && len(params) == 2:
+		obj, err := s.lookup(class, params[0])
+		if err != nil {
+			return nil, err
+		}
+		field := name[len("set_"):]
+		if _, ok := obj.record[field]; !ok {
+			return nil, Failure{"MESSAGE_METHOD_UNKNOWN", method}
+		}
+		obj.record[field] = normalise(params[1])
+		return "", nil
+	}
+
+	return nil, Failure{"MESSAGE_METHOD_UNKNOWN", method}
+}
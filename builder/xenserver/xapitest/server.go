@@ -0,0 +1,543 @@
+// Package xapitest provides an in-process stand-in for a XenServer host, so
+// the builders and their steps can be exercised without real hardware.
+//
+// The Server speaks enough XML-RPC (and JSON-RPC on /jsonrpc) to satisfy
+// go-xenserver-client and keeps an in-memory object model of VMs, VDIs, SRs,
+// PBDs, VBDs, VIFs, networks, PIFs, hosts, pools and tasks. It also serves
+// the /import, /export, /import_raw_vdi and /export_raw_vdi HTTP handlers
+// over TLS on the same address, just like XAPI does.
+package xapitest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultUsername = "root"
+	DefaultPassword = "xenroot"
+)
+
+// Server is a fake XAPI endpoint.
+type Server struct {
+	// Credentials accepted by session.login_with_password and by basic
+	// auth on the HTTP handlers.
+	Username string
+	Password string
+
+	// JSONRPC controls whether /jsonrpc is served, as it is on XenServer
+	// 7.0 and later. It defaults to true.
+	JSONRPC bool
+
+	// FailImports is the number of /import and /import_raw_vdi requests
+	// that fail with a 500 after reading the upload, leaving their task
+	// pending, before imports start to succeed.
+	FailImports int
+
+	// References to the objects every server starts with.
+	HostRef              string
+	PoolRef              string
+	LocalSRRef           string
+	ISOSRRef             string
+	ManagementNetworkRef string
+	HIMNRef              string
+	TemplateRef          string
+	ToolsVDIRef          string
+
+	srv      *httptest.Server
+	certs    *certificates
+	handlers map[string]handler
+
+	mu        sync.Mutex
+	nextRef   int
+	nextDomid int
+	objects   map[string]*object
+	sessions  map[string]bool
+	contents  map[string][]byte
+	calls     []string
+}
+
+// NewServer starts a fake XAPI server on a local port, populated with a
+// single-host pool that has a local SR, an ISO SR holding xs-tools.iso, a
+// management network and the "Other install media" template.
+func NewServer() *Server {
+	s := &Server{
+		Username: DefaultUsername,
+		Password: DefaultPassword,
+		JSONRPC:  true,
+		objects:  make(map[string]*object),
+		sessions: make(map[string]bool),
+		contents: make(map[string][]byte),
+	}
+	s.registerHandlers()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveRPC)
+	mux.HandleFunc("/jsonrpc", s.serveJSONRPC)
+	mux.HandleFunc("/import", s.serveImport)
+	mux.HandleFunc("/import_raw_vdi", s.serveImportRawVdi)
+	mux.HandleFunc("/export", s.serveExport)
+	mux.HandleFunc("/export_raw_vdi", s.serveExportRawVdi)
+
+	var err error
+	s.certs, err = newCertificates()
+	if err != nil {
+		panic(fmt.Sprintf("xapitest: unable to create certificate: %s", err))
+	}
+
+	s.srv = httptest.NewUnstartedServer(mux)
+	s.srv.Listener = &sniffListener{Listener: s.srv.Listener, config: s.certs.tlsConfig()}
+	s.srv.Start()
+
+	s.seed()
+	return s
+}
+
+func (s *Server) seed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.HostRef = s.addHost("xapitest", strings.Split(s.Host(), ":")[0], 8<<30)
+
+	s.LocalSRRef = s.create("SR", map[string]interface{}{
+		"name_label": "Local storage",
+		"type":       "ext",
+	})
+	s.ISOSRRef = s.create("SR", map[string]interface{}{
+		"name_label":   "XenServer Tools",
+		"type":         "iso",
+		"content_type": "iso",
+	})
+	s.ToolsVDIRef = s.create("VDI", map[string]interface{}{
+		"name_label": "xs-tools.iso",
+		"SR":         s.ISOSRRef,
+		"type":       "user",
+		"read_only":  true,
+	})
+
+	s.PoolRef = s.create("pool", map[string]interface{}{
+		"master":     s.HostRef,
+		"default_SR": s.LocalSRRef,
+	})
+
+	s.ManagementNetworkRef = s.create("network", map[string]interface{}{
+		"name_label": "Pool-wide network associated with eth0",
+		"bridge":     "xenbr0",
+	})
+	s.create("PIF", map[string]interface{}{
+		"network":    s.ManagementNetworkRef,
+		"host":       s.HostRef,
+		"management": true,
+	})
+	s.HIMNRef = s.create("network", map[string]interface{}{
+		"name_label":   "Host internal management network",
+		"bridge":       "xenapi",
+		"other_config": map[string]interface{}{"is_host_internal_management_network": "true"},
+	})
+
+	s.TemplateRef = s.create("VM", map[string]interface{}{
+		"name_label":    "Other install media",
+		"is_a_template": true,
+	})
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Host returns the host:port address to hand to xsclient.NewXenAPIClient.
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.srv.URL)
+	return u.Host
+}
+
+// Calls returns the XAPI methods invoked so far, in order.
+func (s *Server) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.calls...)
+}
+
+// Create adds an object of the given XAPI class and returns its reference.
+// Fields not given in rec take the class defaults.
+func (s *Server) Create(class string, rec map[string]interface{}) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.create(class, rec)
+}
+
+// AddHost adds another member to the pool, with memoryFree bytes of free
+// memory in its metrics.
+func (s *Server) AddHost(name, address string, memoryFree uint64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addHost(name, address, memoryFree)
+}
+
+func (s *Server) addHost(name, address string, memoryFree uint64) string {
+	metrics := s.create("host_metrics", map[string]interface{}{
+		"memory_total": strconv.FormatUint(16<<30, 10),
+		"memory_free":  strconv.FormatUint(memoryFree, 10),
+	})
+	return s.create("host", map[string]interface{}{
+		"name_label": name,
+		"address":    address,
+		"metrics":    metrics,
+		"software_version": map[string]interface{}{
+			"product_version": "7.0.0",
+			"product_brand":   "XenServer",
+			"xapi":            "1.9",
+		},
+	})
+}
+
+// Record returns a copy of the record behind ref, or nil if there is none.
+func (s *Server) Record(ref string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[ref]
+	if !ok {
+		return nil
+	}
+	return copyRecord(obj.record)
+}
+
+// Set changes a single field of the object behind ref.
+func (s *Server) Set(ref, field string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[ref].record[field] = value
+}
+
+// FindByNameLabel returns the references of all objects of class with the
+// given name_label, sorted for stable test output.
+func (s *Server) FindByNameLabel(class, name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs := make([]string, 0)
+	for ref, obj := range s.objects {
+		if obj.class == class && obj.record["name_label"] == name {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// FindByUuid returns the reference of the object of class with the given
+// UUID, or "" if there is none.
+func (s *Server) FindByUuid(class, uuid string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ref, obj := range s.objects {
+		if obj.class == class && obj.record["uuid"] == uuid {
+			return ref
+		}
+	}
+	return ""
+}
+
+// Content returns the bytes last uploaded to the VDI or VM behind ref.
+func (s *Server) Content(ref string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte{}, s.contents[ref]...)
+}
+
+// SetContent sets the bytes served when the VDI or VM behind ref is exported.
+func (s *Server) SetContent(ref string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contents[ref] = append([]byte{}, data...)
+}
+
+// SetGuestIP reports ip as the first address of the VM through its guest
+// metrics, as the XenServer tools would.
+func (s *Server) SetGuestIP(vmRef, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := s.create("VM_guest_metrics", map[string]interface{}{
+		"networks": map[string]interface{}{"0/ip": ip},
+	})
+	s.objects[vmRef].record["guest_metrics"] = metrics
+}
+
+func (s *Server) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "XML-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method, params, err := decodeCall(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, method)
+	value, err := s.dispatch(method, params)
+	s.mu.Unlock()
+
+	response := map[string]interface{}{"Status": "Success", "Value": value}
+	if err != nil {
+		log.Printf("xapitest: %s failed: %s", method, err)
+		failure, ok := err.(Failure)
+		if !ok {
+			failure = Failure{"INTERNAL_ERROR", err.Error()}
+		}
+		errorDescription := make([]interface{}, len(failure))
+		for i, f := range failure {
+			errorDescription[i] = f
+		}
+		response = map[string]interface{}{"Status": "Failure", "ErrorDescription": errorDescription}
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	encodeResponse(w, response)
+}
+
+// dispatch handles session management and passes everything else on to call.
+// The caller must hold s.mu.
+func (s *Server) dispatch(method string, params []interface{}) (interface{}, error) {
+	switch method {
+	case "session.login_with_password":
+		if len(params) < 2 || params[0] != s.Username || params[1] != s.Password {
+			return nil, Failure{"SESSION_AUTHENTICATION_FAILED", fmt.Sprintf("%v", params[0]), "Authentication failure"}
+		}
+		s.nextRef++
+		session := fmt.Sprintf("OpaqueRef:session-%d", s.nextRef)
+		s.sessions[session] = true
+		return session, nil
+	}
+
+	if len(params) == 0 {
+		return nil, Failure{"SESSION_INVALID", ""}
+	}
+	session, _ := params[0].(string)
+	if !s.sessions[session] {
+		return nil, Failure{"SESSION_INVALID", session}
+	}
+
+	if method == "session.logout" {
+		delete(s.sessions, session)
+		return "", nil
+	}
+
+	return s.call(method, params[1:])
+}
+
+// authorised checks the session_id query parameter, falling back to basic
+// auth as XAPI does for the export handlers.
+func (s *Server) authorised(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[r.URL.Query().Get("session_id")] {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && user == s.Username && pass == s.Password
+}
+
+// completeTask marks the task named in the request's task_id as finished.
+func (s *Server) completeTask(r *http.Request, result string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.objects[r.URL.Query().Get("task_id")]
+	if !ok || task.class != "task" {
+		return
+	}
+	task.record["progress"] = 1.0
+	if err != nil {
+		task.record["status"] = "failure"
+		task.record["error_info"] = []string{err.Error()}
+		return
+	}
+	task.record["status"] = "success"
+	task.record["result"] = result
+}
+
+// failImport reports whether this import should fail, counting down
+// FailImports.
+func (s *Server) failImport() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.FailImports <= 0 {
+		return false
+	}
+	s.FailImports--
+	return true
+}
+
+func (s *Server) serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "imports must be PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorised(r) {
+		http.Error(w, "unauthorised", http.StatusForbidden)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.completeTask(r, "", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.failImport() {
+		http.Error(w, "import failed", http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	sr := r.URL.Query().Get("sr_id")
+	if sr == "" {
+		sr = s.LocalSRRef
+	}
+	vm := s.create("VM", map[string]interface{}{
+		"name_label":      "imported",
+		"HVM_boot_policy": "BIOS order",
+	})
+	disk := s.create("VDI", map[string]interface{}{
+		"name_label":   "imported disk",
+		"SR":           sr,
+		"virtual_size": fmt.Sprintf("%d", len(data)),
+	})
+	s.create("VBD", map[string]interface{}{
+		"VM":         vm,
+		"VDI":        disk,
+		"userdevice": "0",
+		"type":       "Disk",
+	})
+	s.contents[vm] = data
+	s.mu.Unlock()
+
+	// XAPI double-encodes the result of an import task
+	s.completeTask(r, fmt.Sprintf("<value><array><data><value>%s</value></data></array></value>", vm), nil)
+}
+
+func (s *Server) serveImportRawVdi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "imports must be PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorised(r) {
+		http.Error(w, "unauthorised", http.StatusForbidden)
+		return
+	}
+
+	ref := s.vdiFromQuery(r)
+	if ref == "" {
+		http.Error(w, "no such VDI", http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.completeTask(r, "", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.failImport() {
+		http.Error(w, "import failed", http.StatusInternalServerError)
+		return
+	}
+
+	s.SetContent(ref, data)
+	s.completeTask(r, "", nil)
+}
+
+func (s *Server) serveExport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorised(r) {
+		http.Error(w, "unauthorised", http.StatusForbidden)
+		return
+	}
+
+	ref := s.FindByUuid("VM", r.URL.Query().Get("uuid"))
+	if ref == "" {
+		ref = r.URL.Query().Get("ref")
+	}
+	if !s.isA("VM", ref) {
+		http.Error(w, "no such VM", http.StatusNotFound)
+		return
+	}
+
+	s.serveContent(w, ref)
+}
+
+func (s *Server) serveExportRawVdi(w http.ResponseWriter, r *http.Request) {
+	if !s.authorised(r) {
+		http.Error(w, "unauthorised", http.StatusForbidden)
+		return
+	}
+
+	ref := s.vdiFromQuery(r)
+	if ref == "" {
+		http.Error(w, "no such VDI", http.StatusNotFound)
+		return
+	}
+
+	if base := r.URL.Query().Get("base"); base != "" {
+		baseRef := base
+		if !s.isA("VDI", base) {
+			baseRef = s.FindByUuid("VDI", base)
+		}
+		if baseRef == "" {
+			http.Error(w, "no such base VDI", http.StatusNotFound)
+			return
+		}
+		s.serveDifference(w, ref, baseRef)
+		return
+	}
+
+	s.serveContent(w, ref)
+}
+
+// serveDifference stands in for a differencing VHD: the VDI's content with
+// every byte that's the same in the base zeroed.
+func (s *Server) serveDifference(w http.ResponseWriter, ref, baseRef string) {
+	data := s.Content(ref)
+	base := s.Content(baseRef)
+	for i := range data {
+		if i < len(base) && data[i] == base[i] {
+			data[i] = 0
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.Write(data)
+}
+
+func (s *Server) isA(class, ref string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[ref]
+	return ok && obj.class == class
+}
+
+func (s *Server) serveContent(w http.ResponseWriter, ref string) {
+	data := s.Content(ref)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.Write(data)
+}
+
+// vdiFromQuery resolves the vdi query parameter, which XAPI accepts as
+// either a reference or a UUID.
+func (s *Server) vdiFromQuery(r *http.Request) string {
+	vdi := r.URL.Query().Get("vdi")
+	if s.isA("VDI", vdi) {
+		return vdi
+	}
+	return s.FindByUuid("VDI", vdi)
+}
@@ -0,0 +1,141 @@
+package xapitest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	xsclient "github.com/xenserver/go-xenserver-client"
+)
+
+func testClient(t *testing.T, s *Server) xsclient.XenAPIClient {
+	client := xsclient.NewXenAPIClient(s.Host(), s.Username, s.Password)
+	if err := client.Login(); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+	return client
+}
+
+func TestServer_LoginFailure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	client := xsclient.NewXenAPIClient(s.Host(), s.Username, "wrong")
+	if err := client.Login(); err == nil {
+		t.Fatal("expected login with a bad password to fail")
+	}
+}
+
+func TestServer_CloneAndStart(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := testClient(t, s)
+
+	templates, err := client.GetVMByNameLabel("Other install media")
+	if err != nil {
+		t.Fatalf("GetVMByNameLabel failed: %s", err)
+	}
+	if len(templates) != 1 || templates[0].Ref != s.TemplateRef {
+		t.Fatalf("unexpected templates: %#v", templates)
+	}
+
+	if err := templates[0].Start(false, false); err == nil {
+		t.Fatal("expected starting a template to fail")
+	}
+
+	instance, err := templates[0].Clone("packer-test")
+	if err != nil {
+		t.Fatalf("Clone failed: %s", err)
+	}
+	if err := instance.SetIsATemplate(false); err != nil {
+		t.Fatalf("SetIsATemplate failed: %s", err)
+	}
+	if err := instance.Start(false, false); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+
+	state, err := instance.GetPowerState()
+	if err != nil {
+		t.Fatalf("GetPowerState failed: %s", err)
+	}
+	if state != "Running" {
+		t.Fatalf("expected the VM to be Running, got %s", state)
+	}
+
+	if err := instance.Start(false, false); err == nil {
+		t.Fatal("expected starting a running VM to fail")
+	}
+}
+
+func TestServer_ConnectVdi(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := testClient(t, s)
+
+	sr, err := client.GetDefaultSR()
+	if err != nil {
+		t.Fatalf("GetDefaultSR failed: %s", err)
+	}
+	if sr.Ref != s.LocalSRRef {
+		t.Fatalf("expected the default SR to be %s, got %s", s.LocalSRRef, sr.Ref)
+	}
+
+	vdi, err := sr.CreateVdi("packer-disk", 1024)
+	if err != nil {
+		t.Fatalf("CreateVdi failed: %s", err)
+	}
+
+	vms, _ := client.GetVMByNameLabel("Other install media")
+	vm := vms[0]
+	if err := vm.ConnectVdi(vdi, xsclient.Disk, "0"); err != nil {
+		t.Fatalf("ConnectVdi failed: %s", err)
+	}
+	if vbds := s.Record(vdi.Ref)["VBDs"].([]string); len(vbds) != 1 {
+		t.Fatalf("expected the VDI to have one VBD, got %v", vbds)
+	}
+
+	if err := vm.DisconnectVdi(vdi); err != nil {
+		t.Fatalf("DisconnectVdi failed: %s", err)
+	}
+	if vbds := s.Record(vdi.Ref)["VBDs"].([]string); len(vbds) != 0 {
+		t.Fatalf("expected the VDI to have no VBDs, got %v", vbds)
+	}
+}
+
+func TestServer_RawVdiTransfer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	vdi := s.Create("VDI", map[string]interface{}{"SR": s.LocalSRRef})
+	uuid := s.Record(vdi)["uuid"].(string)
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	url := fmt.Sprintf("https://%s:%s@%s/import_raw_vdi?vdi=%s", s.Username, s.Password, s.Host(), uuid)
+	request, _ := http.NewRequest("PUT", url, bytes.NewBufferString("disk contents"))
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+	resp.Body.Close()
+
+	if got := string(s.Content(vdi)); got != "disk contents" {
+		t.Fatalf("unexpected VDI content: %q", got)
+	}
+
+	url = fmt.Sprintf("https://%s:%s@%s/export_raw_vdi?vdi=%s&format=raw", s.Username, s.Password, s.Host(), uuid)
+	resp, err = httpClient.Get(url)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if string(data) != "disk contents" {
+		t.Fatalf("unexpected download: %q", data)
+	}
+}
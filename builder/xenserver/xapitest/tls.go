@@ -0,0 +1,150 @@
+package xapitest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+type certificates struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newCertificates creates a self-signed certificate for 127.0.0.1, the way
+// a freshly installed XenServer host has one.
+func newCertificates() (*certificates, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xapitest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificates{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+func (c *certificates) tlsConfig() *tls.Config {
+	pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		panic(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{pair}}
+}
+
+// Certificate returns the server's self-signed TLS certificate.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.certs.cert
+}
+
+// CertificatePEM returns the server's TLS certificate in PEM form, suitable
+// for writing out as a CA file.
+func (s *Server) CertificatePEM() []byte {
+	return append([]byte{}, s.certs.certPEM...)
+}
+
+// TLSConfig returns a client configuration that trusts only the server's
+// certificate.
+func (s *Server) TLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.certs.cert)
+	return &tls.Config{RootCAs: pool}
+}
+
+// sniffListener serves plain HTTP and HTTPS on the same port, as XAPI does,
+// so clients may reach any handler over either.
+type sniffListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: conn, config: l.config}, nil
+}
+
+// sniffConn decides on its first read whether the peer is starting a TLS
+// handshake, and if so layers a TLS server over the connection.
+type sniffConn struct {
+	net.Conn
+	config *tls.Config
+
+	once  sync.Once
+	inner net.Conn
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *sniffConn) sniff() {
+	buffered := &bufferedConn{Conn: c.Conn, r: bufio.NewReader(c.Conn)}
+	c.inner = buffered
+
+	// 0x16 is the record type of a TLS handshake
+	if b, err := buffered.r.Peek(1); err == nil && b[0] == 0x16 {
+		c.inner = tls.Server(buffered, c.config)
+	}
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	c.once.Do(c.sniff)
+	return c.inner.Read(p)
+}
+
+func (c *sniffConn) Write(p []byte) (int, error) {
+	c.once.Do(c.sniff)
+	return c.inner.Write(p)
+}
+
+func (c *sniffConn) Close() error {
+	c.once.Do(func() { c.inner = c.Conn })
+	return c.inner.Close()
+}
@@ -0,0 +1,186 @@
+package xapitest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The XML-RPC wire format is small enough that we decode and encode it by
+// hand rather than pulling in a server library. Values decode to string,
+// bool, int64, float64, map[string]interface{} and []interface{}.
+
+type rpcCall struct {
+	MethodName string     `xml:"methodName"`
+	Params     []rpcValue `xml:"params>param>value"`
+}
+
+type rpcValue struct {
+	Text    string     `xml:",chardata"`
+	String  *string    `xml:"string"`
+	Int     *string    `xml:"int"`
+	I4      *string    `xml:"i4"`
+	I8      *string    `xml:"i8"`
+	Boolean *string    `xml:"boolean"`
+	Double  *string    `xml:"double"`
+	Base64  *string    `xml:"base64"`
+	Struct  *rpcStruct `xml:"struct"`
+	Array   *rpcArray  `xml:"array"`
+}
+
+type rpcStruct struct {
+	Members []rpcMember `xml:"member"`
+}
+
+type rpcMember struct {
+	Name  string   `xml:"name"`
+	Value rpcValue `xml:"value"`
+}
+
+type rpcArray struct {
+	Values []rpcValue `xml:"data>value"`
+}
+
+func decodeCall(r io.Reader) (method string, params []interface{}, err error) {
+	var call rpcCall
+	if err = xml.NewDecoder(r).Decode(&call); err != nil {
+		return "", nil, fmt.Errorf("Unable to decode method call: %s", err.Error())
+	}
+
+	params = make([]interface{}, 0, len(call.Params))
+	for _, v := range call.Params {
+		p, err := v.decode()
+		if err != nil {
+			return "", nil, err
+		}
+		params = append(params, p)
+	}
+
+	return call.MethodName, params, nil
+}
+
+func (v rpcValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Base64 != nil:
+		return *v.Base64, nil
+	case v.Int != nil, v.I4 != nil, v.I8 != nil:
+		raw := v.Int
+		if raw == nil {
+			raw = v.I4
+		}
+		if raw == nil {
+			raw = v.I8
+		}
+		return strconv.ParseInt(strings.TrimSpace(*raw), 10, 64)
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.Struct != nil:
+		m := make(map[string]interface{}, len(v.Struct.Members))
+		for _, member := range v.Struct.Members {
+			value, err := member.Value.decode()
+			if err != nil {
+				return nil, err
+			}
+			m[member.Name] = value
+		}
+		return m, nil
+	case v.Array != nil:
+		a := make([]interface{}, 0, len(v.Array.Values))
+		for _, elem := range v.Array.Values {
+			value, err := elem.decode()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		return a, nil
+	default:
+		// A bare <value> is a string
+		return v.Text, nil
+	}
+}
+
+func encodeResponse(w io.Writer, value interface{}) error {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0"?><methodResponse><params><param>`)
+	encodeValue(&b, value)
+	b.WriteString(`</param></params></methodResponse>`)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func encodeValue(b *bytes.Buffer, value interface{}) {
+	b.WriteString("<value>")
+
+	switch v := value.(type) {
+	case nil:
+		b.WriteString("<string></string>")
+	case string:
+		b.WriteString("<string>")
+		xml.EscapeText(b, []byte(v))
+		b.WriteString("</string>")
+	case bool:
+		if v {
+			b.WriteString("<boolean>1</boolean>")
+		} else {
+			b.WriteString("<boolean>0</boolean>")
+		}
+	case int:
+		fmt.Fprintf(b, "<int>%d</int>", v)
+	case int64:
+		fmt.Fprintf(b, "<int>%d</int>", v)
+	case float64:
+		fmt.Fprintf(b, "<double>%f</double>", v)
+	case []string:
+		b.WriteString("<array><data>")
+		for _, elem := range v {
+			encodeValue(b, elem)
+		}
+		b.WriteString("</data></array>")
+	case []interface{}:
+		b.WriteString("<array><data>")
+		for _, elem := range v {
+			encodeValue(b, elem)
+		}
+		b.WriteString("</data></array>")
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = e
+		}
+		encodeStruct(b, m)
+	case map[string]interface{}:
+		encodeStruct(b, v)
+	default:
+		panic(fmt.Sprintf("xapitest: cannot encode value of type %T", value))
+	}
+
+	b.WriteString("</value>")
+}
+
+func encodeStruct(b *bytes.Buffer, m map[string]interface{}) {
+	// Sort the members so responses are stable between runs
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b.WriteString("<struct>")
+	for _, k := range keys {
+		b.WriteString("<member><name>")
+		xml.EscapeText(b, []byte(k))
+		b.WriteString("</name>")
+		encodeValue(b, m[k])
+		b.WriteString("</member>")
+	}
+	b.WriteString("</struct>")
+}
@@ -13,15 +13,16 @@ import (
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
 	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type config struct {
 	common.PackerConfig   `mapstructure:",squash"`
 	xscommon.CommonConfig `mapstructure:",squash"`
 
-	SourcePath string `mapstructure:"source_path"`
-	VMMemory   uint   `mapstructure:"vm_memory"`
+	SourcePath         string `mapstructure:"source_path"`
+	SourceChecksum     string `mapstructure:"source_checksum"`
+	SourceChecksumType string `mapstructure:"source_checksum_type"`
+	VMMemory           uint   `mapstructure:"vm_memory"`
 
 	PlatformArgs map[string]string `mapstructure:"platform_args"`
 
@@ -52,6 +53,7 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
 
 	errs = packer.MultiErrorAppend(
 		errs, self.config.CommonConfig.Prepare(&self.config.ctx, &self.config.PackerConfig)...)
+	errs = packer.MultiErrorAppend(errs, self.config.SSHConfig.Prepare(&self.config.ctx)...)
 
 	// Set default values
 
@@ -59,6 +61,10 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
 		self.config.VMMemory = 1024
 	}
 
+	if self.config.SourceChecksumType == "" {
+		self.config.SourceChecksumType = "sha256"
+	}
+
 	if len(self.config.PlatformArgs) == 0 {
 		pargs := make(map[string]string)
 		pargs["viridian"] = "false"
@@ -76,6 +82,16 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
 		errs = packer.MultiErrorAppend(errs, fmt.Errorf("A source_path must be specified"))
 	}
 
+	if _, ok := checksumTypes[self.config.SourceChecksumType]; !ok {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_checksum_type must be one of 'md5', 'sha1', 'sha256' or 'sha512'"))
+	} else if self.config.SourceChecksum != "" && !validChecksum(self.config.SourceChecksum, self.config.SourceChecksumType) {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("source_checksum isn't a %s checksum", self.config.SourceChecksumType))
+	}
+
+	if self.config.Format == "vhd" && self.config.VHDExport == "nfs" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("vhd_export 'nfs' isn't supported by the xva builder"))
+	}
+
 	if len(errs.Errors) > 0 {
 		retErr = errors.New(errs.Error())
 	}
@@ -86,13 +102,17 @@ func (self *Builder) Prepare(raws ...interface{}) (params []string, retErr error
 
 func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
 	//Setup XAPI client
-	client := xsclient.NewXenAPIClient(self.config.HostIp, self.config.Username, self.config.Password)
+	tlsConfig, err := self.config.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := xscommon.NewXenAPIHypervisor(self.config.HostIp, self.config.Username, self.config.Password, self.config.XAPIProtocol, tlsConfig)
 
-	err := client.Login()
+	err = client.Login()
 	if err != nil {
 		return nil, err.(error)
 	}
-	ui.Say("XAPI client session established")
+	ui.Say(fmt.Sprintf("XAPI client session established over %s", client.Protocol()))
 
 	client.GetHosts()
 
@@ -109,6 +129,7 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 
 	//Build the steps
 	steps := []multistep.Step{
+		new(xscommon.StepConnectHostSSH),
 		&xscommon.StepPrepareOutputDir{
 			Force: self.config.PackerForce,
 			Path:  self.config.OutputDir,
@@ -136,11 +157,11 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 		new(stepImportInstance),
 		&xscommon.StepAttachVdi{
 			VdiUuidKey: "floppy_vdi_uuid",
-			VdiType:    xsclient.Floppy,
+			VdiType:    xscommon.Floppy,
 		},
 		&xscommon.StepAttachVdi{
 			VdiUuidKey: "tools_vdi_uuid",
-			VdiType:    xsclient.CD,
+			VdiType:    xscommon.CD,
 		},
 		new(xscommon.StepStartVmPaused),
 		new(xscommon.StepGetVNCPort),
@@ -151,6 +172,7 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			HostPortMax: self.config.HostPortMax,
 			ResultKey:   "local_vnc_port",
 		},
+		new(xscommon.StepStartVNCRecording),
 		new(xscommon.StepBootWait),
 		&xscommon.StepTypeBootCommand{
 			Ctx: self.config.ctx,
@@ -160,26 +182,32 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 			Timeout: 300 * time.Minute, /*self.config.InstallTimeout*/ // @todo change this
 		},
 		&xscommon.StepForwardPortOverSSH{
-			RemotePort:  xscommon.InstanceSSHPort,
+			RemotePort:  xscommon.InstanceCommPort,
 			RemoteDest:  xscommon.InstanceSSHIP,
 			HostPortMin: self.config.HostPortMin,
 			HostPortMax: self.config.HostPortMax,
-			ResultKey:   "local_ssh_port",
+			ResultKey:   "local_comm_port",
+
+			SkipInDirectMode: true,
 		},
 		&communicator.StepConnect{
-			Config:    &self.config.SSHConfig.Comm,
-			Host:      xscommon.CommHost,
-			SSHConfig: xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
-			SSHPort:   xscommon.SSHPort,
+			Config:      &self.config.SSHConfig.Comm,
+			Host:        xscommon.CommHost,
+			SSHConfig:   xscommon.SSHConfigFunc(self.config.CommonConfig.SSHConfig),
+			SSHPort:     xscommon.CommPort,
+			WinRMConfig: xscommon.WinRMConfigFunc,
 		},
 		new(common.StepProvision),
 		new(xscommon.StepShutdown),
+		new(xscommon.StepStopVNCRecording),
 		&xscommon.StepDetachVdi{
 			VdiUuidKey: "floppy_vdi_uuid",
 		},
 		&xscommon.StepDetachVdi{
 			VdiUuidKey: "tools_vdi_uuid",
 		},
+		// vm_memory isn't applied to the imported VM, so the ova descriptor
+		// reads its memory back from the VM
 		new(xscommon.StepExport),
 	}
 
@@ -205,6 +233,21 @@ func (self *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (pa
 		artifactState["virtualizationType"] = "HVM"
 	}
 
+	artifactState["format"] = self.config.Format
+	if checksums, ok := state.GetOk("export_checksums"); ok {
+		artifactState["checksums"] = checksums
+	}
+	artifactState["compression"] = self.config.ExportCompression
+	if sizes, ok := state.GetOk("export_sizes"); ok {
+		artifactState["sizes"] = sizes
+	}
+	if sizes, ok := state.GetOk("export_allocated_sizes"); ok {
+		artifactState["allocated_sizes"] = sizes
+	}
+	if sizes, ok := state.GetOk("export_virtual_sizes"); ok {
+		artifactState["virtual_sizes"] = sizes
+	}
+
 	artifact, _ := xscommon.NewArtifact(self.config.OutputDir, artifactState, state.Get("export_files").([]string))
 
 	return artifact, nil
@@ -3,6 +3,7 @@ package xva
 import (
 	"github.com/mitchellh/packer/packer"
 	"testing"
+	"time"
 )
 
 func testConfig() map[string]interface{} {
@@ -186,3 +187,328 @@ func TestBuilderPrepare_SourcePath(t *testing.T) {
 		t.Fatalf("should not have error: %s", err)
 	}
 }
+
+func TestBuilderPrepare_WinRM(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	delete(config, "ssh_username")
+	config["communicator"] = "winrm"
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["winrm_username"] = "Administrator"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if b.config.Comm.WinRMPort != 5985 {
+		t.Errorf("bad winrm port: %d", b.config.Comm.WinRMPort)
+	}
+}
+
+func TestBuilderPrepare_XAPIProtocol(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Default
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.XAPIProtocol != "xmlrpc" {
+		t.Errorf("bad xapi_protocol: %s", b.config.XAPIProtocol)
+	}
+
+	// Bad
+	config["xapi_protocol"] = "soap"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["xapi_protocol"] = "jsonrpc"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_SSHConnectMode(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Default
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.SSHConnectMode != "tunnel" {
+		t.Errorf("bad ssh_connect_mode: %s", b.config.SSHConnectMode)
+	}
+
+	// Bad
+	config["ssh_connect_mode"] = "bastion"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["ssh_connect_mode"] = "direct"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_VHDExport(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Default
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.VHDExport != "http" {
+		t.Errorf("bad vhd_export: %s", b.config.VHDExport)
+	}
+
+	// Bad
+	config["vhd_export"] = "smb"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// NFS needs a mounted SR, which the xva builder doesn't have
+	config["vhd_export"] = "nfs"
+	config["format"] = "vhd"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_ExportCompression(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Default
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.ExportCompression != "none" {
+		t.Errorf("bad export_compression: %s", b.config.ExportCompression)
+	}
+
+	// Bad
+	config["export_compression"] = "bzip2"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["export_compression"] = "zstd"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// Image formats are already compact, and an ova must stay a plain tar
+	config["format"] = "ova"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_SourceChecksum(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Bad
+	config["source_checksum"] = "abc123"
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Bad
+	config["source_checksum"] = "d41d8cd98f00b204e9800998ecf8427e"
+	config["source_checksum_type"] = "crc32"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["source_checksum_type"] = "md5"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_BootKeyInterval(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Default
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.BootKeyInterval != 50*time.Millisecond || b.config.BootKeyGroupInterval != 0 {
+		t.Errorf("bad intervals: %s, %s", b.config.BootKeyInterval, b.config.BootKeyGroupInterval)
+	}
+
+	// Bad
+	config["boot_key_interval"] = "fast"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Good
+	config["boot_key_interval"] = "200ms"
+	config["boot_keygroup_interval"] = "2s"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.BootKeyInterval != 200*time.Millisecond || b.config.BootKeyGroupInterval != 2*time.Second {
+		t.Errorf("bad intervals: %s, %s", b.config.BootKeyInterval, b.config.BootKeyGroupInterval)
+	}
+}
+
+func TestBuilderPrepare_VNCRecord(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Default
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.VNCRecord || b.config.VNCRecordInterval != time.Second {
+		t.Errorf("bad recording: %v, %s", b.config.VNCRecord, b.config.VNCRecordInterval)
+	}
+
+	// Bad
+	for _, interval := range []string{"often", "0s"} {
+		config["vnc_record_interval"] = interval
+		b = Builder{}
+		warns, err = b.Prepare(config)
+		if len(warns) > 0 {
+			t.Fatalf("bad: %#v", warns)
+		}
+		if err == nil {
+			t.Fatalf("%s should have error", interval)
+		}
+	}
+
+	// Good
+	config["vnc_record"] = true
+	config["vnc_record_interval"] = "500ms"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if !b.config.VNCRecord || b.config.VNCRecordInterval != 500*time.Millisecond {
+		t.Errorf("bad recording: %v, %s", b.config.VNCRecord, b.config.VNCRecordInterval)
+	}
+}
@@ -0,0 +1,232 @@
+package xva
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
+)
+
+/*
+ * The XVA to import can be a local file or an http(s) URL, and either can
+ * be gzip or zstd compressed, as '.xva.gz' or '.xva.zst'. It's streamed
+ * straight into the import, decompressing on the way, so nothing is staged
+ * on disk. The source_checksum is of the file as it's stored, before it's
+ * decompressed, and is checked as it's read: the last byte is held back
+ * until the checksum matches, so XAPI never sees the end of a bad XVA.
+ */
+
+var checksumTypes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func isRemoteSource(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// sourceCompression returns the compression of the XVA at path, judged by
+// its extension.
+func sourceCompression(path string) string {
+	if isRemoteSource(path) {
+		if u, err := url.Parse(path); err == nil {
+			path = u.Path
+		}
+	}
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(path, ".zst"):
+		return "zstd"
+	}
+	return "none"
+}
+
+// openSource returns an UploadSource for the XVA at path, which is checked
+// against checksum if it's set.
+func openSource(path, checksum, checksumType string) xscommon.UploadSource {
+	return func() (io.ReadCloser, int64, error) {
+		stored, length, err := openStored(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		raw := &storedReader{r: stored}
+		if checksum != "" {
+			raw.hash = checksumTypes[checksumType]()
+			raw.expected = strings.ToLower(checksum)
+		}
+
+		source := &sourceReader{path: path, raw: raw, Reader: raw, closers: []io.Closer{stored}}
+		switch sourceCompression(path) {
+		case "gzip":
+			gz, err := gzip.NewReader(raw)
+			if err != nil {
+				stored.Close()
+				return nil, 0, source.wrap(err)
+			}
+			source.Reader = gz
+			source.closers = append(source.closers, gz)
+			length = -1
+		case "zstd":
+			// Decoding synchronously, so errors reading raw are seen here
+			zr, err := zstd.NewReader(raw, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				stored.Close()
+				return nil, 0, source.wrap(err)
+			}
+			source.Reader = zr
+			source.closers = append(source.closers, zr.IOReadCloser())
+			length = -1
+		}
+		return source, length, nil
+	}
+}
+
+// openStored opens the XVA at path as it's stored, returning its length or
+// -1 if that isn't known.
+func openStored(path string) (io.ReadCloser, int64, error) {
+	if isRemoteSource(path) {
+		resp, err := http.Get(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err := fmt.Errorf("GET '%s' got non-200 status code: %s", path, resp.Status)
+			if resp.StatusCode < 500 {
+				return nil, 0, xscommon.UploadSourceError{Err: err}
+			}
+			return nil, 0, err
+		}
+		return resp.Body, resp.ContentLength, nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, 0, xscommon.UploadSourceError{Err: fmt.Errorf("Unable to open XVA '%s': %s", path, err.Error())}
+	}
+	fstat, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, 0, xscommon.UploadSourceError{Err: fmt.Errorf("Unable to stat '%s': %s", path, err.Error())}
+	}
+	return fh, fstat.Size(), nil
+}
+
+// storedReader reads the XVA as it's stored, keeping any error reading it
+// and checking it against expected if it's hashing. When it's hashing it
+// holds the last byte back until the checksum is known to match.
+type storedReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+	buf      []byte
+	pending  []byte
+	verified bool
+	err      error
+	mismatch error
+}
+
+func (self *storedReader) Read(p []byte) (int, error) {
+	if self.hash == nil {
+		n, err := self.r.Read(p)
+		if err != nil && err != io.EOF {
+			self.err = err
+		}
+		return n, err
+	}
+	if self.mismatch != nil {
+		return 0, self.mismatch
+	}
+	if self.buf == nil {
+		self.buf = make([]byte, 32*1024)
+	}
+
+	for {
+		available := len(self.pending) - 1
+		if self.verified {
+			available = len(self.pending)
+		}
+		if available > 0 || (available == 0 && len(p) == 0) {
+			n := copy(p, self.pending[:available])
+			self.pending = self.pending[n:]
+			return n, nil
+		}
+		if self.verified {
+			return 0, io.EOF
+		}
+
+		n, err := self.r.Read(self.buf)
+		self.hash.Write(self.buf[:n])
+		self.pending = append(self.pending, self.buf[:n]...)
+		if err == io.EOF {
+			if actual := hex.EncodeToString(self.hash.Sum(nil)); actual != self.expected {
+				self.mismatch = fmt.Errorf("checksum is %s, expected %s", actual, self.expected)
+				return 0, self.mismatch
+			}
+			self.verified = true
+		} else if err != nil {
+			self.err = err
+			return 0, err
+		}
+	}
+}
+
+// sourceReader reads the XVA, decompressed if need be. Errors reading it
+// are passed on as they are, so they're retried, but a bad checksum or bad
+// compressed data are UploadSourceErrors.
+type sourceReader struct {
+	io.Reader
+	path    string
+	raw     *storedReader
+	closers []io.Closer
+}
+
+func (self *sourceReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = self.wrap(err)
+	}
+	return n, err
+}
+
+func (self *sourceReader) wrap(err error) error {
+	switch {
+	case self.raw.mismatch != nil:
+		return xscommon.UploadSourceError{Err: fmt.Errorf("XVA '%s' is corrupt, its %s", self.path, self.raw.mismatch.Error())}
+	case self.raw.err != nil:
+		return self.raw.err
+	}
+	return xscommon.UploadSourceError{Err: fmt.Errorf("Unable to decompress XVA '%s': %s", self.path, err.Error())}
+}
+
+func (self *sourceReader) Close() error {
+	var err error
+	for i := len(self.closers) - 1; i >= 0; i-- {
+		if closeErr := self.closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// validChecksum reports whether checksum looks like a hex digest of the
+// given type.
+func validChecksum(checksum, checksumType string) bool {
+	digest, err := hex.DecodeString(checksum)
+	return err == nil && len(digest) == checksumTypes[checksumType]().Size()
+}
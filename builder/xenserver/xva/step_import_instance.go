@@ -2,22 +2,20 @@ package xva
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
-	xsclient "github.com/xenserver/go-xenserver-client"
 )
 
 type stepImportInstance struct {
-	instance *xsclient.VM
-	vdi      *xsclient.VDI
+	instance string
+	vdi      string
 }
 
 func (self *stepImportInstance) Run(state multistep.StateBag) multistep.StepAction {
 
-	client := state.Get("client").(xsclient.XenAPIClient)
+	client := state.Get("client").(xscommon.Hypervisor)
 	config := state.Get("config").(config)
 	ui := state.Get("ui").(packer.Ui)
 
@@ -30,29 +28,18 @@ func (self *stepImportInstance) Run(state multistep.StateBag) multistep.StepActi
 		return multistep.ActionHalt
 	}
 
-	// Open the file for reading (NB: httpUpload closes the file for us)
-	fh, err := os.Open(config.SourcePath)
+	// Stream the XVA from wherever it is, decompressing it as it goes
+	source := openSource(config.SourcePath, config.SourceChecksum, config.SourceChecksumType)
+	instance, err := xscommon.HTTPUploadSource(client.ImportURL(sr), config.SourcePath, source, state)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Unable to open XVA '%s': %s", config.SourcePath, err.Error()))
+		ui.Error(fmt.Sprintf("Unable to upload XVA: %s", err.Error()))
 		return multistep.ActionHalt
 	}
-
-	result, err := xscommon.HTTPUpload(fmt.Sprintf("https://%s/import?session_id=%s&sr_id=%s",
-		client.Host,
-		client.Session.(string),
-		sr.Ref,
-	), fh, state)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Unable to upload VDI: %s", err.Error()))
-		return multistep.ActionHalt
-	}
-	if result == nil {
+	if instance == "" {
 		ui.Error("XAPI did not reply with an instance reference")
 		return multistep.ActionHalt
 	}
 
-	instance := xsclient.VM(*result)
-
 	/*
 		err = instance.SetStaticMemoryRange(config.VMMemory*1024*1024, config.VMMemory*1024*1024)
 		if err != nil {
@@ -135,14 +122,14 @@ func (self *stepImportInstance) Run(state multistep.StateBag) multistep.StepActi
 
 	*/
 
-	instanceId, err := instance.GetUuid()
+	instanceId, err := client.GetVMUuid(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to get VM UUID: %s", err.Error()))
 		return multistep.ActionHalt
 	}
 	state.Put("instance_uuid", instanceId)
 
-	bootOrder, err := instance.GetHVMBootPolicy()
+	bootOrder, err := client.GetVMHVMBootPolicy(instance)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Unable to determine if VM is HVM or PV: %s", err.Error()))
 		return multistep.ActionHalt
@@ -150,7 +137,7 @@ func (self *stepImportInstance) Run(state multistep.StateBag) multistep.StepActi
 	
 	state.Put("virtualization_type", bootOrder)
 
-	instance.SetDescription(config.VMDescription)
+	err = client.SetVMDescription(instance, config.VMDescription)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error setting VM description: %s", err.Error()))
 		return multistep.ActionHalt
@@ -0,0 +1,156 @@
+package xva
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	xscommon "github.com/xenserverarmy/packer/builder/xenserver/common"
+	"github.com/xenserverarmy/packer/builder/xenserver/xapitest"
+)
+
+var testXVA = []byte(strings.Repeat("an XVA is a tar of the VM's metadata and disk blocks\n", 1000))
+
+func testImportState(t *testing.T, server *xapitest.Server, c config) multistep.StateBag {
+	client := xscommon.NewXenAPIHypervisor(server.Host(), server.Username, server.Password, "", server.TLSConfig())
+	if err := client.Login(); err != nil {
+		t.Fatalf("Login failed: %s", err)
+	}
+
+	c.UploadTimeout = time.Hour
+	state := new(multistep.BasicStateBag)
+	state.Put("client", client)
+	state.Put("config", c)
+	state.Put("commonconfig", c.CommonConfig)
+	state.Put("ui", &packer.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	})
+	return state
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestStepImportInstance_RemoteGzip(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(testXVA)
+	w.Close()
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/centos.xva.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(gz.Bytes())
+	}))
+	defer source.Close()
+
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testImportState(t, server, config{
+		SourcePath:         source.URL + "/images/centos.xva.gz?token=abc",
+		SourceChecksum:     checksum(gz.Bytes()),
+		SourceChecksumType: "sha256",
+	})
+
+	step := new(stepImportInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vm := server.FindByUuid("VM", state.Get("instance_uuid").(string))
+	if !bytes.Equal(server.Content(vm), testXVA) {
+		t.Fatal("the imported XVA wasn't decompressed")
+	}
+}
+
+func TestStepImportInstance_LocalZstd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var zst bytes.Buffer
+	w, _ := zstd.NewWriter(&zst)
+	w.Write(testXVA)
+	w.Close()
+	path := filepath.Join(dir, "centos.xva.zst")
+	if err := ioutil.WriteFile(path, zst.Bytes(), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testImportState(t, server, config{SourcePath: path})
+
+	step := new(stepImportInstance)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vm := server.FindByUuid("VM", state.Get("instance_uuid").(string))
+	if !bytes.Equal(server.Content(vm), testXVA) {
+		t.Fatal("the imported XVA wasn't decompressed")
+	}
+}
+
+func TestStepImportInstance_BadChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "centos.xva")
+	if err := ioutil.WriteFile(path, testXVA, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	server := xapitest.NewServer()
+	defer server.Close()
+	state := testImportState(t, server, config{
+		SourcePath:         path,
+		SourceChecksum:     checksum([]byte("something else")),
+		SourceChecksumType: "sha256",
+	})
+
+	step := new(stepImportInstance)
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	// The import is abandoned without being retried
+	created, cancelled := 0, 0
+	for _, call := range server.Calls() {
+		switch call {
+		case "task.create":
+			created++
+		case "task.cancel":
+			cancelled++
+		}
+	}
+	if created != 1 || cancelled != 1 {
+		t.Fatalf("expected one cancelled import task, got %d created and %d cancelled", created, cancelled)
+	}
+	if _, ok := state.GetOk("instance_uuid"); ok {
+		t.Fatal("no instance should have been imported")
+	}
+}
@@ -113,10 +113,13 @@ func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (pac
 
 	vhd := ""
 	for _, path := range artifact.Files() {
-		if strings.HasSuffix(path, ".vhd") {
+		if strings.HasSuffix(path, ".vhd") || strings.HasSuffix(path, ".vhd.gz") {
 			vhd = path
 			break
 		}
+		if strings.HasSuffix(path, ".vhd.zst") {
+			return nil, false, fmt.Errorf("CloudStack can't import zstd compressed VHDs; export with export_compression 'gzip' or 'none'")
+		}
 	}
 
 	if vhd == "" {
@@ -138,7 +141,14 @@ func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (pac
 	copyFromUrl := ""
 	uploadFile := vhd
 
-	if p.config.CompressVhd {
+	if strings.HasSuffix(vhd, ".gz") {
+		// The builder compressed the VHD as it exported it
+		if strings.HasSuffix (p.config.DownloadUrl, "/" ) {
+			copyFromUrl = p.config.DownloadUrl + file
+		} else {
+			copyFromUrl = fmt.Sprintf("%s/%s", p.config.DownloadUrl, file) 
+		}
+	} else if p.config.CompressVhd {
 		uploadFile = dir + "template.vhd.gzip"
 		os.Remove ( uploadFile ) // remove any existing file to ensure no corruption
 
@@ -1,6 +1,7 @@
 package xenserver
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
@@ -97,11 +98,14 @@ func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (pac
 
 	vhd := ""
 	for _, path := range artifact.Files() {
-		if strings.HasSuffix(path, ".vhd") && !strings.HasSuffix(path, "/0.vhd") {
+		if (strings.HasSuffix(path, ".vhd") || strings.HasSuffix(path, ".vhd.gz")) && !strings.HasSuffix(path, "/0.vhd") {
 			// 0.vhd is special in OpenStack on XenServer so should never be present
 			vhd = path
 			break
 		}
+		if strings.HasSuffix(path, ".vhd.zst") {
+			return nil, false, fmt.Errorf("Glance can't import zstd compressed VHDs; export with export_compression 'gzip' or 'none'")
+		}
 	}
 
 	if vhd == "" {
@@ -122,24 +126,41 @@ func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (pac
 
 	ui.Message(fmt.Sprintf("Uploading %s with mode %s to OpenStack Glance", vhd, vmMode))
 
-	// first we need to rename the artifact to 0.vhd, then compress it into a tgz
-	
 	dir, _ := path.Split(vhd)
 
-	osvhd := dir + "0.vhd"
-	os.Remove ( osvhd )	// remove any existing file to ensure no corruption
-
-	err := os.Rename ( vhd, osvhd )
-	if err != nil {
-		return nil, false, fmt.Errorf("Error renaming '%s' to '%s': %s", vhd, osvhd, err)		
-	}
-
 	ostgz := dir + "0.vhd.tgz"
 	os.Remove ( ostgz ) // remove any existing file to ensure no corruption
 
-	ui.Message(fmt.Sprintf("Compressing '%s' to '%s'", vhd, ostgz))	
+	var err error
+	if strings.HasSuffix(vhd, ".gz") {
+		// the builder already compressed the VHD, so it only needs wrapping as 0.vhd in a tar
+		sizes, _ := artifact.State("sizes").(map[string]string)
+		size, err := strconv.ParseInt ( sizes[vhd], 10, 64 )
+		if err != nil {
+			return nil, false, fmt.Errorf("The size of '%s' before compression is unknown", vhd)
+		}
+
+		ui.Message(fmt.Sprintf("Packaging '%s' as '%s'", vhd, ostgz))
 
-	err = compressVhd  ( osvhd, ostgz )
+		err = tarCompressedVhd ( vhd, size, ostgz )
+		if err != nil {
+			return nil, false, fmt.Errorf("Error packaging '%s': %s", vhd, err)
+		}
+	} else {
+		// first we need to rename the artifact to 0.vhd, then compress it into a tgz
+
+		osvhd := dir + "0.vhd"
+		os.Remove ( osvhd )	// remove any existing file to ensure no corruption
+
+		err = os.Rename ( vhd, osvhd )
+		if err != nil {
+			return nil, false, fmt.Errorf("Error renaming '%s' to '%s': %s", vhd, osvhd, err)		
+		}
+
+		ui.Message(fmt.Sprintf("Compressing '%s' to '%s'", vhd, ostgz))	
+
+		err = compressVhd  ( osvhd, ostgz )
+	}
 	
 	ui.Say("Authenticating to identity service")
 	// Authenticate with a username, password, tenant id.
@@ -306,4 +327,53 @@ func compressVhd ( osvhd string, ostgz string ) (err error) {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+// tarCompressedVhd builds the tgz from a gzipped VHD without recompressing it.
+// A gzip file can be several gzip streams one after another, so the tar header
+// and trailer are compressed on their own either side of a copy of the VHD.
+func tarCompressedVhd ( gzvhd string, size int64, ostgz string ) (err error) {
+
+	tgzWriter, err := os.Create(ostgz)
+	if err != nil {
+		return fmt.Errorf( "Failed creating file for compressed archive %s: %s", ostgz, err)
+	}
+	defer tgzWriter.Close()
+
+	// WriteHeader writes the header blocks straight through; the tar writer
+	// is then dropped as the VHD's data is added separately
+	var header bytes.Buffer
+	tarWriter := tar.NewWriter(&header)
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "0.vhd", Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}); err != nil {
+		return fmt.Errorf("Failed creating archive header for %s: %s", gzvhd, err)
+	}
+
+	if err := writeGzipped(tgzWriter, header.Bytes()); err != nil {
+		return fmt.Errorf("Failed writing archive header for %s: %s", gzvhd, err)
+	}
+
+	fileReader, err := os.Open(gzvhd)
+	if err != nil {
+		return fmt.Errorf("Failed opening file '%s' to write compressed archive. %s", gzvhd, err)
+	}
+	defer fileReader.Close()
+
+	if _, err = io.Copy(tgzWriter, fileReader); err != nil {
+		return fmt.Errorf("Failed copying file %s to archive: %s", gzvhd, err)
+	}
+
+	// pad the VHD to a whole block, then end the archive with two empty blocks
+	padding := (512 - size % 512) % 512
+	if err := writeGzipped(tgzWriter, make([]byte, padding + 1024)); err != nil {
+		return fmt.Errorf("Failed writing archive trailer for %s: %s", gzvhd, err)
+	}
+
+	return nil
+}
+
+func writeGzipped ( w io.Writer, data []byte ) error {
+	gzipWriter := gzip.NewWriter(w)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}